@@ -0,0 +1,144 @@
+package conman
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Authorization schemes for putting the AuthToken on a request.
+// See config.go for the details of each.
+const (
+	AuthSchemeBearer = "bearer"
+	AuthSchemeToken  = "token"
+	AuthSchemeBasic  = "basic"
+	AuthSchemeHeader = "header"
+	AuthSchemeQuery  = "query"
+	AuthSchemeNone   = "none"
+)
+
+// Used when authScheme is header or query and
+// authHeader or authParam isn't set.
+const (
+	DefaultAuthHeader = "X-Auth-Token"
+	DefaultAuthParam  = "access_token"
+)
+
+// authScheme returns the connection's scheme, defaulting to bearer.
+func (conn *Connection) authScheme() string {
+	if conn.AuthScheme == "" {
+		return AuthSchemeBearer
+	}
+	return strings.ToLower(conn.AuthScheme)
+}
+
+func validAuthScheme(scheme string) bool {
+	switch strings.ToLower(scheme) {
+	case "", AuthSchemeBearer, AuthSchemeToken, AuthSchemeBasic,
+		AuthSchemeHeader, AuthSchemeQuery, AuthSchemeNone:
+		return true
+	}
+	return false
+}
+
+// writesAuthorization is true if the connection's scheme puts the token in the Authorization header.
+func (conn *Connection) writesAuthorization() bool {
+	switch conn.authScheme() {
+	case AuthSchemeBearer, AuthSchemeToken, AuthSchemeBasic:
+		return true
+	case AuthSchemeHeader:
+		return strings.EqualFold(conn.AuthHeader, "Authorization")
+	}
+	return false
+}
+
+// checkSigningAuth is an error if the connection signs requests, and its scheme also
+// puts the token in the Authorization header, where the signature goes.
+func (conn *Connection) checkSigningAuth() error {
+	if conn.Signing.enabled() && conn.writesAuthorization() {
+		return fmt.Errorf("connection %q signs requests, and the signature replaces the Authorization header its %s %s would set",
+			conn.Name, AuthSchemeKey, conn.authScheme())
+	}
+	return nil
+}
+
+// applyAuth puts the token on the request according to the connection's AuthScheme.
+// A header set explicitly in the connection's Headers is left alone.
+func (conn *Connection) applyAuth(req *http.Request, token string) error {
+	if token == "" {
+		return nil
+	}
+
+	setHeader := func(name, value string) {
+		if req.Header.Get(name) == "" {
+			req.Header.Set(name, value)
+		}
+	}
+
+	switch conn.authScheme() {
+	case AuthSchemeBearer:
+		setHeader("Authorization", "Bearer "+token)
+	case AuthSchemeToken:
+		setHeader("Authorization", "token "+token)
+	case AuthSchemeBasic:
+		if req.Header.Get("Authorization") == "" {
+			user, password := token, ""
+			if i := strings.Index(token, ":"); i >= 0 {
+				user, password = token[:i], token[i+1:]
+			}
+			req.SetBasicAuth(user, password)
+		}
+	case AuthSchemeHeader:
+		name := conn.AuthHeader
+		if name == "" {
+			name = DefaultAuthHeader
+		}
+		setHeader(name, token)
+	case AuthSchemeQuery:
+		name := conn.AuthParam
+		if name == "" {
+			name = DefaultAuthParam
+		}
+		q := req.URL.Query()
+		if q.Get(name) == "" {
+			q.Set(name, token)
+			req.URL.RawQuery = q.Encode()
+		}
+	case AuthSchemeNone:
+	default:
+		return fmt.Errorf("connection %q has unknown %s %q", conn.Name, AuthSchemeKey, conn.AuthScheme)
+	}
+	return nil
+}
+
+// clearAuth takes the token applyAuth put on the request off again, so another can go on.
+// Like applyAuth, it leaves headers set in the connection's Headers alone.
+func (conn *Connection) clearAuth(req *http.Request) {
+	del := func(name string) {
+		for k := range conn.Headers {
+			if strings.EqualFold(k, name) {
+				return
+			}
+		}
+		req.Header.Del(name)
+	}
+
+	switch conn.authScheme() {
+	case AuthSchemeBearer, AuthSchemeToken, AuthSchemeBasic:
+		del("Authorization")
+	case AuthSchemeHeader:
+		name := conn.AuthHeader
+		if name == "" {
+			name = DefaultAuthHeader
+		}
+		del(name)
+	case AuthSchemeQuery:
+		name := conn.AuthParam
+		if name == "" {
+			name = DefaultAuthParam
+		}
+		q := req.URL.Query()
+		q.Del(name)
+		req.URL.RawQuery = q.Encode()
+	}
+}
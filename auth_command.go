@@ -0,0 +1,132 @@
+package conman
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// AuthCommand is a command that prints a token, like a git credential helper
+// or a kubectl exec plugin.
+type AuthCommand struct {
+	Command []string // The program and its arguments.
+	Env     []string // NAME=value variables added to the command's environment.
+	Format  string   // How the token is printed, see the AuthCommandFormat constants.
+}
+
+// Formats for an AuthCommand's output.
+const (
+	AuthCommandFormatText = "text" // The output is the token, the default.
+	AuthCommandFormatJSON = "json" // {"token": "...", "expiresAt": "<RFC 3339 time>"}
+)
+
+// maxCommandStderr is how much of a failed command's stderr goes in the error.
+const maxCommandStderr = 1024
+
+func (ac AuthCommand) format() string {
+	if ac.Format == "" {
+		return AuthCommandFormatText
+	}
+	return strings.ToLower(ac.Format)
+}
+
+// commandTokenSource gets tokens by running the connection's AuthCommand.
+type commandTokenSource struct {
+	conn Connection
+}
+
+func (s *commandTokenSource) Token(ctx context.Context) (*Token, error) {
+	ac := s.conn.AuthCommand
+	cmd := exec.CommandContext(ctx, expandPath(ac.Command[0]), ac.Command[1:]...)
+	cmd.Env = append(os.Environ(), ac.Env...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+
+	log := s.conn.logger()
+	start := time.Now()
+	if err := cmd.Run(); err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if len(msg) > maxCommandStderr {
+			msg = msg[:maxCommandStderr] + "…"
+		}
+		if msg != "" {
+			err = fmt.Errorf("%v: %s", err, msg)
+		}
+		log.WarnContext(ctx, "auth command failed", "command", ac.Command[0], LogElapsedKey, time.Since(start), "error", err)
+		return nil, fmt.Errorf("auth command %s failed: %w", ac.Command[0], err)
+	}
+
+	tok := &Token{}
+	switch ac.format() {
+	case AuthCommandFormatJSON:
+		var out struct {
+			Token     string    `json:"token"`
+			ExpiresAt time.Time `json:"expiresAt"`
+		}
+		if err := json.Unmarshal(stdout.Bytes(), &out); err != nil {
+			return nil, fmt.Errorf("couldn't decode the output of auth command %s: %v", ac.Command[0], err)
+		}
+		tok.AccessToken, tok.Expiry = out.Token, out.ExpiresAt
+	default:
+		tok.AccessToken = strings.TrimSpace(stdout.String())
+	}
+	if tok.AccessToken == "" {
+		return nil, fmt.Errorf("auth command %s didn't print a token", ac.Command[0])
+	}
+	log.InfoContext(ctx, "auth command token", "command", ac.Command[0], LogElapsedKey, time.Since(start), "expiry", tok.Expiry)
+	return tok, nil
+}
+
+// getAuthCommand reads the authCommand settings under the key ak.
+func getAuthCommand(ak string) AuthCommand {
+	key := func(k string) string { return fmt.Sprintf("%s.%s", ak, k) }
+	return AuthCommand{
+		Command: viper.GetStringSlice(key(CommandKey)),
+		Env:     viper.GetStringSlice(key(EnvKey)),
+		Format:  viper.GetString(key(FormatKey)),
+	}
+}
+
+func (ac AuthCommand) mergeConfig(m map[string]interface{}) {
+	command := make([]interface{}, len(ac.Command))
+	for i, a := range ac.Command {
+		command[i] = a
+	}
+	setKey(m, CommandKey, command)
+	env := make([]interface{}, len(ac.Env))
+	for i, e := range ac.Env {
+		env[i] = e
+	}
+	setKey(m, EnvKey, env)
+	setKey(m, FormatKey, ac.Format)
+}
+
+func (ac AuthCommand) validate() error {
+	if len(ac.Command) == 0 {
+		if len(ac.Env) > 0 || ac.Format != "" {
+			return fmt.Errorf("%s is needed", CommandKey)
+		}
+		return nil
+	}
+	if ac.Command[0] == "" {
+		return fmt.Errorf("%s has no program", CommandKey)
+	}
+	for _, e := range ac.Env {
+		if i := strings.Index(e, "="); i <= 0 {
+			return fmt.Errorf("%s %q isn't NAME=value", EnvKey, e)
+		}
+	}
+	switch ac.format() {
+	case AuthCommandFormatText, AuthCommandFormatJSON:
+	default:
+		return fmt.Errorf("unknown %s %q", FormatKey, ac.Format)
+	}
+	return nil
+}
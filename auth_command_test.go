@@ -0,0 +1,176 @@
+package conman
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// TestAuthCommandHelper isn't a test, it's the auth command the tests run.
+// It counts its runs in the file $RUNS, and prints what $OUTPUT says.
+func TestAuthCommandHelper(t *testing.T) {
+	if os.Getenv("CONMAN_AUTH_HELPER") != "1" {
+		return
+	}
+	f, _ := os.OpenFile(os.Getenv("RUNS"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	fmt.Fprintln(f, "run")
+	f.Close()
+	n := countRuns(os.Getenv("RUNS"))
+
+	switch out := os.Getenv("OUTPUT"); out {
+	case "fail":
+		fmt.Fprintln(os.Stderr, "no credentials found")
+		os.Exit(1)
+	case "json-expired":
+		fmt.Printf(`{"token": "json-%d", "expiresAt": %q}`, n, time.Now().Add(time.Second).Format(time.RFC3339))
+	case "json":
+		fmt.Printf(`{"token": "json-%d", "expiresAt": %q}`, n, time.Now().Add(time.Hour).Format(time.RFC3339))
+	default:
+		fmt.Printf("  %s-%d\n", out, n)
+	}
+	os.Exit(0)
+}
+
+func countRuns(fn string) int {
+	b, _ := ioutil.ReadFile(fn)
+	return strings.Count(string(b), "run")
+}
+
+func helperCommand(t *testing.T, output, format string) (AuthCommand, string) {
+	runs := filepath.Join(t.TempDir(), "runs")
+	return AuthCommand{
+		Command: []string{os.Args[0], "-test.run=^TestAuthCommandHelper$"},
+		Env:     []string{"CONMAN_AUTH_HELPER=1", "RUNS=" + runs, "OUTPUT=" + output},
+		Format:  format,
+	}, runs
+}
+
+func TestAuthCommand(t *testing.T) {
+	got := ""
+	recorder := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get("Authorization")
+	}))
+	defer recorder.Close()
+
+	cases := []struct {
+		name   string
+		output string
+		format string
+		runs   int
+		expect string
+	}{
+		{name: "text", output: "text", runs: 1, expect: "Bearer text-1"},
+		{name: "json", output: "json", format: AuthCommandFormatJSON, runs: 1, expect: "Bearer json-1"},
+		// A token about to expire isn't kept.
+		{name: "expired", output: "json-expired", format: AuthCommandFormatJSON, runs: 3, expect: "Bearer json-3"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ac, runs := helperCommand(t, c.output, c.format)
+			conn := Connection{Name: "command-" + c.name, ServiceURL: recorder.URL, AuthToken: "static", AuthCommand: ac}
+			if err := conn.validate(); err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 3; i++ {
+				if _, _, err := conn.Get("/", nil); err != nil {
+					t.Fatalf("Request failed: %v", err)
+				}
+			}
+			if n := countRuns(runs); n != c.runs || got != c.expect {
+				t.Errorf("Command ran %d times, got %q, expected %d times, %q", n, got, c.runs, c.expect)
+			}
+		})
+	}
+
+	var mu sync.Mutex
+	accept, unauthorized := "text-2", 0
+	api := apiServer(&mu, &accept, &unauthorized)
+	defer api.Close()
+
+	// A rejected token gets the command run again.
+	ac, runs := helperCommand(t, "text", "")
+	conn := Connection{Name: "command-401", ServiceURL: api.URL, AuthCommand: ac}
+	if _, _, err := conn.Get("/", nil); err != nil || unauthorized != 1 || countRuns(runs) != 2 {
+		t.Errorf("Got %d unauthorized, %d runs, error: %v", unauthorized, countRuns(runs), err)
+	}
+
+	// A failed command is an error, with its stderr.
+	ac, _ = helperCommand(t, "fail", "")
+	conn = Connection{Name: "command-fail", ServiceURL: api.URL, AuthCommand: ac}
+	if _, _, err := conn.Get("/", nil); err == nil || !strings.Contains(err.Error(), "no credentials found") {
+		t.Errorf("Expected the command's error, got %v", err)
+	}
+}
+
+func TestTokenSourceOrder(t *testing.T) {
+	tokens := newTokenServer(3600, false)
+	defer tokens.Close()
+	got := ""
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get("Authorization")
+	}))
+	defer api.Close()
+
+	ac, _ := helperCommand(t, "command", "")
+	clientCredentials := OAuth2Config{TokenURL: tokens.URL, ClientID: "client", ClientSecret: "secret"}
+	notLoggedIn := OAuth2Config{TokenURL: tokens.URL, AuthURL: tokens.URL, ClientID: "client"}
+	cases := []struct {
+		conn   Connection
+		expect string
+	}{
+		{Connection{Name: "order-1", OAuth2: clientCredentials, AuthCommand: ac, AuthToken: "static"}, "Bearer tok-1"},
+		{Connection{Name: "order-2", OAuth2: notLoggedIn, AuthCommand: ac, AuthToken: "static"}, "Bearer command-1"},
+		{Connection{Name: "order-3", OAuth2: notLoggedIn, AuthToken: "static"}, "Bearer static"},
+	}
+	for _, c := range cases {
+		c.conn.ServiceURL = api.URL
+		if _, _, err := c.conn.Get("/", nil); err != nil || got != c.expect {
+			t.Errorf("%s: got %q, expected %q, error: %v", c.conn.Name, got, c.expect, err)
+		}
+	}
+}
+
+func TestAuthCommandConfig(t *testing.T) {
+	defer resetConfig()
+	viper.Set(ConnectionsKey, map[string]interface{}{
+		"one": map[string]interface{}{
+			ServiceURLKey: "http://one.example.com",
+			AuthCommandKey: map[string]interface{}{
+				CommandKey: []interface{}{"~/bin/get-token", "--audience", "one"},
+				EnvKey:     []interface{}{"AWS_PROFILE=dev"},
+				FormatKey:  "json",
+			},
+		},
+	})
+	conn, _ := getConnectionFromConfig("one")
+	want := AuthCommand{Command: []string{"~/bin/get-token", "--audience", "one"}, Env: []string{"AWS_PROFILE=dev"}, Format: "json"}
+	if fmt.Sprintf("%#v", conn.AuthCommand) != fmt.Sprintf("%#v", want) {
+		t.Errorf("Got %#v", conn.AuthCommand)
+	}
+	m := make(map[string]interface{})
+	conn.mergeConfig(m)
+	if fmt.Sprint(m[AuthCommandKey]) != "map[command:[~/bin/get-token --audience one] env:[AWS_PROFILE=dev] format:json]" {
+		t.Errorf("Got config %v", m[AuthCommandKey])
+	}
+
+	for _, ac := range []AuthCommand{
+		{Format: "json"},
+		{Command: []string{""}},
+		{Command: []string{"get-token"}, Env: []string{"=x"}},
+		{Command: []string{"get-token"}, Format: "yaml"},
+	} {
+		conn.AuthCommand = ac
+		if err := conn.validate(); err == nil {
+			t.Errorf("Expected an error for %#v", ac)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package conman
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+)
+
+// Response bodies that are kept are read into buffers from a pool,
+// which go back in the pool when the body is closed.
+var bufferPool = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+// Buffers bigger than this aren't put back in the pool, so one huge
+// response doesn't pin the memory.
+const maxPooledBuffer = 1 << 20
+
+func getBuffer() *bytes.Buffer {
+	buf := bufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+func putBuffer(buf *bytes.Buffer) {
+	if buf.Cap() <= maxPooledBuffer {
+		bufferPool.Put(buf)
+	}
+}
+
+// pooledBody is a response body kept in a pooled buffer.
+type pooledBody struct {
+	mu  sync.Mutex
+	r   *bytes.Reader
+	buf *bytes.Buffer
+}
+
+func newPooledBody(buf *bytes.Buffer) *pooledBody {
+	return &pooledBody{r: bytes.NewReader(buf.Bytes()), buf: buf}
+}
+
+func (b *pooledBody) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.r == nil {
+		return 0, io.ErrClosedPipe
+	}
+	return b.r.Read(p)
+}
+
+func (b *pooledBody) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.buf != nil {
+		putBuffer(b.buf)
+		b.buf, b.r = nil, nil
+	}
+	return nil
+}
+
+// peekBody reads up to limit bytes of resp's body, all of it if limit is zero or less, and
+// puts them back in front of the rest so the body can be read again from the start.
+func peekBody(resp *http.Response, limit int64) ([]byte, error) {
+	r := io.Reader(resp.Body)
+	if limit > 0 {
+		r = io.LimitReader(resp.Body, limit)
+	}
+	b, err := ioutil.ReadAll(r)
+	resp.Body = &peekedBody{Reader: io.MultiReader(bytes.NewReader(b), resp.Body), Closer: resp.Body}
+	return b, err
+}
+
+// peekedBody is what peekBody read, then the rest of the body.
+type peekedBody struct {
+	io.Reader
+	io.Closer
+}
+
+// limitReader reads from r, but fails with a *BodyTooLargeError
+// if there are more than limit bytes.
+type limitReader struct {
+	r     io.Reader
+	n     int64 // Bytes left before the limit.
+	limit int64
+	url   string
+}
+
+func newLimitReader(r io.Reader, limit int64, url string) io.Reader {
+	if limit <= 0 {
+		return r
+	}
+	return &limitReader{r: r, n: limit, limit: limit, url: url}
+}
+
+func (l *limitReader) Read(p []byte) (int, error) {
+	if l.n < 0 {
+		return 0, &BodyTooLargeError{Limit: l.limit, URL: l.url}
+	}
+	// Read one more than is left, to tell if there's more than the limit.
+	if int64(len(p)) > l.n+1 {
+		p = p[:l.n+1]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	if l.n < 0 {
+		return n + int(l.n), &BodyTooLargeError{Limit: l.limit, URL: l.url}
+	}
+	return n, err
+}
@@ -0,0 +1,223 @@
+package conman
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// TransportConfig configures the http.Client a Connection builds for itself.
+// The zero value gives you the same behaviour as http.DefaultClient.
+type TransportConfig struct {
+	ProxyURL            string        // Empty uses the environment (HTTP_PROXY etc.), "direct" uses no proxy.
+	MaxIdleConns        int           // Zero uses the http.DefaultTransport value.
+	MaxIdleConnsPerHost int           // Zero uses http.DefaultMaxIdleConnsPerHost.
+	MaxConnsPerHost     int           // Zero means no limit.
+	IdleConnTimeout     time.Duration // Zero uses the http.DefaultTransport value.
+	KeepAlive           time.Duration // TCP keep-alive period, zero uses the net.Dialer default.
+	DisableKeepAlives   bool          // One request per TCP connection.
+	DisableHTTP2        bool
+	MaxRedirects        int  // Zero uses the http.Client default of 10.
+	NoRedirects         bool // Return redirect responses rather than following them.
+}
+
+// proxyDirect is the ProxyURL value for not using a proxy at all.
+const proxyDirect = "direct"
+
+// Defaults lifted from http.DefaultTransport.
+const (
+	defaultMaxIdleConns    = 100
+	defaultIdleConnTimeout = 90 * time.Second
+	defaultDialTimeout     = 30 * time.Second
+	defaultRedirects       = 10
+)
+
+// Clients are cached by connection name, so that all the copies of a connection
+// we get from the configuration share a connection pool. A change to the configuration,
+// or to the TLS files it names, replaces the client, and removing the connection drops it.
+var (
+	clientsMu sync.Mutex
+	clients   = make(map[string]keyedClient)
+)
+
+// keyedClient is a cached client, and the configuration it was built from.
+type keyedClient struct {
+	key    string
+	client *http.Client
+}
+
+// HTTPClient returns the http.Client used for the connection's requests,
+// building it from the connection's configuration the first time it's asked for.
+// If the connection has a RoundTripper it's used instead of building a transport.
+func (conn *Connection) HTTPClient() (*http.Client, error) {
+	if conn.RoundTripper != nil {
+		return conn.newClient(conn.RoundTripper), nil
+	}
+
+	key := conn.clientKey()
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	old, ok := clients[conn.Name]
+	if ok && old.key == key {
+		return old.client, nil
+	}
+
+	tr, err := conn.newTransport()
+	if err != nil {
+		return nil, err
+	}
+	c := conn.newClient(tr)
+	if ok {
+		old.client.CloseIdleConnections()
+	}
+	clients[conn.Name] = keyedClient{key: key, client: c}
+	return c, nil
+}
+
+func (conn *Connection) clientKey() string {
+	return fmt.Sprintf("%s|%#v|%#v|%s", conn.Name, conn.Transport, conn.TLS, conn.TLS.filesVersion())
+}
+
+// forgetConnection drops the cached client and token source for the named connection.
+func forgetConnection(name string) {
+	clientsMu.Lock()
+	if c, ok := clients[name]; ok {
+		c.client.CloseIdleConnections()
+		delete(clients, name)
+	}
+	clientsMu.Unlock()
+
+	tokenSourcesMu.Lock()
+	delete(tokenSources, name)
+	tokenSourcesMu.Unlock()
+}
+
+func (conn *Connection) newClient(rt http.RoundTripper) *http.Client {
+	return &http.Client{
+		Transport:     rt,
+		CheckRedirect: conn.Transport.checkRedirect,
+	}
+}
+
+func (tc TransportConfig) checkRedirect(req *http.Request, via []*http.Request) error {
+	if tc.NoRedirects {
+		return http.ErrUseLastResponse
+	}
+	max := tc.MaxRedirects
+	if max <= 0 {
+		max = defaultRedirects
+	}
+	if len(via) >= max {
+		return fmt.Errorf("stopped after %d redirects", max)
+	}
+	return nil
+}
+
+func (conn *Connection) newTransport() (*http.Transport, error) {
+	tc := conn.Transport
+
+	proxy, err := conn.proxy()
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig, err := conn.TLS.tlsClientConfig()
+	if err != nil {
+		return nil, fmt.Errorf("connection %q: %v", conn.Name, err)
+	}
+
+	tr := &http.Transport{
+		Proxy: proxy,
+		DialContext: (&net.Dialer{
+			Timeout:   defaultDialTimeout,
+			KeepAlive: tc.KeepAlive,
+		}).DialContext,
+		ForceAttemptHTTP2:     !tc.DisableHTTP2,
+		MaxIdleConns:          defaultMaxIdleConns,
+		MaxIdleConnsPerHost:   tc.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       tc.MaxConnsPerHost,
+		IdleConnTimeout:       defaultIdleConnTimeout,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		DisableKeepAlives:     tc.DisableKeepAlives,
+	}
+	if tc.MaxIdleConns > 0 {
+		tr.MaxIdleConns = tc.MaxIdleConns
+	}
+	if tc.IdleConnTimeout > 0 {
+		tr.IdleConnTimeout = tc.IdleConnTimeout
+	}
+	if tc.DisableHTTP2 {
+		// A non-nil empty map is how you turn HTTP/2 off.
+		tr.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	}
+	return tr, nil
+}
+
+// proxy returns the transport's Proxy function for the connection's proxyURL.
+func (conn *Connection) proxy() (func(*http.Request) (*url.URL, error), error) {
+	switch pu := conn.Transport.ProxyURL; pu {
+	case "":
+		return http.ProxyFromEnvironment, nil
+	case proxyDirect:
+		return nil, nil
+	default:
+		u, err := url.Parse(pu)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("connection %q has a bad proxy URL %q", conn.Name, pu)
+		}
+		return http.ProxyURL(u), nil
+	}
+}
+
+// getTransportConfig reads the transport settings under the key tk.
+func getTransportConfig(tk string) TransportConfig {
+	key := func(k string) string { return fmt.Sprintf("%s.%s", tk, k) }
+	return TransportConfig{
+		ProxyURL:            viper.GetString(key(ProxyURLKey)),
+		MaxIdleConns:        viper.GetInt(key(MaxIdleConnsKey)),
+		MaxIdleConnsPerHost: viper.GetInt(key(MaxIdleConnsPerHostKey)),
+		MaxConnsPerHost:     viper.GetInt(key(MaxConnsPerHostKey)),
+		IdleConnTimeout:     viper.GetDuration(key(IdleConnTimeoutKey)),
+		KeepAlive:           viper.GetDuration(key(KeepAliveKey)),
+		DisableKeepAlives:   viper.GetBool(key(DisableKeepAlivesKey)),
+		DisableHTTP2:        viper.GetBool(key(DisableHTTP2Key)),
+		MaxRedirects:        viper.GetInt(key(MaxRedirectsKey)),
+		NoRedirects:         viper.GetBool(key(NoRedirectsKey)),
+	}
+}
+
+func (tc TransportConfig) mergeConfig(m map[string]interface{}) {
+	setKey(m, ProxyURLKey, tc.ProxyURL)
+	setKey(m, MaxIdleConnsKey, tc.MaxIdleConns)
+	setKey(m, MaxIdleConnsPerHostKey, tc.MaxIdleConnsPerHost)
+	setKey(m, MaxConnsPerHostKey, tc.MaxConnsPerHost)
+	setKey(m, IdleConnTimeoutKey, durationValue(tc.IdleConnTimeout))
+	setKey(m, KeepAliveKey, durationValue(tc.KeepAlive))
+	setKey(m, DisableKeepAlivesKey, tc.DisableKeepAlives)
+	setKey(m, DisableHTTP2Key, tc.DisableHTTP2)
+	setKey(m, MaxRedirectsKey, tc.MaxRedirects)
+	setKey(m, NoRedirectsKey, tc.NoRedirects)
+}
+
+func (tc TransportConfig) validate() error {
+	if tc.ProxyURL != "" && tc.ProxyURL != proxyDirect {
+		if u, err := url.Parse(tc.ProxyURL); err != nil || u.Host == "" {
+			return fmt.Errorf("bad %s %q", ProxyURLKey, tc.ProxyURL)
+		}
+	}
+	if tc.MaxIdleConns < 0 || tc.MaxIdleConnsPerHost < 0 || tc.MaxConnsPerHost < 0 || tc.MaxRedirects < 0 {
+		return fmt.Errorf("connection limits can't be negative")
+	}
+	if tc.IdleConnTimeout < 0 {
+		return fmt.Errorf("%s can't be negative", IdleConnTimeoutKey)
+	}
+	return nil
+}
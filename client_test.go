@@ -0,0 +1,172 @@
+package conman
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+func TestRoundTripperInjection(t *testing.T) {
+	var got *http.Request
+	conn := Connection{
+		ServiceURL: "http://service.invalid",
+		RoundTripper: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			got = req
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Header:     http.Header{"Content-Type": []string{"application/json"}},
+				Body:       ioutil.NopCloser(strings.NewReader(`{"test": "value"}`)),
+				Request:    req,
+			}, nil
+		}),
+	}
+
+	var result map[string]string
+	if _, _, err := conn.Get("/path", &result); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if got == nil || got.URL.String() != "http://service.invalid/path" {
+		t.Errorf("RoundTripper got request: %v", got)
+	}
+	if result["test"] != "value" {
+		t.Errorf("Got result %#v", result)
+	}
+}
+
+func TestRedirectPolicy(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/done" {
+			return
+		}
+		var n int
+		fmt.Sscanf(r.URL.Path, "/%d", &n)
+		if n <= 1 {
+			http.Redirect(w, r, "/done", http.StatusFound)
+		} else {
+			http.Redirect(w, r, fmt.Sprintf("/%d", n-1), http.StatusFound)
+		}
+	}))
+	defer ts.Close()
+
+	cases := []struct {
+		name      string
+		transport TransportConfig
+		path      string
+		status    int
+		fails     bool
+	}{
+		{"Default follows", TransportConfig{}, "/3", http.StatusOK, false},
+		{"No redirects", TransportConfig{NoRedirects: true}, "/3", http.StatusFound, true},
+		{"Under max redirects", TransportConfig{MaxRedirects: 3}, "/2", http.StatusOK, false},
+		{"Over max redirects", TransportConfig{MaxRedirects: 2}, "/3", 0, true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			conn := Connection{Name: "redirect", ServiceURL: ts.URL, Transport: c.transport}
+			_, resp, err := conn.Get(c.path, nil)
+			if (err != nil) != c.fails {
+				t.Errorf("Got error: %v, expected error: %t", err, c.fails)
+			}
+			if c.status != 0 && (resp == nil || resp.StatusCode != c.status) {
+				t.Errorf("Got response: %v, expected status %d", resp, c.status)
+			}
+		})
+	}
+}
+
+func TestProxyURL(t *testing.T) {
+	var got string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.URL.String()
+	}))
+	defer proxy.Close()
+
+	conn := Connection{
+		Name:       "proxied",
+		ServiceURL: "http://service.invalid",
+		Transport:  TransportConfig{ProxyURL: proxy.URL},
+	}
+	if _, _, err := conn.Get("/path", nil); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if got != "http://service.invalid/path" {
+		t.Errorf("Proxy got: %q", got)
+	}
+
+	conn.Transport.ProxyURL = "://bad"
+	if _, _, err := conn.Get("/path", nil); err == nil {
+		t.Errorf("Expected an error for a bad proxy URL.")
+	}
+}
+
+func TestClientCache(t *testing.T) {
+	tc := TransportConfig{
+		MaxIdleConns:        7,
+		MaxIdleConnsPerHost: 3,
+		IdleConnTimeout:     time.Minute,
+		DisableKeepAlives:   true,
+		DisableHTTP2:        true,
+	}
+	a := Connection{Name: "cached", Transport: tc}
+	b := Connection{Name: "cached", Transport: tc}
+
+	ca, err := a.HTTPClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cb, _ := b.HTTPClient()
+	if ca != cb {
+		t.Errorf("Expected connections with the same configuration to share a client.")
+	}
+
+	b.Transport.MaxIdleConns = 8
+	if cb, _ = b.HTTPClient(); ca == cb {
+		t.Errorf("Expected a new client for a changed configuration.")
+	}
+
+	tr, ok := ca.Transport.(*http.Transport)
+	if !ok {
+		t.Fatalf("Expected an *http.Transport, got %T", ca.Transport)
+	}
+	if tr.MaxIdleConns != 7 || tr.MaxIdleConnsPerHost != 3 || tr.IdleConnTimeout != time.Minute ||
+		!tr.DisableKeepAlives || tr.ForceAttemptHTTP2 || tr.TLSNextProto == nil {
+		t.Errorf("Transport not configured: %#v", tr)
+	}
+}
+
+// A connection has one client, replaced when its configuration or TLS files change.
+func TestClientCacheReplaced(t *testing.T) {
+	certFile, keyFile := writeClientCert(t, t.TempDir())
+	conn := Connection{Name: "replaced", TLS: TLSConfig{CertFile: certFile, KeyFile: keyFile}}
+	first, err := conn.HTTPClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, _ := conn.HTTPClient(); c != first {
+		t.Errorf("Expected the same client for the same files.")
+	}
+
+	later := time.Now().Add(time.Hour)
+	if err = os.Chtimes(certFile, later, later); err != nil {
+		t.Fatal(err)
+	}
+	second, _ := conn.HTTPClient()
+	if second == first || clients[conn.Name].client != second {
+		t.Errorf("Expected a new client, in place of the old one, for a changed certificate.")
+	}
+
+	forgetConnection(conn.Name)
+	if _, ok := clients[conn.Name]; ok {
+		t.Errorf("Expected the client to be dropped.")
+	}
+}
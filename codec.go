@@ -0,0 +1,274 @@
+package conman
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"mime"
+	"net/url"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v2"
+)
+
+//
+// Codecs
+//
+// Request content is encoded, and response bodies decoded, by a Codec chosen by media type:
+// the request's Content-Type (application/json unless set with WithContentType or a
+// Content-Type header on a Request) and the response's Content-Type.
+// A response without a Content-Type is decoded with the codec for the Accept header we sent.
+// JSON, form, XML and YAML codecs are registered to start with, others (e.g. msgpack)
+// can be added with RegisterCodec.
+//
+// Raw content doesn't go through a codec: a []byte or io.Reader is sent as is, and
+// a *[]byte, *string or io.Writer result gets the response body as is, whatever its type.
+//
+
+// Media types of the built in codecs.
+const (
+	JSONContentType = "application/json"
+	FormContentType = "application/x-www-form-urlencoded"
+	XMLContentType  = "application/xml"
+	YAMLContentType = "application/yaml"
+	RawContentType  = "application/octet-stream"
+)
+
+// Codec marshals request content and unmarshals response bodies for a media type.
+// Unmarshal mustn't keep data after it returns, the buffer is reused.
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// StreamDecoder is a Codec that can also decode straight from a response body,
+// without it being read into memory first.
+type StreamDecoder interface {
+	Codec
+	Decode(r io.Reader, v interface{}) error
+}
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = map[string]Codec{
+		JSONContentType:      JSONCodec{},
+		"text/json":          JSONCodec{},
+		FormContentType:      FormCodec{},
+		XMLContentType:       XMLCodec{},
+		"text/xml":           XMLCodec{},
+		YAMLContentType:      YAMLCodec{},
+		"application/x-yaml": YAMLCodec{},
+		"text/yaml":          YAMLCodec{},
+		"text/x-yaml":        YAMLCodec{},
+	}
+)
+
+// RegisterCodec sets the codec for the media type, replacing any already registered.
+// Passing a nil codec removes it.
+func RegisterCodec(mediaType string, c Codec) {
+	mediaType = strings.ToLower(mediaType)
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	if c == nil {
+		delete(codecs, mediaType)
+		return
+	}
+	codecs[mediaType] = c
+}
+
+// LookupCodec returns the codec for a media type, or Content-Type header value.
+// Structured syntax suffixes are understood, so application/vnd.api+json gets the JSON codec.
+func LookupCodec(contentType string) (Codec, bool) {
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, false
+	}
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	if c, ok := codecs[mt]; ok {
+		return c, true
+	}
+	if i := strings.LastIndex(mt, "+"); i >= 0 {
+		if c, ok := codecs["application/"+mt[i+1:]]; ok {
+			return c, true
+		}
+	}
+	return nil, false
+}
+
+// encodeContent turns content into a request body using the codec for contentType.
+// A string is sent as is, for compatibility, as are []byte and io.Reader.
+func encodeContent(contentType string, content interface{}) (io.Reader, error) {
+	switch c := content.(type) {
+	case string:
+		// If we marshall the string, it escapes the quotes: "foo" => \"foo\".
+		// This makes for bad JSON.
+		return strings.NewReader(c), nil
+	case []byte:
+		return bytes.NewReader(c), nil
+	case io.Reader:
+		return c, nil
+	}
+
+	codec, ok := LookupCodec(contentType)
+	if !ok {
+		return nil, fmt.Errorf("no codec to encode content as %q", contentType)
+	}
+	b, err := codec.Marshal(content)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(b), nil
+}
+
+// decodeRaw puts body into obj if obj wants the body as is.
+// A *string only gets the body as is if it has a Content-Type that isn't JSON. A JSON body,
+// or one without a Content-Type, is decoded into it as a JSON string, as it always has been.
+func decodeRaw(contentType string, body []byte, obj interface{}) (bool, error) {
+	switch o := obj.(type) {
+	case *[]byte:
+		*o = append([]byte(nil), body...)
+	case *string:
+		if contentType == "" || isJSON(contentType) {
+			return false, nil
+		}
+		*o = string(body)
+	case io.Writer:
+		_, err := o.Write(body)
+		return true, err
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+func isJSON(contentType string) bool {
+	c, ok := LookupCodec(contentType)
+	if !ok {
+		return false
+	}
+	_, ok = c.(JSONCodec)
+	return ok
+}
+
+// isRaw is true if content or a result is sent or received without a codec.
+func isRaw(v interface{}) bool {
+	switch v.(type) {
+	case []byte, io.Reader, *[]byte, *string, io.Writer:
+		return true
+	}
+	return false
+}
+
+// JSONCodec encodes and decodes JSON. Responses are decoded with the DecodeOptions.
+type JSONCodec struct {
+	DecodeOptions
+}
+
+func (JSONCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (c JSONCodec) Unmarshal(data []byte, v interface{}) error {
+	return c.decodeJSON(data, v)
+}
+
+func (c JSONCodec) Decode(r io.Reader, v interface{}) error {
+	return c.streamJSON(r, v)
+}
+
+// FormCodec encodes and decodes application/x-www-form-urlencoded.
+// It marshals url.Values, map[string]string, map[string][]string and map[string]interface{}
+// (using fmt to format values), and unmarshals into pointers to the first three.
+type FormCodec struct{}
+
+func (FormCodec) Marshal(v interface{}) ([]byte, error) {
+	q := make(url.Values)
+	switch m := v.(type) {
+	case url.Values:
+		q = m
+	case map[string][]string:
+		q = url.Values(m)
+	case map[string]string:
+		for k, s := range m {
+			q.Set(k, s)
+		}
+	case map[string]interface{}:
+		for k, s := range m {
+			q.Set(k, fmt.Sprintf("%v", s))
+		}
+	default:
+		return nil, fmt.Errorf("can't form encode a %T", v)
+	}
+	return []byte(q.Encode()), nil
+}
+
+func (FormCodec) Unmarshal(data []byte, v interface{}) error {
+	q, err := url.ParseQuery(string(data))
+	if err != nil {
+		return err
+	}
+	switch m := v.(type) {
+	case *url.Values:
+		*m = q
+	case *map[string][]string:
+		*m = q
+	case *map[string]string:
+		if *m == nil {
+			*m = make(map[string]string, len(q))
+		}
+		for k := range q {
+			(*m)[k] = q.Get(k)
+		}
+	default:
+		return fmt.Errorf("can't form decode into a %T", v)
+	}
+	return nil
+}
+
+// XMLCodec encodes and decodes XML with encoding/xml.
+type XMLCodec struct{}
+
+func (XMLCodec) Marshal(v interface{}) ([]byte, error) {
+	return xml.Marshal(v)
+}
+
+func (XMLCodec) Unmarshal(data []byte, v interface{}) error {
+	return xml.Unmarshal(data, v)
+}
+
+func (XMLCodec) Decode(r io.Reader, v interface{}) error {
+	return xml.NewDecoder(r).Decode(v)
+}
+
+// YAMLCodec encodes and decodes YAML.
+// Maps decoded into an interface{} or map[string]interface{} have string keys, as they would with JSON.
+type YAMLCodec struct{}
+
+func (YAMLCodec) Marshal(v interface{}) ([]byte, error) {
+	return yaml.Marshal(v)
+}
+
+func (YAMLCodec) Unmarshal(data []byte, v interface{}) error {
+	if err := yaml.Unmarshal(data, v); err != nil {
+		return err
+	}
+	switch o := v.(type) {
+	case *interface{}:
+		*o = normalizeValue(*o)
+	case *map[string]interface{}:
+		normalizeValue(*o)
+	}
+	return nil
+}
+
+// accept is the Accept header to send when we want a result decoded.
+func accept(result interface{}) string {
+	if isRaw(result) {
+		return "*/*"
+	}
+	return JSONContentType
+}
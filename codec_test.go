@@ -0,0 +1,182 @@
+package conman
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestCodecs(t *testing.T) {
+	var got *http.Request
+	var gotBody string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		b, _ := ioutil.ReadAll(r.Body)
+		gotBody = string(b)
+		switch r.URL.Path {
+		case "/xml":
+			w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+			fmt.Fprint(w, `<user><name>xml</name></user>`)
+		case "/yaml":
+			w.Header().Set("Content-Type", "application/x-yaml")
+			fmt.Fprint(w, "name: yaml\nnested:\n  a: 1\n")
+		case "/untyped":
+			w.Header()["Content-Type"] = nil
+			fmt.Fprint(w, `<user><name>untyped</name></user>`)
+		case "/form":
+			w.Header().Set("Content-Type", FormContentType)
+			fmt.Fprint(w, "name=form&x=1")
+		case "/csv":
+			w.Header().Set("Content-Type", "text/csv")
+			fmt.Fprint(w, "name\ncsv\n")
+		case "/string":
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, `"abc"`)
+		default:
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, `{"name": "json"}`)
+		}
+	}))
+	defer ts.Close()
+
+	conn := Connection{ServiceURL: ts.URL}
+	ctx := context.Background()
+
+	type user struct {
+		XMLName xml.Name `xml:"user" json:"-" yaml:"-"`
+		Name    string   `xml:"name" json:"name" yaml:"name"`
+	}
+
+	t.Run("Form request, XML response", func(t *testing.T) {
+		var u user
+		_, _, err := conn.SendContext(ctx, http.MethodPost, "/xml", url.Values{"a": {"b c"}}, &u,
+			WithContentType(FormContentType), WithAccept(XMLContentType))
+		if err != nil || u.Name != "xml" {
+			t.Fatalf("Got %#v, error: %v", u, err)
+		}
+		if ct := got.Header.Get("Content-Type"); ct != FormContentType || gotBody != "a=b+c" {
+			t.Errorf("Got Content-Type %q, body %q", ct, gotBody)
+		}
+		if a := got.Header.Get("Accept"); a != XMLContentType {
+			t.Errorf("Got Accept %q", a)
+		}
+	})
+
+	t.Run("Builder content type header", func(t *testing.T) {
+		var m map[string]string
+		_, _, err := conn.Request(http.MethodPut).Path("form").
+			Header("Content-Type", FormContentType).
+			Body(map[string]string{"x": "1"}).
+			Result(&m).Do(ctx)
+		if err != nil || m["name"] != "form" || gotBody != "x=1" {
+			t.Errorf("Got %v, body %q, error: %v", m, gotBody, err)
+		}
+	})
+
+	t.Run("YAML response", func(t *testing.T) {
+		var m map[string]interface{}
+		if _, _, err := conn.Get("/yaml", &m); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if nested, ok := m["nested"].(map[string]interface{}); !ok || m["name"] != "yaml" || nested["a"] != 1 {
+			t.Errorf("Got %#v", m)
+		}
+	})
+
+	t.Run("Untyped response uses Accept", func(t *testing.T) {
+		var u user
+		_, _, err := conn.SendContext(ctx, http.MethodGet, "/untyped", nil, &u, WithAccept("application/xml, */*;q=0.1"))
+		if err != nil || u.Name != "untyped" {
+			t.Errorf("Got %#v, error: %v", u, err)
+		}
+	})
+
+	t.Run("Default Accept", func(t *testing.T) {
+		var u user
+		if _, _, err := conn.Get("/", &u); err != nil || u.Name != "json" {
+			t.Errorf("Got %#v, error: %v", u, err)
+		}
+		if a := got.Header.Get("Accept"); a != JSONContentType {
+			t.Errorf("Got Accept %q", a)
+		}
+	})
+
+	t.Run("Raw", func(t *testing.T) {
+		var b []byte
+		if _, _, err := conn.Post("/csv", []byte("raw"), &b); err != nil || string(b) != "name\ncsv\n" {
+			t.Errorf("Got %q, error: %v", b, err)
+		}
+		if ct := got.Header.Get("Content-Type"); ct != RawContentType || gotBody != "raw" {
+			t.Errorf("Got Content-Type %q, body %q", ct, gotBody)
+		}
+
+		// A string gets a text body as is, but a JSON one decoded.
+		var text, str string
+		if _, _, err := conn.Get("/csv", &text); err != nil || text != "name\ncsv\n" {
+			t.Errorf("Got %q, error: %v", text, err)
+		}
+		if _, _, err := conn.Get("/string", &str); err != nil || str != "abc" {
+			t.Errorf("Got %q, error: %v", str, err)
+		}
+
+		var buf bytes.Buffer
+		if _, _, err := conn.Post("/", strings.NewReader("reader"), &buf); err != nil || buf.String() != `{"name": "json"}` || gotBody != "reader" {
+			t.Errorf("Got %q, body %q, error: %v", buf.String(), gotBody, err)
+		}
+	})
+
+	t.Run("No codec", func(t *testing.T) {
+		var m map[string]interface{}
+		_, _, err := conn.Get("/csv", &m)
+		var cterr *ContentTypeError
+		if !errors.As(err, &cterr) || cterr.ContentType != "text/csv" {
+			t.Errorf("Expected a ContentTypeError, got: %v", err)
+		}
+
+		RegisterCodec("text/csv", csvCodec{})
+		defer RegisterCodec("text/csv", nil)
+		var rows [][]string
+		if _, _, err = conn.Get("/csv", &rows); err != nil || len(rows) != 2 || rows[1][0] != "csv" {
+			t.Errorf("Got %v, error: %v", rows, err)
+		}
+	})
+}
+
+// csvCodec is a minimal codec to test registration.
+type csvCodec struct{}
+
+func (csvCodec) Marshal(v interface{}) ([]byte, error) { return nil, errors.New("not implemented") }
+
+func (csvCodec) Unmarshal(data []byte, v interface{}) error {
+	rows := v.(*[][]string)
+	for _, l := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		*rows = append(*rows, strings.Split(l, ","))
+	}
+	return nil
+}
+
+func TestLookupCodec(t *testing.T) {
+	cases := map[string]Codec{
+		"application/json":                  JSONCodec{},
+		"application/vnd.api+json":          JSONCodec{},
+		"application/problem+json; q=1":     JSONCodec{},
+		"application/atom+xml":              XMLCodec{},
+		"Application/X-WWW-Form-Urlencoded": FormCodec{},
+		"text/html":                         nil,
+		"not a media type;;":                nil,
+	}
+	for ct, expects := range cases {
+		c, ok := LookupCodec(ct)
+		if ok != (expects != nil) || c != expects {
+			t.Errorf("%q: expected %T, got %T", ct, expects, c)
+		}
+	}
+}
@@ -13,14 +13,177 @@ package conman
 //       connection-name-1:
 //             serviceURL: http://localhost
 //						 authToken: XXX-YYY-ZZZ
+//             authScheme: bearer
+//             timeout: 30s
 //             heaeders:
 //                   X-APP-PARAM:  some-param
+//             transport:
+//                   proxyURL: http://proxy.example.com:3128
+//                   maxIdleConnsPerHost: 10
+//             tls:
+//                   caFile: ~/.certs/private-ca.pem
+//             oauth2:
+//                   tokenURL: https://auth.example.com/oauth/token
+//                   clientID: my-client
+//                   clientSecret: XXX-YYY-ZZZ
+//                   scopes: [read, write]
 //       connection-name-2:
 //             serviceURL: http://localhost
 //						 authToken: XXX-YYY-ZZZ
 //             heaeders:
 //                   X-APP-PARAM:  some-param
 //
+// References
+// serviceURL, authToken, header values, the oauth2 clientID, clientSecret and refreshToken,
+// and the signing secret and sessionToken can refer to secrets kept out of the config file.
+// The references are resolved when the connection is loaded (see LoadConnection):
+//     ${env:NAME}       - the environment variable NAME, an error if it isn't set.
+//     ${NAME}           - the same.
+//     ${NAME:-default}  - NAME if it's set and not empty, otherwise default.
+//     ${file:path}      - the contents of the file, without a trailing newline. path can start with ~/.
+//     $$                - a $.
+// A $ that doesn't start one of these is left as it is.
+// This changed how some values are read: before references, a $$ in one of these values was
+// two $s, and now it's one, and a ${ that isn't a reference stops the connection loading.
+// Write $$ for a $ that's followed by another $ or a {. GetConnection and GetAllConnections
+// log connections that don't load and leave them out, LoadConnection and LoadAllConnections
+// return the errors.
+// Updating a connection writes the references back, rather than what they resolved to,
+// unless the value has been changed.
+//
+// Encryption
+// The same values can be kept in the config file encrypted, as ENC[...] (AES-256-GCM).
+// They're decrypted when the connection is loaded, and stay encrypted in the file and in
+// Describe. EncryptConnectionValue encrypts a value in place, and RotateSecretKey encrypts
+// them all again with a new key. The key is set with SetSecretKey, or at the top level:
+//     encryption:
+//           keyFile: ~/.conman/key       - a file with a 32 byte key, e.g. from GenerateKeyFile.
+//           passphraseEnv: MY_PASSPHRASE  - without a keyFile, the environment variable with
+//                                           the passphrase the key is derived from (scrypt),
+//                                           CONMAN_PASSPHRASE by default.
+// Without either PassphraseFunc, if it's set, is asked for the passphrase.
+//
+// AuthScheme
+// authScheme says how the authToken is put on a request, one of:
+//     bearer  - Authorization: Bearer <authToken> (the default)
+//     token   - Authorization: token <authToken>
+//     basic   - Basic auth, authToken is user:password
+//     header  - the raw token in the header named by authHeader
+//     query   - the token in the query parameter named by authParam
+//     none    - don't send the token.
+// If the connection's headers already set the header the scheme would use,
+// the configured header wins and the token isn't added.
+//
+// Timeout
+// timeout is a duration (e.g. 500ms, 30s, 1m) that limits the time a request
+// can take, including reading the response body. Zero or unset means no limit.
+//
+// Transport
+// Each connection builds its own http.Client. The transport section configures it:
+//     proxyURL             - proxy for requests, "direct" for none. Defaults to HTTP_PROXY etc.
+//     maxIdleConns         - idle connection pool size.
+//     maxIdleConnsPerHost  - idle connection pool size per host.
+//     maxConnsPerHost      - limit on connections per host, including those in use.
+//     idleConnTimeout      - how long an idle connection stays in the pool.
+//     keepAlive            - TCP keep-alive period.
+//     disableKeepAlives    - use a new TCP connection for every request.
+//     disableHTTP2         - only use HTTP/1.1.
+//     maxRedirects         - number of redirects followed, default 10.
+//     noRedirects          - don't follow redirects, return the redirect response.
+//
+// TLS
+// The tls section configures TLS for the connection:
+//     caFile              - PEM file of CA certificates to trust as well as the system roots.
+//     certFile            - PEM client certificate for mutual TLS.
+//     keyFile             - PEM key for the client certificate.
+//     insecureSkipVerify  - don't verify the server certificate. Only for testing.
+//     pins                - list of base64 SHA-256 public key hashes (optionally prefixed sha256/),
+//                           the server must present a certificate matching one of them.
+//
+// Retry
+// The retry section sets when a request is retried:
+//     maxAttempts    - total attempts including the first, 0 or 1 for no retries.
+//     baseDelay      - starting backoff delay, defaults to 100ms.
+//     maxDelay       - longest backoff delay, defaults to 10s.
+//     statusCodes    - response codes to retry, defaults to [429, 502, 503, 504].
+//     networkErrors  - retry if the request fails with a network error.
+//     allMethods     - also retry non-idempotent methods (POST and PATCH).
+// A Retry-After header on a retried response overrides the backoff delay. If it asks for
+// longer than maxDelay the request isn't retried, and the response is returned.
+//
+// Decode
+// The decode section sets how JSON responses are decoded:
+//     disallowUnknownFields  - it's an error for the response to have fields the result doesn't.
+//     useNumber              - numbers decoded into an interface{} are json.Number rather than float64.
+//     maxBodySize            - bytes of a response body to read before giving up, 0 for no limit.
+//                              An HTTPError, and the debug dump, only get this much of the body.
+//     discardBody            - decode the body as it's read, rather than keeping it in resp.Body.
+//
+// OAuth2
+// A connection with an oauth2 section gets its access tokens from an OAuth2 token endpoint,
+// rather than using authToken. Tokens are cached until they expire, and fetched again if the
+// service rejects one with a 401:
+//     tokenURL      - the token endpoint.
+//     clientID      - the client ID.
+//     clientSecret  - the client secret, if the client has one.
+//     scopes        - list of scopes to ask for.
+//     refreshToken  - if set, tokens come from the refresh_token grant rather than client_credentials.
+//                     If the server rotates it, the new one is only kept in memory until
+//                     Connection.SaveRefreshToken writes it back.
+//     authStyle     - how the client ID and secret are sent: header (basic auth, the default)
+//                     or params (in the form body).
+// The token is put on requests according to authScheme, as authToken would be.
+//
+// Login
+// People, rather than services, log in with a browser or another device, see Connection.Login.
+// For that the oauth2 section has one or both of:
+//     authURL        - the authorization endpoint, for the authorization code flow with PKCE.
+//     deviceAuthURL  - the device authorization endpoint, for the device flow.
+// Login saves the refresh token it gets in refreshToken (or the access token in authToken if
+// there isn't one). Until then the connection uses authToken.
+//
+// AuthCommand
+// A connection with an authCommand section gets its token by running a command, like a
+// git credential helper, rather than keeping it in the config file:
+//     command  - the program and its arguments, e.g. [gcloud, auth, print-access-token].
+//     env      - list of NAME=value variables to add to the command's environment.
+//     format   - how the command prints the token:
+//                    text  - the token is all of the output (the default).
+//                    json  - {"token": "...", "expiresAt": "2006-01-02T15:04:05Z"},
+//                            expiresAt (RFC 3339) is optional.
+// The token is kept until it expires, or the service rejects it with a 401, and
+// then the command is run again. If the connection has oauth2 tokens they're used instead.
+//
+// Signing
+// A connection with a signing section signs every request, after middleware, just before
+// it's sent. The canonicalisation is described in signing.go:
+//     scheme           - hmac-sha256, or aws-sigv4 for AWS Signature Version 4.
+//     keyID            - the key ID, or the AWS access key ID. It's in the Authorization header.
+//     secret           - the signing secret, or the AWS secret access key.
+//     headers          - list of other headers to sign, e.g. [Content-Type, X-Request-Id].
+//     unsignedPayload  - don't hash the body, e.g. for large uploads. Bodies streamed from a
+//                        reader can't be read twice to hash them, so need it.
+//     region           - aws-sigv4 region.
+//     service          - aws-sigv4 service.
+//     sessionToken     - aws-sigv4 session token, for temporary credentials.
+// The signature goes in the Authorization header, so authScheme has to be none, query, or header
+// with another authHeader. bearer, the default, isn't allowed.
+//
+// Hints
+// hints maps an HTTP status code to a suggestion added to the error
+// for a response with that status, e.g.
+//     hints:
+//           404: Check the project name.
+// A connection with hints doesn't use the DefaultHints.
+//
+// Redaction
+// Secrets are masked (e.g. abcd…wxyz) in debug and verbose output, and in Describe and List.
+// The header and field names that are masked can be added to at the top level:
+//     redact:
+//           headers: [X-Session]
+//           fields: [pin]
+// Set showSecrets: true to turn off redaction altogether.
+//
 // DefaultConnection
 // If the config paramater defaultConnection is set, then this name is used as a default,
 // if there is connection with that name deflined.
@@ -33,9 +196,108 @@ package conman
 const (
 	ConnectionsKey           = "connections"       // string
 	DefaultConnectionNameKey = "defaultConnection" // string
+	ShowSecretsKey           = "showSecrets"       // bool
+	RedactKey                = "redact"            // map[string]interface{}
+	EncryptionKey            = "encryption"        // map[string]interface{}
 	ServiceURLKey            = "serviceURL"        // string
 	AuthTokenKey             = "authToken"         //string
 	HeadersKey               = "headers"           // map[string]string
+	AuthSchemeKey            = "authScheme"        // string
+	AuthHeaderKey            = "authHeader"        // string
+	AuthParamKey             = "authParam"         // string
+	TimeoutKey               = "timeout"           // time.Duration
+	TransportKey             = "transport"         // map[string]interface{}
+	TLSKey                   = "tls"               // map[string]interface{}
+	HintsKey                 = "hints"             // map[int]string
+	RetryKey                 = "retry"             // map[string]interface{}
+	DecodeKey                = "decode"            // map[string]interface{}
+	OAuth2Key                = "oauth2"            // map[string]interface{}
+	AuthCommandKey           = "authCommand"       // map[string]interface{}
+	SigningKey               = "signing"           // map[string]interface{}
+)
+
+// Keys in the redact section.
+const (
+	RedactHeadersKey = "headers" // []string
+	RedactFieldsKey  = "fields"  // []string
+)
+
+// Keys in the encryption section.
+const (
+	EncryptionKeyFileKey = "keyFile"       // string
+	PassphraseEnvKey     = "passphraseEnv" // string
+)
+
+// Keys in the transport section.
+const (
+	ProxyURLKey            = "proxyURL"            // string
+	MaxIdleConnsKey        = "maxIdleConns"        // int
+	MaxIdleConnsPerHostKey = "maxIdleConnsPerHost" // int
+	MaxConnsPerHostKey     = "maxConnsPerHost"     // int
+	IdleConnTimeoutKey     = "idleConnTimeout"     // time.Duration
+	KeepAliveKey           = "keepAlive"           // time.Duration
+	DisableKeepAlivesKey   = "disableKeepAlives"   // bool
+	DisableHTTP2Key        = "disableHTTP2"        // bool
+	MaxRedirectsKey        = "maxRedirects"        // int
+	NoRedirectsKey         = "noRedirects"         // bool
+)
+
+// Keys in the tls section.
+const (
+	CAFileKey             = "caFile"             // string
+	CertFileKey           = "certFile"           // string
+	KeyFileKey            = "keyFile"            // string
+	InsecureSkipVerifyKey = "insecureSkipVerify" // bool
+	PinsKey               = "pins"               // []string
+)
+
+// Keys in the decode section.
+const (
+	DisallowUnknownFieldsKey = "disallowUnknownFields" // bool
+	UseNumberKey             = "useNumber"             // bool
+	MaxBodySizeKey           = "maxBodySize"           // int64
+	DiscardBodyKey           = "discardBody"           // bool
+)
+
+// Keys in the oauth2 section.
+const (
+	TokenURLKey      = "tokenURL"      // string
+	AuthURLKey       = "authURL"       // string
+	DeviceAuthURLKey = "deviceAuthURL" // string
+	ClientIDKey      = "clientID"      // string
+	ClientSecretKey  = "clientSecret"  // string
+	ScopesKey        = "scopes"        // []string
+	RefreshTokenKey  = "refreshToken"  // string
+	AuthStyleKey     = "authStyle"     // string
+)
+
+// Keys in the authCommand section.
+const (
+	CommandKey = "command" // []string
+	EnvKey     = "env"     // []string
+	FormatKey  = "format"  // string
+)
+
+// Keys in the signing section.
+const (
+	SigningSchemeKey   = "scheme"          // string
+	KeyIDKey           = "keyID"           // string
+	SigningSecretKey   = "secret"          // string
+	SignedHeadersKey   = "headers"         // []string
+	UnsignedPayloadKey = "unsignedPayload" // bool
+	RegionKey          = "region"          // string
+	ServiceKey         = "service"         // string
+	SessionTokenKey    = "sessionToken"    // string
+)
+
+// Keys in the retry section.
+const (
+	MaxAttemptsKey      = "maxAttempts"   // int
+	BaseDelayKey        = "baseDelay"     // time.Duration
+	MaxDelayKey         = "maxDelay"      // time.Duration
+	RetryStatusCodesKey = "statusCodes"   // []int
+	NetworkErrorsKey    = "networkErrors" // bool
+	AllMethodsKey       = "allMethods"    // bool
 )
 
 // ConnectionFlagKey          = "connection"        //string
@@ -0,0 +1,217 @@
+package conman
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	toml "github.com/pelletier/go-toml"
+	"github.com/spf13/viper"
+	yaml "gopkg.in/yaml.v2"
+)
+
+//
+// Reading and writing the config file viper loaded.
+//
+// We don't use viper.WriteConfig() for this. Viper writes out
+// all of its settings (including flags and overrides), and it lower cases
+// every key on the way through. Instead we read the file ourselves into a
+// generic map, change only the connections we're asked to change, and write
+// the map back out in the same format. Keys we don't know about are left alone.
+// (Comments, unfortunately, don't survive the trip).
+//
+
+type configFile struct {
+	path   string
+	format string
+	data   map[string]interface{}
+}
+
+// loadConfigFile reads the file viper loaded the configuration from.
+// Returns nil, nil if viper didn't load a file.
+func loadConfigFile() (cf *configFile, err error) {
+	path := viper.ConfigFileUsed()
+	if path == "" {
+		return nil, nil
+	}
+
+	cf = &configFile{
+		path:   path,
+		format: strings.ToLower(strings.TrimPrefix(filepath.Ext(path), ".")),
+		data:   make(map[string]interface{}),
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch cf.format {
+	case "yaml", "yml":
+		m := make(map[interface{}]interface{})
+		if err = yaml.Unmarshal(b, &m); err == nil {
+			cf.data = normalizeMap(m)
+		}
+	case "toml":
+		var tree *toml.Tree
+		if tree, err = toml.LoadBytes(b); err == nil {
+			cf.data = tree.ToMap()
+		}
+	case "json":
+		if len(strings.TrimSpace(string(b))) > 0 {
+			err = json.Unmarshal(b, &cf.data)
+		}
+	default:
+		err = fmt.Errorf("can't update config file %q: unsupported format %q", path, cf.format)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read config file %q: %v", path, err)
+	}
+	return cf, nil
+}
+
+// write the config back out to the file it came from.
+func (cf *configFile) write() (err error) {
+	var b []byte
+	switch cf.format {
+	case "yaml", "yml":
+		b, err = yaml.Marshal(cf.data)
+	case "toml":
+		var tree *toml.Tree
+		if tree, err = toml.TreeFromMap(cf.data); err == nil {
+			var s string
+			s, err = tree.ToTomlString()
+			b = []byte(s)
+		}
+	case "json":
+		b, err = json.MarshalIndent(cf.data, "", "  ")
+	default:
+		err = fmt.Errorf("unsupported format %q", cf.format)
+	}
+	if err != nil {
+		return fmt.Errorf("couldn't write config file %q: %v", cf.path, err)
+	}
+
+	mode := os.FileMode(0644)
+	if fi, statErr := os.Stat(cf.path); statErr == nil {
+		mode = fi.Mode()
+	}
+	return ioutil.WriteFile(cf.path, b, mode)
+}
+
+// connections returns the connections map from the file,
+// creating it if necessary.
+func (cf *configFile) connections() map[string]interface{} {
+	k, v := findKey(cf.data, ConnectionsKey)
+	if m, ok := v.(map[string]interface{}); ok {
+		return m
+	}
+	if k == "" {
+		k = ConnectionsKey
+	}
+	m := make(map[string]interface{})
+	cf.data[k] = m
+	return m
+}
+
+// findKey does a case insensitive lookup of key in m, viper style.
+// Returns the key as it's actually spelled in the map.
+func findKey(m map[string]interface{}, key string) (string, interface{}) {
+	if v, ok := m[key]; ok {
+		return key, v
+	}
+	for k, v := range m {
+		if strings.EqualFold(k, key) {
+			return k, v
+		}
+	}
+	return "", nil
+}
+
+// setKey sets key in m, replacing any entry which differs only by case.
+// If value is the zero value for its type the key is removed instead.
+func setKey(m map[string]interface{}, key string, value interface{}) {
+	for k := range m {
+		if strings.EqualFold(k, key) {
+			delete(m, k)
+		}
+	}
+	if !isEmptyValue(value) {
+		m[key] = value
+	}
+}
+
+// subMap returns a copy of the map at key in m,
+// or an empty map if there isn't one.
+func subMap(m map[string]interface{}, key string) map[string]interface{} {
+	if _, v := findKey(m, key); v != nil {
+		switch vv := v.(type) {
+		case map[string]interface{}:
+			return copyMap(vv)
+		case map[interface{}]interface{}:
+			return normalizeMap(vv)
+		}
+	}
+	return make(map[string]interface{})
+}
+
+// durations are written out as strings (e.g. 1m30s) which
+// is what viper wants to read.
+func durationValue(d time.Duration) string {
+	if d == 0 {
+		return ""
+	}
+	return d.String()
+}
+
+func isEmptyValue(v interface{}) bool {
+	switch vv := v.(type) {
+	case nil:
+		return true
+	case string:
+		return vv == ""
+	case bool:
+		return !vv
+	case int:
+		return vv == 0
+	case int64:
+		return vv == 0
+	case map[string]interface{}:
+		return len(vv) == 0
+	case []interface{}:
+		return len(vv) == 0
+	}
+	return false
+}
+
+// yaml.v2 gives us map[interface{}]interface{} all the way down.
+// Everything else wants map[string]interface{}.
+func normalizeMap(m map[interface{}]interface{}) map[string]interface{} {
+	nm := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		nm[fmt.Sprintf("%v", k)] = normalizeValue(v)
+	}
+	return nm
+}
+
+func normalizeValue(v interface{}) interface{} {
+	switch vv := v.(type) {
+	case map[interface{}]interface{}:
+		return normalizeMap(vv)
+	case map[string]interface{}:
+		for k, e := range vv {
+			vv[k] = normalizeValue(e)
+		}
+		return vv
+	case []interface{}:
+		for i, e := range vv {
+			vv[i] = normalizeValue(e)
+		}
+		return vv
+	}
+	return v
+}
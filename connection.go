@@ -1,10 +1,15 @@
 package conman
 
 import (
+	"errors"
 	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
 	"sort"
+	"strings"
+	"time"
 
-	t "github.com/jdrivas/termtext"
 	"github.com/jdrivas/vconfig"
 	"github.com/spf13/viper"
 )
@@ -13,16 +18,46 @@ import (
 // Public API
 //
 
-// TODO: Add a way to add an connection object to the configuration
-// extra points for adding a anbility to add it to the configuration file if one
-// is there.
-
 // Connection contains information for connecting to a service endpoint.
 type Connection struct {
-	Name       string
-	ServiceURL string
-	AuthToken  string
-	Headers    map[string]string
+	Name        string
+	ServiceURL  string
+	AuthToken   string
+	AuthScheme  string // How AuthToken is sent, see the AuthScheme constants.
+	AuthHeader  string // Header name for the header scheme.
+	AuthParam   string // Query parameter name for the query scheme.
+	Headers     map[string]string
+	Timeout     time.Duration // Zero means no timeout.
+	Transport   TransportConfig
+	TLS         TLSConfig
+	Retry       RetryPolicy
+	Decode      DecodeOptions
+	OAuth2      OAuth2Config  // If TokenURL is set, tokens come from here rather than AuthToken.
+	AuthCommand AuthCommand   // If there's a Command, and no OAuth2 tokens, tokens come from here.
+	Signing     SigningConfig // If there's a Scheme, each request is signed.
+
+	// TokenSource, if set, supplies the tokens for requests in place of
+	// OAuth2, AuthCommand and AuthToken. See CachedTokenSource.
+	TokenSource TokenSource
+
+	// Logger, if set, is used for this connection's diagnostics
+	// instead of the package logger (see SetLogger).
+	Logger *slog.Logger
+
+	// Hints are added to HTTPErrors by status code.
+	// If nil, DefaultHints are used.
+	Hints map[int]string
+
+	// RoundTripper, if set, is used to make the requests rather than
+	// a transport built from the Transport configuration.
+	// Use it to inject a custom http.RoundTripper, e.g. for tests.
+	RoundTripper http.RoundTripper
+
+	// Middleware wraps each attempt at a request on this connection, see Use.
+	Middleware []Middleware
+
+	// refs are the values that had references in them, by config key, see resolveRefs.
+	refs map[string]secretRef
 }
 
 // ConnectionList for handling our set of connections.
@@ -38,10 +73,7 @@ func (a byName) Less(i, j int) bool { return a[i].Name < a[j].Name }
 func GetCurrentConnection() (c *Connection, err error) {
 	if viper.IsSet(DefaultConnectionNameKey) {
 		cn := viper.GetString(DefaultConnectionNameKey)
-		var ok bool
-		if c, ok = GetConnection(cn); !ok {
-			err = fmt.Errorf("couldn't find connection: %q", cn)
-		}
+		c, err = LoadConnection(cn)
 	} else {
 		err = fmt.Errorf("defualt connection not set")
 	}
@@ -49,26 +81,108 @@ func GetCurrentConnection() (c *Connection, err error) {
 }
 
 // GetConnection by name (from configuration).
+// If the connection's references can't be resolved the error is logged, and it's not found.
+// Use LoadConnection to get the error.
 func GetConnection(name string) (*Connection, bool) {
-	return getConnectionFromConfig(name)
+	c, err := LoadConnection(name)
+	if err != nil {
+		if connectionExists(name) {
+			Logger().Error("couldn't load connection", LogConnectionKey, name, "error", err)
+		}
+		return nil, false
+	}
+	return c, true
+}
+
+// LoadConnection gets the named connection from the configuration,
+// with the references in its values resolved (see config.go).
+func LoadConnection(name string) (*Connection, error) {
+	c, ok := getConnectionFromConfig(name)
+	if !ok {
+		return nil, fmt.Errorf("couldn't find connection: %q", name)
+	}
+	if err := c.resolveRefs(); err != nil {
+		return nil, err
+	}
+	return c, nil
 }
 
 // SetConnection sets a new default.
 func SetConnection(name string) (ok bool) {
-	var conn *Connection
-	if conn, ok = GetConnection(name); ok {
-		vconfig.Set(DefaultConnectionNameKey, conn.Name)
+	if ok = connectionExists(name); ok {
+		vconfig.Set(DefaultConnectionNameKey, name)
 	}
 	return ok
 }
 
-// GetAllConnections returns a list of known connections
+// AddConnection adds a new connection to the configuration.
+// If viper loaded a config file, the connection is written to it as well.
+// It's an error to add a connection with a name that's already in use.
+func AddConnection(conn *Connection) (err error) {
+	if err = conn.validate(); err != nil {
+		return err
+	}
+	if connectionExists(conn.Name) {
+		return fmt.Errorf("connection %q already exists", conn.Name)
+	}
+	return updateConnectionsConfig(func(conns map[string]interface{}) {
+		putConnection(conns, conn)
+	})
+}
+
+// UpdateConnection replaces the configuration of an existing connection
+// with the values in conn, in memory and in the config file if there is one.
+// Keys in the config file that Connection doesn't know about are left alone.
+// Values that were encrypted in the config file are encrypted again if they've changed.
+func UpdateConnection(conn *Connection) (err error) {
+	if err = conn.validate(); err != nil {
+		return err
+	}
+	if !connectionExists(conn.Name) {
+		return fmt.Errorf("couldn't find connection: %q", conn.Name)
+	}
+	if err = conn.encryptChangedRefs(); err != nil {
+		return err
+	}
+	return updateConnectionsConfig(func(conns map[string]interface{}) {
+		putConnection(conns, conn)
+	})
+}
+
+// RemoveConnection deletes the named connection from the configuration
+// and from the config file if there is one.
+// If it was the default connection, the default is left pointing at a
+// connection that doesn't exist, so use SetConnection to pick a new one.
+func RemoveConnection(name string) (err error) {
+	if !connectionExists(name) {
+		return fmt.Errorf("couldn't find connection: %q", name)
+	}
+	err = updateConnectionsConfig(func(conns map[string]interface{}) {
+		if k, _ := findKey(conns, name); k != "" {
+			delete(conns, k)
+		}
+	})
+	if err == nil {
+		forgetConnection(name)
+	}
+	return err
+}
+
+// GetAllConnections returns a list of known connections.
+// Connections that can't be loaded are logged and left out, use LoadAllConnections to get the errors.
 func GetAllConnections() ConnectionList {
-	conns := getAllConnectionsFromConfig()
-	sort.Sort(byName(conns))
+	conns, _ := LoadAllConnections()
 	return conns
 }
 
+// LoadAllConnections returns the connections that load, and an error for each one that doesn't,
+// e.g. because of a reference that can't be resolved.
+func LoadAllConnections() (ConnectionList, error) {
+	conns, err := getAllConnectionsFromConfig()
+	sort.Sort(byName(conns))
+	return conns, err
+}
+
 // FindConnection returns a connection if it's in the list
 // otherwise nil.
 func (cl ConnectionList) FindConnection(name string) (conn *Connection) {
@@ -83,33 +197,200 @@ func (cl ConnectionList) FindConnection(name string) (conn *Connection) {
 
 // Private API
 // Read in the config to get all the named connections
-
-func getAllConnectionsFromConfig() (cl ConnectionList) {
+// Connections whose references can't be resolved are logged and left out, and their errors returned.
+func getAllConnectionsFromConfig() (cl ConnectionList, err error) {
 	cm := viper.GetStringMap(ConnectionsKey) // map[string]interface{}
+	names := make([]string, 0, len(cm))
 	for name := range cm {
-		if c, ok := getConnectionFromConfig(name); ok {
-			cl = append(cl, c)
-		} else {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var errs []error
+	for _, name := range names {
+		if !connectionExists(name) {
 			panic(fmt.Sprintf("Expected but couldn't find connection name %q in configuration.", name))
 		}
+		c, err := LoadConnection(name)
+		if err != nil {
+			Logger().Error("couldn't load connection", LogConnectionKey, name, "error", err)
+			errs = append(errs, err)
+			continue
+		}
+		cl = append(cl, c)
 	}
-	return cl
+	return cl, errors.Join(errs...)
+}
+
+func connectionExists(name string) bool {
+	return viper.IsSet(fmt.Sprintf("%s.%s", ConnectionsKey, name))
 }
 
 func getConnectionFromConfig(name string) (c *Connection, ok bool) {
 	ck := fmt.Sprintf("%s.%s", ConnectionsKey, name)
 	if viper.IsSet(ck) {
 		c = &Connection{
-			Name:       name,
-			ServiceURL: viper.GetString(fmt.Sprintf("%s.%s", ck, ServiceURLKey)),
-			AuthToken:  viper.GetString(fmt.Sprintf("%s.%s", ck, AuthTokenKey)),
-			Headers:    viper.GetStringMapString(fmt.Sprintf("%s.%s", ck, HeadersKey)),
+			Name:        name,
+			ServiceURL:  viper.GetString(fmt.Sprintf("%s.%s", ck, ServiceURLKey)),
+			AuthToken:   viper.GetString(fmt.Sprintf("%s.%s", ck, AuthTokenKey)),
+			AuthScheme:  viper.GetString(fmt.Sprintf("%s.%s", ck, AuthSchemeKey)),
+			AuthHeader:  viper.GetString(fmt.Sprintf("%s.%s", ck, AuthHeaderKey)),
+			AuthParam:   viper.GetString(fmt.Sprintf("%s.%s", ck, AuthParamKey)),
+			Headers:     viper.GetStringMapString(fmt.Sprintf("%s.%s", ck, HeadersKey)),
+			Timeout:     viper.GetDuration(fmt.Sprintf("%s.%s", ck, TimeoutKey)),
+			Transport:   getTransportConfig(fmt.Sprintf("%s.%s", ck, TransportKey)),
+			TLS:         getTLSConfig(fmt.Sprintf("%s.%s", ck, TLSKey)),
+			Retry:       getRetryPolicy(fmt.Sprintf("%s.%s", ck, RetryKey)),
+			Decode:      getDecodeOptions(fmt.Sprintf("%s.%s", ck, DecodeKey)),
+			OAuth2:      getOAuth2Config(fmt.Sprintf("%s.%s", ck, OAuth2Key)),
+			AuthCommand: getAuthCommand(fmt.Sprintf("%s.%s", ck, AuthCommandKey)),
+			Signing:     getSigningConfig(fmt.Sprintf("%s.%s", ck, SigningKey)),
+			Hints:       getHints(fmt.Sprintf("%s.%s", ck, HintsKey)),
 		}
 		ok = true
 	}
 	return c, ok
 }
 
+// updateConnectionsConfig applies update to the connections map in the config
+// file, if viper loaded one, and to viper's in memory configuration.
+// The file is written first, so if that fails nothing has changed.
+func updateConnectionsConfig(update func(conns map[string]interface{})) (err error) {
+	var cf *configFile
+	if cf, err = loadConfigFile(); err != nil {
+		return err
+	}
+	if cf != nil {
+		update(cf.connections())
+		if err = cf.write(); err != nil {
+			return err
+		}
+		if err = viper.ReadInConfig(); err != nil {
+			return err
+		}
+	}
+
+	// Viper has no way to unset a key, so we replace the whole connections map.
+	conns := copyMap(viper.GetStringMap(ConnectionsKey))
+	update(conns)
+	viper.Set(ConnectionsKey, conns)
+	return nil
+}
+
+// putConnection adds or updates conn in a connections map.
+func putConnection(conns map[string]interface{}, conn *Connection) {
+	k, v := findKey(conns, conn.Name)
+	entry, ok := v.(map[string]interface{})
+	if !ok {
+		entry = make(map[string]interface{})
+	}
+	if k == "" {
+		k = conn.Name
+	}
+	conn.mergeConfig(entry)
+	conns[k] = entry
+}
+
+// mergeConfig writes the connection's values into a config map
+// using the config keys.
+func (conn *Connection) mergeConfig(m map[string]interface{}) {
+	setKey(m, ServiceURLKey, conn.ServiceURL)
+	setKey(m, AuthTokenKey, conn.AuthToken)
+	setKey(m, AuthSchemeKey, conn.AuthScheme)
+	setKey(m, AuthHeaderKey, conn.AuthHeader)
+	setKey(m, AuthParamKey, conn.AuthParam)
+	headers := make(map[string]interface{}, len(conn.Headers))
+	for k, v := range conn.Headers {
+		headers[k] = v
+	}
+	setKey(m, HeadersKey, headers)
+	setKey(m, TimeoutKey, durationValue(conn.Timeout))
+	transport := subMap(m, TransportKey)
+	conn.Transport.mergeConfig(transport)
+	setKey(m, TransportKey, transport)
+	tlsm := subMap(m, TLSKey)
+	conn.TLS.mergeConfig(tlsm)
+	setKey(m, TLSKey, tlsm)
+	retry := subMap(m, RetryKey)
+	conn.Retry.mergeConfig(retry)
+	setKey(m, RetryKey, retry)
+	decode := subMap(m, DecodeKey)
+	conn.Decode.mergeConfig(decode)
+	setKey(m, DecodeKey, decode)
+	oauth2 := subMap(m, OAuth2Key)
+	conn.OAuth2.mergeConfig(oauth2)
+	setKey(m, OAuth2Key, oauth2)
+	command := subMap(m, AuthCommandKey)
+	conn.AuthCommand.mergeConfig(command)
+	setKey(m, AuthCommandKey, command)
+	signing := subMap(m, SigningKey)
+	conn.Signing.mergeConfig(signing)
+	setKey(m, SigningKey, signing)
+	setKey(m, HintsKey, hintsConfig(conn.Hints))
+	conn.restoreRefs(m)
+}
+
+// validate catches the obvious mistakes before they get into the configuration.
+func (conn *Connection) validate() error {
+	if conn.Name == "" {
+		return fmt.Errorf("connection must have a name")
+	}
+	if strings.Contains(conn.Name, ".") {
+		return fmt.Errorf("connection name %q can't contain a '.'", conn.Name)
+	}
+	u, err := url.Parse(conn.ServiceURL)
+	if err != nil {
+		return fmt.Errorf("connection %q has a bad %s %q: %v", conn.Name, ServiceURLKey, conn.ServiceURL, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("connection %q has a bad %s %q: must be an absolute http or https URL",
+			conn.Name, ServiceURLKey, conn.ServiceURL)
+	}
+	if conn.Timeout < 0 {
+		return fmt.Errorf("connection %q has a negative %s", conn.Name, TimeoutKey)
+	}
+	if err := conn.Transport.validate(); err != nil {
+		return fmt.Errorf("connection %q has a bad %s: %v", conn.Name, TransportKey, err)
+	}
+	if err := conn.TLS.validate(); err != nil {
+		return fmt.Errorf("connection %q has a bad %s: %v", conn.Name, TLSKey, err)
+	}
+	if err := conn.Retry.validate(); err != nil {
+		return fmt.Errorf("connection %q has a bad %s: %v", conn.Name, RetryKey, err)
+	}
+	if err := conn.OAuth2.validate(); err != nil {
+		return fmt.Errorf("connection %q has a bad %s: %v", conn.Name, OAuth2Key, err)
+	}
+	if err := conn.AuthCommand.validate(); err != nil {
+		return fmt.Errorf("connection %q has a bad %s: %v", conn.Name, AuthCommandKey, err)
+	}
+	if err := conn.Signing.validate(); err != nil {
+		return fmt.Errorf("connection %q has a bad %s: %v", conn.Name, SigningKey, err)
+	}
+	if !validAuthScheme(conn.AuthScheme) {
+		return fmt.Errorf("connection %q has unknown %s %q", conn.Name, AuthSchemeKey, conn.AuthScheme)
+	}
+	return conn.checkSigningAuth()
+}
+
+func copyMap(m map[string]interface{}) map[string]interface{} {
+	nm := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		switch vv := v.(type) {
+		case map[string]interface{}:
+			nm[k] = copyMap(vv)
+		case map[string]string:
+			sm := make(map[string]interface{}, len(vv))
+			for sk, sv := range vv {
+				sm[sk] = sv
+			}
+			nm[k] = sm
+		default:
+			nm[k] = v
+		}
+	}
+	return nm
+}
+
 // ConnectionFlagValue this is where command line flag must store a conenction value to use.
 var ConnectionFlagValue string
 var previouslySetByFlag bool
@@ -125,10 +406,7 @@ var defaultConn = &Connection{
 }
 
 func InitConnections() {
-	if vconfig.Debug() {
-		t.Pef()
-		defer t.Pxf()
-	}
+	log := Logger()
 
 	var conn *Connection
 	var err error
@@ -138,12 +416,18 @@ func InitConnections() {
 	if conn, err = GetCurrentConnection(); err != nil {
 		// .. Otherwise, see if there is a _name_ of a defined connection to use as default ...
 		defaultName := viper.GetString(DefaultConnectionNameKey)
+		if defaultName != "" && connectionExists(defaultName) {
+			// It's there but doesn't load, e.g. its token is in an environment variable that isn't set.
+			// Don't send anything to another connection, leave it as the default so its error comes back.
+			log.Error("default connection doesn't load", LogConnectionKey, defaultName, "error", err)
+			return
+		}
 		if conn, ok = GetConnection(defaultName); !ok {
 
 			// ... next look for _any_ defined connections.
 			// Rather than pick a random connection (maps don't have a determined order.
 			// and we get connections from the config file as a map), pick the first lexographic one.
-			conns := getAllConnectionsFromConfig()
+			conns, _ := getAllConnectionsFromConfig() // The ones that don't load are logged.
 			if len(conns) > 0 {
 				sort.Sort(byName(conns))
 				conn = conns[0]
@@ -151,9 +435,7 @@ func InitConnections() {
 				// ... As a last resort set up a broken empty connection.
 				// We won't panic here as we can set it during interactive
 				// mode and it will otherwise error.
-				if vconfig.Debug() {
-					fmt.Printf("Using a 'broken' default connection.\n")
-				}
+				log.Debug("using a 'broken' default connection", LogConnectionKey, defaultConnectionName)
 				conn = defaultConn
 				// Add this to the configuraiton so we find it in a any latter GetCurrentConnection.
 				viper.Set(fmt.Sprintf("%s.%s.%s",
@@ -164,7 +446,5 @@ func InitConnections() {
 			vconfig.Set(DefaultConnectionNameKey, conn.Name)
 		}
 	}
-	if vconfig.Debug() {
-		fmt.Printf("Using connection: %s[%s]\n", conn.Name, conn.ServiceURL)
-	}
+	log.Debug("using connection", LogConnectionKey, conn.Name, LogURLKey, newRedactor(conn).url(conn.ServiceURL))
 }
@@ -0,0 +1,188 @@
+package conman
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestConnectionConfigFile(t *testing.T) {
+
+	cases := []struct {
+		name   string
+		file   string
+		config string
+	}{
+		{
+			name: "YAML",
+			file: "config.yaml",
+			config: `appSetting: keep-me
+defaultConnection: one
+connections:
+  one:
+    serviceURL: http://one.example.com
+    authToken: one-token
+    extraKey: untouched
+`,
+		},
+		{
+			name: "TOML",
+			file: "config.toml",
+			config: `appSetting = "keep-me"
+defaultConnection = "one"
+
+[connections]
+  [connections.one]
+    serviceURL = "http://one.example.com"
+    authToken = "one-token"
+    extraKey = "untouched"
+`,
+		},
+		{
+			name: "JSON",
+			file: "config.json",
+			config: `{
+  "appSetting": "keep-me",
+  "defaultConnection": "one",
+  "connections": {
+    "one": {
+      "serviceURL": "http://one.example.com",
+      "authToken": "one-token",
+      "extraKey": "untouched"
+    }
+  }
+}`,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			defer resetConfig()
+
+			dir, err := ioutil.TempDir("", "conman")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			fn := filepath.Join(dir, c.file)
+			if err = ioutil.WriteFile(fn, []byte(c.config), 0600); err != nil {
+				t.Fatal(err)
+			}
+			viper.SetConfigFile(fn)
+			if err = viper.ReadInConfig(); err != nil {
+				t.Fatal(err)
+			}
+
+			// Add
+			two := &Connection{
+				Name:       "two",
+				ServiceURL: "https://two.example.com",
+				AuthToken:  "two-token",
+				Headers:    map[string]string{"X-App": "two"},
+				Timeout:    30 * time.Second,
+				Transport:  TransportConfig{MaxIdleConnsPerHost: 4, IdleConnTimeout: time.Minute},
+			}
+			if err = AddConnection(two); err != nil {
+				t.Fatalf("AddConnection: %v", err)
+			}
+			if err = AddConnection(two); err == nil {
+				t.Errorf("Expected an error adding %q twice.", two.Name)
+			}
+
+			// Update
+			one := &Connection{Name: "one", ServiceURL: "http://one.example.com:8080"}
+			if err = UpdateConnection(one); err != nil {
+				t.Fatalf("UpdateConnection: %v", err)
+			}
+
+			// Remove
+			if err = AddConnection(&Connection{Name: "three", ServiceURL: "http://three.example.com"}); err != nil {
+				t.Fatalf("AddConnection: %v", err)
+			}
+			if err = RemoveConnection("three"); err != nil {
+				t.Fatalf("RemoveConnection: %v", err)
+			}
+			if err = RemoveConnection("three"); err == nil {
+				t.Errorf("Expected an error removing a missing connection.")
+			}
+
+			// In memory.
+			checkConnections(t, "memory", GetAllConnections())
+
+			// And on disk.
+			v := viper.New()
+			v.SetConfigFile(fn)
+			if err = v.ReadInConfig(); err != nil {
+				t.Fatal(err)
+			}
+			if got := v.GetString("appSetting"); got != "keep-me" {
+				t.Errorf("appSetting got: %q, expected %q", got, "keep-me")
+			}
+			if got := v.GetString("connections.one.extraKey"); got != "untouched" {
+				t.Errorf("extraKey got: %q, expected %q", got, "untouched")
+			}
+			resetConfig()
+			viper.SetConfigFile(fn)
+			if err = viper.ReadInConfig(); err != nil {
+				t.Fatal(err)
+			}
+			checkConnections(t, "file", GetAllConnections())
+		})
+	}
+}
+
+func checkConnections(t *testing.T, where string, cl ConnectionList) {
+	t.Helper()
+	if len(cl) != 2 {
+		t.Fatalf("%s: got %d connections, expected 2: %#v", where, len(cl), cl)
+	}
+	if one := cl.FindConnection("one"); one == nil {
+		t.Errorf("%s: missing connection one", where)
+	} else {
+		if one.ServiceURL != "http://one.example.com:8080" {
+			t.Errorf("%s: one.ServiceURL got: %q", where, one.ServiceURL)
+		}
+		if one.AuthToken != "" {
+			t.Errorf("%s: one.AuthToken got: %q, expected it removed", where, one.AuthToken)
+		}
+	}
+	if two := cl.FindConnection("two"); two == nil {
+		t.Errorf("%s: missing connection two", where)
+	} else if two.AuthToken != "two-token" || two.Headers["x-app"] != "two" || two.Timeout != 30*time.Second ||
+		two.Transport.MaxIdleConnsPerHost != 4 || two.Transport.IdleConnTimeout != time.Minute {
+		t.Errorf("%s: connection two got: %#v", where, two)
+	}
+}
+
+func TestConnectionValidation(t *testing.T) {
+	defer resetConfig()
+	bad := []*Connection{
+		{Name: "", ServiceURL: "http://localhost"},
+		{Name: "a.b", ServiceURL: "http://localhost"},
+		{Name: "a", ServiceURL: "localhost:8080"},
+		{Name: "a", ServiceURL: "ftp://localhost"},
+	}
+	for _, c := range bad {
+		if err := AddConnection(c); err == nil {
+			t.Errorf("Expected an error adding %#v", c)
+		}
+	}
+
+	// No config file, so this is in memory only.
+	if err := AddConnection(&Connection{Name: "a", ServiceURL: "http://localhost"}); err != nil {
+		t.Errorf("AddConnection: %v", err)
+	}
+	if _, ok := GetConnection("a"); !ok {
+		t.Errorf("Couldn't find added connection.")
+	}
+	if err := RemoveConnection("a"); err != nil {
+		t.Errorf("RemoveConnection: %v", err)
+	}
+	if _, ok := GetConnection("a"); ok {
+		t.Errorf("Found removed connection.")
+	}
+}
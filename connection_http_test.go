@@ -1,10 +1,13 @@
 package conman
 
 import (
+	"context"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 )
 
 func Test_smoke(t *testing.T) {
@@ -34,3 +37,128 @@ func Test_smoke(t *testing.T) {
 	// fmt.Printf("effect: %#+v\nresponse: %#+v\n", effect, resp)
 
 }
+
+func TestAuthScheme(t *testing.T) {
+
+	var got *http.Request
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+	}))
+	defer ts.Close()
+
+	cases := []struct {
+		name    string
+		conn    Connection
+		check   func(r *http.Request) string
+		expects string
+	}{
+		{
+			name:    "Default is bearer",
+			conn:    Connection{AuthToken: "abc"},
+			check:   func(r *http.Request) string { return r.Header.Get("Authorization") },
+			expects: "Bearer abc",
+		},
+		{
+			name:    "Token",
+			conn:    Connection{AuthToken: "abc", AuthScheme: "token"},
+			check:   func(r *http.Request) string { return r.Header.Get("Authorization") },
+			expects: "token abc",
+		},
+		{
+			name: "Basic",
+			conn: Connection{AuthToken: "user:pass:word", AuthScheme: "Basic"},
+			check: func(r *http.Request) string {
+				u, p, _ := r.BasicAuth()
+				return u + "/" + p
+			},
+			expects: "user/pass:word",
+		},
+		{
+			name:    "Header",
+			conn:    Connection{AuthToken: "abc", AuthScheme: "header", AuthHeader: "X-Api-Key"},
+			check:   func(r *http.Request) string { return r.Header.Get("X-Api-Key") },
+			expects: "abc",
+		},
+		{
+			name: "Query",
+			conn: Connection{AuthToken: "abc", AuthScheme: "query"},
+			check: func(r *http.Request) string {
+				return r.URL.Query().Get(DefaultAuthParam) + "&" + r.URL.Query().Get("q")
+			},
+			expects: "abc&1",
+		},
+		{
+			name:    "None",
+			conn:    Connection{AuthToken: "abc", AuthScheme: "none"},
+			check:   func(r *http.Request) string { return r.Header.Get("Authorization") },
+			expects: "",
+		},
+		{
+			name:    "Explicit header wins",
+			conn:    Connection{AuthToken: "abc", Headers: map[string]string{"Authorization": "Other xyz"}},
+			check:   func(r *http.Request) string { return r.Header.Get("Authorization") },
+			expects: "Other xyz",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got = nil
+			c.conn.ServiceURL = ts.URL
+			if _, _, err := c.conn.Get("/?q=1", nil); err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+			if v := c.check(got); v != c.expects {
+				t.Errorf("Got: %q, expected %q", v, c.expects)
+			}
+		})
+	}
+
+	conn := Connection{ServiceURL: ts.URL, AuthToken: "abc", AuthScheme: "unknown"}
+	if _, _, err := conn.Get("/", nil); err == nil {
+		t.Errorf("Expected an error for an unknown auth scheme.")
+	}
+}
+
+func TestTimeoutAndCancel(t *testing.T) {
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(5 * time.Second):
+			}
+			return
+		}
+		fmt.Fprintln(w, `{"test": "value"}`)
+	}))
+	defer ts.Close()
+
+	conn := Connection{ServiceURL: ts.URL, Timeout: 50 * time.Millisecond}
+	if _, _, err := conn.Get("/slow", nil); err == nil {
+		t.Errorf("Expected a timeout error.")
+	}
+
+	// Returning from Get mustn't cancel the request before we've read the body.
+	conn.Timeout = time.Second
+	_, resp, err := conn.Get("/fast", nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || len(b) == 0 {
+		t.Errorf("Couldn't read body after request returned, got %q, error: %v", b, err)
+	}
+
+	conn.Timeout = 0
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	if _, _, err := conn.GetContext(ctx, "/slow", nil); err == nil {
+		t.Errorf("Expected a cancelled error.")
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Errorf("Cancel didn't propagate to the request.")
+	}
+}
@@ -1,6 +1,7 @@
 package conman
 
 import (
+	"fmt"
 	"testing"
 
 	"github.com/spf13/viper"
@@ -16,6 +17,7 @@ func TestInitialConfig(t *testing.T) {
 	type e struct {
 		conName  string
 		numConns int
+		loadErr  bool // The current connection is conName, but it doesn't load.
 	}
 
 	// Some configs to use
@@ -27,6 +29,7 @@ func TestInitialConfig(t *testing.T) {
 		defaultConfig string
 		setConfig     string
 		configs       []config
+		broken        string // A connection with a reference that can't be resolved.
 		expected      e
 	}{
 		{
@@ -80,6 +83,13 @@ func TestInitialConfig(t *testing.T) {
 			setConfig:     "b",
 			expected:      e{conName: "a", numConns: 2},
 		},
+		{
+			name:          "One Configuration, with a default that doesn't load",
+			defaultConfig: "p",
+			configs:       []config{a},
+			broken:        "p",
+			expected:      e{conName: "p", numConns: 1, loadErr: true},
+		},
 	}
 
 	for _, c := range cases {
@@ -88,6 +98,10 @@ func TestInitialConfig(t *testing.T) {
 		for _, cfg := range c.configs {
 			setConnectionConfig(cfg.name, cfg.url)
 		}
+		if c.broken != "" {
+			setConnectionConfig(c.broken, "http://127.0.0.1")
+			viper.Set(fmt.Sprintf("%s.%s.%s", ConnectionsKey, c.broken, AuthTokenKey), "${env:CONMAN_INIT_MISSING}")
+		}
 
 		// Set default
 		if c.defaultConfig != "" {
@@ -99,7 +113,12 @@ func TestInitialConfig(t *testing.T) {
 		t.Run(c.name, func(t *testing.T) {
 			for {
 
-				if cn, err := GetCurrentConnection(); err == nil {
+				if c.expected.loadErr {
+					_, err := GetCurrentConnection()
+					if name := viper.GetString(DefaultConnectionNameKey); err == nil || name != c.expected.conName {
+						t.Errorf("Expected %s to stay the default and fail to load, got %s, error: %v", c.expected.conName, name, err)
+					}
+				} else if cn, err := GetCurrentConnection(); err == nil {
 					if cn.Name != c.expected.conName {
 						t.Errorf("Checking names, got: %s, expected %s", cn.Name, c.expected.conName)
 					}
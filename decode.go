@@ -0,0 +1,132 @@
+package conman
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/spf13/viper"
+)
+
+// DecodeOptions control how a JSON response is decoded into the result.
+// They can be set for a connection, and overridden for a single call with WithDecodeOptions.
+//
+// By default the response body is read into a buffer, decoded, and left in resp.Body
+// so the caller can read it again. With DiscardBody it's decoded as it's read
+// (unless debug output needs it), and resp.Body is empty afterwards.
+type DecodeOptions struct {
+	DisallowUnknownFields bool  // Error if the response has a field the result doesn't.
+	UseNumber             bool  // Decode numbers into an interface{} as json.Number, not float64.
+	MaxBodySize           int64 // Fail with a *BodyTooLargeError rather than read more than this. Zero is no limit.
+	DiscardBody           bool  // Don't keep the body in the response once it's decoded.
+}
+
+// SendOption changes how a single request is made.
+type SendOption func(*sendOptions)
+
+type sendOptions struct {
+	decode      *DecodeOptions
+	expect      []int  // Status codes that aren't an error, if empty anything under 300.
+	contentType string // Media type to encode content as.
+	accept      string // Accept header to send with a result.
+	progress    ProgressFunc
+	// Bodies that are streamed, so aren't read for debug output.
+	streamRequest, streamResponse bool
+}
+
+// WithDecodeOptions uses d, rather than the connection's DecodeOptions, for this call.
+func WithDecodeOptions(d DecodeOptions) SendOption {
+	return func(o *sendOptions) {
+		o.decode = &d
+	}
+}
+
+// WithContentType encodes the content with the codec for mediaType, rather than as JSON.
+func WithContentType(mediaType string) SendOption {
+	return func(o *sendOptions) {
+		o.contentType = mediaType
+	}
+}
+
+// WithAccept sends accept as the Accept header, rather than application/json.
+// A response without a Content-Type is decoded as the first media type in it.
+func WithAccept(accept string) SendOption {
+	return func(o *sendOptions) {
+		o.accept = accept
+	}
+}
+
+func (conn *Connection) sendOptions(opts []SendOption) *sendOptions {
+	o := &sendOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	if o.decode == nil {
+		o.decode = &conn.Decode
+	}
+	return o
+}
+
+// ContentTypeError is returned when a result was asked for, but there's
+// no codec for the response's Content-Type (e.g. an HTML error page from a proxy).
+type ContentTypeError struct {
+	ContentType string
+	URL         string
+}
+
+func (e *ContentTypeError) Error() string {
+	return fmt.Sprintf("response from %s has Content-Type %q, which can't be decoded", e.URL, e.ContentType)
+}
+
+// BodyTooLargeError is returned when a response body is bigger than the MaxBodySize.
+type BodyTooLargeError struct {
+	Limit int64
+	URL   string
+}
+
+func (e *BodyTooLargeError) Error() string {
+	return fmt.Sprintf("response from %s is larger than the %d byte limit", e.URL, e.Limit)
+}
+
+// decodeJSON decodes body into obj with the options.
+func (d DecodeOptions) decodeJSON(body []byte, obj interface{}) error {
+	return d.streamJSON(bytes.NewReader(body), obj)
+}
+
+// streamJSON decodes JSON from r into obj with the options.
+// As with json.Unmarshal, anything but white space after the value is an error.
+func (d DecodeOptions) streamJSON(r io.Reader, obj interface{}) error {
+	dec := json.NewDecoder(r)
+	if d.DisallowUnknownFields {
+		dec.DisallowUnknownFields()
+	}
+	if d.UseNumber {
+		dec.UseNumber()
+	}
+	if err := dec.Decode(obj); err != nil {
+		return err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return fmt.Errorf("unexpected data after the JSON value")
+	}
+	return nil
+}
+
+// getDecodeOptions reads the decode settings under the key dk.
+func getDecodeOptions(dk string) DecodeOptions {
+	key := func(k string) string { return fmt.Sprintf("%s.%s", dk, k) }
+	return DecodeOptions{
+		DisallowUnknownFields: viper.GetBool(key(DisallowUnknownFieldsKey)),
+		UseNumber:             viper.GetBool(key(UseNumberKey)),
+		MaxBodySize:           viper.GetInt64(key(MaxBodySizeKey)),
+		DiscardBody:           viper.GetBool(key(DiscardBodyKey)),
+	}
+}
+
+func (d DecodeOptions) mergeConfig(m map[string]interface{}) {
+	setKey(m, DisallowUnknownFieldsKey, d.DisallowUnknownFields)
+	setKey(m, UseNumberKey, d.UseNumber)
+	setKey(m, MaxBodySizeKey, d.MaxBodySize)
+	setKey(m, DiscardBodyKey, d.DiscardBody)
+}
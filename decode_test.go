@@ -0,0 +1,79 @@
+package conman
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDecode(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/html":
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			fmt.Fprintln(w, "<html><body>Bad Gateway</body></html>")
+		case "/broken":
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintln(w, `{"id": `)
+		case "/trailing":
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintln(w, `{"id": 1} <html><body>Bad Gateway</body></html>`)
+		case "/empty":
+			w.WriteHeader(http.StatusOK)
+		default:
+			w.Header().Set("Content-Type", "application/vnd.api+json")
+			fmt.Fprintln(w, `{"id": 12345678901234567890, "name": "big", "extra": true}`)
+		}
+	}))
+	defer ts.Close()
+
+	type item struct {
+		ID   json.Number `json:"id"`
+		Name string      `json:"name"`
+	}
+
+	conn := Connection{ServiceURL: ts.URL}
+
+	var it item
+	if _, _, err := conn.Get("/item", &it); err != nil || it.Name != "big" {
+		t.Errorf("Got %#v, error: %v", it, err)
+	}
+
+	var m map[string]interface{}
+	if _, _, err := conn.SendContext(context.Background(), http.MethodGet, "/item", nil, &m,
+		WithDecodeOptions(DecodeOptions{UseNumber: true})); err != nil {
+		t.Errorf("Error: %v", err)
+	} else if n, ok := m["id"].(json.Number); !ok || n.String() != "12345678901234567890" {
+		t.Errorf("Expected a json.Number, got %#v", m["id"])
+	}
+
+	conn.Decode.DisallowUnknownFields = true
+	if _, _, err := conn.Get("/item", &it); err == nil {
+		t.Errorf("Expected an error for an unknown field.")
+	}
+	if _, _, err := conn.SendContext(context.Background(), http.MethodGet, "/item", nil, &it, WithDecodeOptions(DecodeOptions{})); err != nil {
+		t.Errorf("Expected per call options to override the connection, got: %v", err)
+	}
+
+	_, resp, err := conn.Get("/html", &it)
+	var cterr *ContentTypeError
+	if !errors.As(err, &cterr) || resp == nil {
+		t.Errorf("Expected a ContentTypeError, got: %v", err)
+	}
+
+	if _, _, err = conn.Get("/broken", &it); err == nil {
+		t.Errorf("Expected a decoding error.")
+	}
+
+	if _, _, err = conn.Get("/trailing", &it); err == nil {
+		t.Errorf("Expected an error for data after the JSON.")
+	}
+
+	if _, _, err = conn.Get("/empty", &it); err != nil {
+		t.Errorf("Didn't expect an error for an empty body, got: %v", err)
+	}
+}
@@ -17,6 +17,7 @@ func (conns ConnectionList) List() {
 		} // eat the error if we
 		w := ansiterm.NewTabWriter(os.Stdout, 4, 4, 3, ' ', 0)
 		fmt.Fprintf(w, "%s\n", t.Title("\tName\tURL"))
+		redact := newRedactor(nil)
 		for _, c := range conns {
 			name := t.Text(c.Name)
 			current := ""
@@ -24,7 +25,7 @@ func (conns ConnectionList) List() {
 				name = t.Highlight("%s", c.Name)
 				current = t.Highlight("%s", "*")
 			}
-			fmt.Fprintf(w, "%s\t%s\t%s\n", current, name, t.Text("%s", c.ServiceURL))
+			fmt.Fprintf(w, "%s\t%s\t%s\n", current, name, t.Text("%s", redact.url(c.ServiceURL)))
 		}
 		w.Flush()
 	} else {
@@ -56,14 +57,15 @@ func (conn *Connection) Describe() {
 }
 
 func describeHeader() string {
-	return t.Title("\tName\tServiceURL\tAuthToken\tHeaders\n")
+	return t.Title("\tName\tServiceURL\tAuthToken\tTLS\tHeaders\n")
 }
 
 const currentDisplay = "*"
 
 func (conn *Connection) describeBody() (rv string) {
 	// First header
-	headers := getHeadersDisplay(conn.Headers)
+	redact := newRedactor(conn)
+	headers := conn.getHeadersDisplay(redact)
 	current := ""
 	name := t.Text(conn.Name)
 	if cn, err := GetCurrentConnection(); err == nil {
@@ -72,12 +74,20 @@ func (conn *Connection) describeBody() (rv string) {
 			name = t.Highlight(conn.Name)
 		}
 	}
+	token := redact.secret(conn.AuthToken)
+	if conn.encrypted(AuthTokenKey, conn.AuthToken) {
+		token = encryptedDisplay
+	}
+	tlsDisplay := conn.TLS.String()
+	if tlsDisplay == "" {
+		tlsDisplay = emptyHeader
+	}
 	rv += fmt.Sprintf("%s\t%s\t%s\t",
 		current, name,
-		t.Text("%s\t%s\t%s\n",
-			conn.ServiceURL, conn.AuthToken, headers[0]))
+		t.Text("%s\t%s\t%s\t%s\n",
+			redact.url(conn.ServiceURL), token, tlsDisplay, headers[0]))
 	for i := 1; i < len(headers); i++ {
-		rv += fmt.Sprintf("\t\t\t%s\n", headers[i])
+		rv += fmt.Sprintf("\t\t\t\t\t%s\n", headers[i])
 	}
 	return rv
 }
@@ -86,11 +96,25 @@ func (conn *Connection) describeBody() (rv string) {
 const lengthLimit = 40
 const emptyHeader = "<empty>"
 
+// encryptedDisplay is shown for values that are encrypted in the config file, even with showSecrets.
+const encryptedDisplay = "ENC[…]"
+
+// encrypted is true if the value at key is still the one decrypted from the config file.
+func (conn *Connection) encrypted(key, value string) bool {
+	ref, ok := conn.refs[key]
+	return ok && ref.value == value && isEncrypted(ref.raw)
+}
+
 // Will always return a list with a first element in it,
 // either the actual first header, or the emptyHeader string.
-func getHeadersDisplay(hm map[string]string) (hl []string) {
-	if len(hm) > 0 {
-		for k, v := range hm {
+func (conn *Connection) getHeadersDisplay(redact *redactor) (hl []string) {
+	if len(conn.Headers) > 0 {
+		for k, v := range conn.Headers {
+			if conn.encrypted(HeadersKey+"."+k, v) {
+				v = encryptedDisplay
+			} else {
+				v = redact.header(k, v)
+			}
 			if len(v) > lengthLimit {
 				v = v[:lengthLimit/2-5] + " ... " + v[len(v)-lengthLimit/2+5:]
 			}
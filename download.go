@@ -0,0 +1,391 @@
+package conman
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DownloadOptions control Download and DownloadFile.
+type DownloadOptions struct {
+	Progress ProgressFunc // Called as the body is written, done includes anything resumed from.
+
+	// SHA256 is the expected hex digest of the whole download.
+	SHA256 string
+	// DigestHeader is a response header with the SHA-256 digest of the download. It can be a
+	// hex or base64 digest, or a Digest or Repr-Digest style sha-256=... value.
+	DigestHeader string
+
+	// MaxResumes is how many times a download is resumed with a Range request if the connection
+	// drops part way through. It defaults to the connection's Retry.MaxAttempts - 1.
+	MaxResumes int
+}
+
+// ChecksumError is returned when a download doesn't match its SHA-256 digest.
+type ChecksumError struct {
+	Expected string // Hex digests.
+	Got      string
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("download checksum mismatch: expected sha256 %s, got %s", e.Expected, e.Got)
+}
+
+// partSuffix is added to the path of a file while it's downloaded.
+// validatorSuffix is added to that for the file with the ETag or Last-Modified of the
+// response the part came from, which is sent in If-Range to resume it.
+const (
+	partSuffix      = ".part"
+	validatorSuffix = ".validator"
+)
+
+// Download GETs cmd and streams the body to w, without holding it in memory.
+// If the connection drops the download carries on from where it got to with a Range request,
+// as long as the response had an ETag or Last-Modified to send in If-Range.
+// If the server ignores the Range, the part already written is skipped, unless the download
+// has changed, which is an error.
+// The SideEffect covers all the requests made.
+func (conn Connection) Download(ctx context.Context, cmd string, w io.Writer, opts DownloadOptions) (effect *SideEffect, resp *http.Response, err error) {
+	return conn.download(ctx, cmd, w, 0, nil, opts)
+}
+
+// DownloadFile downloads cmd into the file at path. The body is written to path.part and
+// renamed once it's all there (and matches the checksum, if there is one).
+// If path.part is already there, from an earlier download that didn't finish, the download
+// resumes from the end of it, with If-Range so that the server sends it all again if it's changed.
+// If there's no ETag or Last-Modified saved for it, it starts again from the beginning.
+func (conn Connection) DownloadFile(ctx context.Context, cmd, path string, opts DownloadOptions) (effect *SideEffect, resp *http.Response, err error) {
+	path = expandPath(path)
+	part := path + partSuffix
+	f, err := os.OpenFile(part, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return effect, resp, err
+	}
+	defer func() {
+		if f != nil {
+			f.Close()
+		}
+	}()
+
+	offset, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return effect, resp, err
+	}
+	pf := &partFile{f: f, path: part}
+	if offset > 0 && pf.validator() == "" {
+		// We can't tell if what's there is part of the same file.
+		if err = pf.restart(); err != nil {
+			return effect, resp, err
+		}
+		offset = 0
+	}
+	effect, resp, err = conn.download(ctx, cmd, f, offset, pf, opts)
+	var cerr *ChecksumError
+	if errors.As(err, &cerr) {
+		f.Close()
+		f = nil
+		os.Remove(part)
+		pf.removeValidator()
+	}
+	if err != nil {
+		return effect, resp, err
+	}
+
+	err = f.Close()
+	f = nil
+	if err == nil {
+		err = os.Rename(part, path)
+	}
+	if err == nil {
+		pf.removeValidator()
+	}
+	return effect, resp, err
+}
+
+// partFile is the file DownloadFile writes to, and where it keeps the validator.
+type partFile struct {
+	f    *os.File
+	path string
+}
+
+// restart empties the file, when the server sends the whole body rather than the range asked for.
+func (p *partFile) restart() error {
+	if err := p.f.Truncate(0); err != nil {
+		return err
+	}
+	_, err := p.f.Seek(0, io.SeekStart)
+	return err
+}
+
+func (p *partFile) validator() string {
+	b, err := ioutil.ReadFile(p.path + validatorSuffix)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
+
+// saveValidator keeps the validator of the response that's being written, as it starts,
+// so it's there if the download is interrupted.
+func (p *partFile) saveValidator(v string) error {
+	if v == "" {
+		p.removeValidator()
+		return nil
+	}
+	return ioutil.WriteFile(p.path+validatorSuffix, []byte(v+"\n"), 0644)
+}
+
+func (p *partFile) removeValidator() {
+	os.Remove(p.path + validatorSuffix)
+}
+
+// download streams cmd into w, starting at offset. part is given when w is a file from
+// DownloadFile, which has the validator for what's there already and is emptied when the
+// server sends the whole body rather than the range asked for.
+func (conn Connection) download(ctx context.Context, cmd string, w io.Writer, offset int64, part *partFile, opts DownloadOptions) (effect *SideEffect, resp *http.Response, err error) {
+	effect = &SideEffect{}
+	sum := sha256.New()
+	if offset > 0 && (opts.SHA256 != "" || opts.DigestHeader != "") {
+		if err = hashPrefix(sum, w, offset); err != nil {
+			return effect, resp, err
+		}
+	}
+
+	resumes := opts.MaxResumes
+	if resumes == 0 {
+		resumes = conn.Retry.MaxAttempts - 1
+	}
+	validator := ""
+	if part != nil && offset > 0 {
+		validator = part.validator()
+	}
+	for attempt := 0; ; attempt++ {
+		var e *SideEffect
+		var done bool
+		e, resp, done, err = conn.downloadOnce(ctx, cmd, w, sum, &offset, part, validator, opts)
+		effect.add(e)
+		if err == nil || done || attempt >= resumes || !isRetryableError(err) || ctx.Err() != nil {
+			break
+		}
+		if resp != nil {
+			validator = responseValidator(resp)
+		}
+		if offset > 0 && validator == "" {
+			// Without If-Range we can't tell if the rest is from the same file.
+			break
+		}
+		conn.logger().InfoContext(ctx, "resuming download", LogURLKey, newRedactor(&conn).url(conn.ServiceURL+cmd),
+			"offset", offset, "error", err)
+	}
+	if err != nil {
+		return effect, resp, err
+	}
+
+	expected := strings.ToLower(opts.SHA256)
+	if expected == "" && opts.DigestHeader != "" {
+		v := resp.Header.Get(opts.DigestHeader)
+		if v == "" {
+			return effect, resp, fmt.Errorf("download has no %s header to check the digest against", opts.DigestHeader)
+		}
+		d, ok := parseDigest(v)
+		if !ok {
+			return effect, resp, fmt.Errorf("can't parse a SHA-256 digest from %s: %q", opts.DigestHeader, v)
+		}
+		expected = hex.EncodeToString(d)
+	}
+	if expected != "" {
+		if got := hex.EncodeToString(sum.Sum(nil)); got != expected {
+			err = &ChecksumError{Expected: expected, Got: got}
+		}
+	}
+	return effect, resp, err
+}
+
+// downloadOnce makes one request for the rest of the download, from *offset, and copies it to w.
+// done is true if the error means there's no point trying again.
+func (conn Connection) downloadOnce(ctx context.Context, cmd string, w io.Writer, sum hash.Hash, offset *int64, part *partFile, validator string, opts DownloadOptions) (effect *SideEffect, resp *http.Response, done bool, err error) {
+	from := *offset
+	edit := func(req *http.Request) {
+		if from > 0 {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", from))
+			if validator != "" {
+				req.Header.Set("If-Range", validator)
+			}
+		}
+	}
+	so := conn.sendOptions(nil)
+	so.streamResponse = true
+	so.expect = []int{http.StatusOK, http.StatusPartialContent, http.StatusRequestedRangeNotSatisfiable}
+	effect, resp, err = conn.send(ctx, http.MethodGet, conn.ServiceURL+cmd, nil, nil, edit, so)
+	if err != nil {
+		return effect, resp, true, err
+	}
+	defer resp.Body.Close()
+
+	total := int64(-1)
+	switch resp.StatusCode {
+	case http.StatusRequestedRangeNotSatisfiable:
+		// We asked for the range after the end: we've already got it all.
+		if size, ok := contentRangeSize(resp.Header.Get("Content-Range")); ok && from > 0 && size == from {
+			return effect, resp, true, nil
+		}
+		return effect, resp, true, conn.checkReturnCode(resp, newRedactor(&conn), conn.Decode.MaxBodySize)
+	case http.StatusPartialContent:
+		start, size, ok := parseContentRange(resp.Header.Get("Content-Range"))
+		if !ok || start != from {
+			return effect, resp, true, fmt.Errorf("download asked for bytes from %d, got Content-Range %q", from, resp.Header.Get("Content-Range"))
+		}
+		total = size
+	case http.StatusOK:
+		if resp.ContentLength >= 0 {
+			total = resp.ContentLength
+		}
+		if from > 0 {
+			// The server sent the whole thing.
+			if part == nil {
+				if v := responseValidator(resp); v == "" || v != validator {
+					// It's changed, and what's been written can't be taken back.
+					return effect, resp, true, fmt.Errorf("download changed on the server after %d bytes", from)
+				}
+				if _, err = io.CopyN(ioutil.Discard, resp.Body, from); err != nil {
+					return effect, resp, false, err
+				}
+			} else {
+				if err = part.restart(); err != nil {
+					return effect, resp, true, err
+				}
+				*offset = 0
+				sum.Reset()
+			}
+		}
+	}
+	if part != nil {
+		if err = part.saveValidator(responseValidator(resp)); err != nil {
+			return effect, resp, true, err
+		}
+	}
+
+	received := &byteCounter{n: *offset, total: total, progress: opts.Progress}
+	start := time.Now()
+	n, err := io.Copy(io.MultiWriter(w, sum), &readErrors{received.wrap(resp.Body)})
+	*offset += n
+	effect.BytesReceived += n
+	effect.ElapsedTime += time.Since(start)
+	if err != nil {
+		// A failed write isn't going to get any better.
+		var rerr *readError
+		done = !errors.As(err, &rerr)
+		if rerr != nil {
+			err = rerr.err
+		}
+		return effect, resp, done, err
+	}
+	return effect, resp, false, nil
+}
+
+// responseValidator is what to send in If-Range to get the rest of resp's body:
+// its ETag, unless that's weak, otherwise its Last-Modified.
+func responseValidator(resp *http.Response) string {
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	return resp.Header.Get("Last-Modified")
+}
+
+// readError marks an error reading the response, rather than writing it out.
+type readError struct {
+	err error
+}
+
+func (e *readError) Error() string { return e.err.Error() }
+
+type readErrors struct {
+	r io.Reader
+}
+
+func (r *readErrors) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err != nil && err != io.EOF {
+		err = &readError{err}
+	}
+	return n, err
+}
+
+// hashPrefix hashes the first n bytes of w, if it's a file we're resuming.
+func hashPrefix(sum hash.Hash, w io.Writer, n int64) error {
+	r, ok := w.(io.ReaderAt)
+	if !ok {
+		return fmt.Errorf("can't verify a resumed download without reading back what was written")
+	}
+	_, err := io.Copy(sum, io.NewSectionReader(r, 0, n))
+	return err
+}
+
+// parseContentRange parses bytes start-end/size. size is -1 if it's *.
+func parseContentRange(v string) (start, size int64, ok bool) {
+	v = strings.TrimSpace(v)
+	if !strings.HasPrefix(v, "bytes ") {
+		return 0, 0, false
+	}
+	v = strings.TrimSpace(v[len("bytes "):])
+	slash := strings.Index(v, "/")
+	dash := strings.Index(v, "-")
+	if slash < 0 || dash < 0 || dash > slash {
+		return 0, 0, false
+	}
+	start, err := strconv.ParseInt(v[:dash], 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	size = -1
+	if s := v[slash+1:]; s != "*" {
+		if size, err = strconv.ParseInt(s, 10, 64); err != nil {
+			return 0, 0, false
+		}
+	}
+	return start, size, true
+}
+
+// contentRangeSize parses the bytes */size of a 416 response.
+func contentRangeSize(v string) (int64, bool) {
+	v = strings.TrimSpace(v)
+	if !strings.HasPrefix(v, "bytes */") {
+		return 0, false
+	}
+	size, err := strconv.ParseInt(v[len("bytes */"):], 10, 64)
+	return size, err == nil
+}
+
+// parseDigest gets a SHA-256 digest from a header value: hex, base64, or
+// sha-256=<base64> (Digest) or sha-256=:<base64>: (Repr-Digest and Content-Digest),
+// possibly in a list with other algorithms.
+func parseDigest(v string) ([]byte, bool) {
+	for _, item := range strings.Split(v, ",") {
+		item = strings.TrimSpace(item)
+		// A base64 digest only has = at the end, as padding.
+		if i := strings.Index(item, "="); i > 0 && i < len(item)-1 && item[i+1] != '=' {
+			if alg := strings.ToLower(item[:i]); alg != "sha-256" && alg != "sha256" {
+				continue
+			}
+			item = strings.Trim(item[i+1:], ":")
+		}
+		if d, err := hex.DecodeString(item); err == nil && len(d) == sha256.Size {
+			return d, true
+		}
+		if d, err := base64.StdEncoding.DecodeString(item); err == nil && len(d) == sha256.Size {
+			return d, true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,242 @@
+package conman
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDownload(t *testing.T) {
+	content := []byte(strings.Repeat("abcdefghijklmnopqrstuvwxyz", 4000))
+	digest := sha256.Sum256(content)
+	sha := hex.EncodeToString(digest[:])
+	modTime := time.Now()
+
+	lastModified := modTime.UTC().Format(http.TimeFormat)
+
+	var drops int
+	var ignoreRange bool
+	var ranges []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		w.Header().Set("Repr-Digest", "sha-256=:"+base64.StdEncoding.EncodeToString(digest[:])+":")
+		if drops > 0 && r.Header.Get("Range") == "" {
+			// Send half of it, then drop the connection.
+			drops--
+			w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+			w.Header().Set("Last-Modified", lastModified)
+			w.Write(content[:len(content)/2])
+			w.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler)
+		}
+		if ignoreRange {
+			r.Header.Del("Range")
+		}
+		http.ServeContent(w, r, "data", modTime, bytes.NewReader(content))
+	}))
+	defer ts.Close()
+
+	conn := Connection{ServiceURL: ts.URL, Retry: RetryPolicy{MaxAttempts: 3}}
+	ctx := context.Background()
+
+	for _, ignore := range []bool{false, true} {
+		t.Run("Resume, ignore range: "+strconv.FormatBool(ignore), func(t *testing.T) {
+			drops, ignoreRange, ranges = 1, ignore, nil
+			var buf bytes.Buffer
+			var last, total int64
+			effect, _, err := conn.Download(ctx, "/data", &buf, DownloadOptions{
+				SHA256:   sha,
+				Progress: func(done, t int64) { last, total = done, t },
+			})
+			if err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+			if !bytes.Equal(buf.Bytes(), content) {
+				t.Errorf("Got %d bytes, expected %d", buf.Len(), len(content))
+			}
+			if len(ranges) != 2 || ranges[1] != "bytes="+strconv.Itoa(len(content)/2)+"-" {
+				t.Errorf("Expected a range request, got %q", ranges)
+			}
+			if effect.Attempts != 2 || last != int64(len(content)) || total != int64(len(content)) {
+				t.Errorf("Got %d attempts, progress %d of %d", effect.Attempts, last, total)
+			}
+			if effect.BytesReceived != int64(len(content)) {
+				t.Errorf("Expected %d bytes received, got %d", len(content), effect.BytesReceived)
+			}
+		})
+	}
+
+	t.Run("No resumes", func(t *testing.T) {
+		drops, ignoreRange = 1, false
+		c := conn
+		c.Retry = RetryPolicy{}
+		if _, _, err := c.Download(ctx, "/data", ioutil.Discard, DownloadOptions{}); err == nil {
+			t.Errorf("Expected an error without resumes")
+		}
+	})
+
+	dir, err := ioutil.TempDir("", "download")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A part file from an earlier download, with the validator of the response it's from.
+	writePart := func(path string, b []byte, validator string) {
+		ioutil.WriteFile(path+partSuffix, b, 0644)
+		if validator != "" {
+			ioutil.WriteFile(path+partSuffix+validatorSuffix, []byte(validator+"\n"), 0644)
+		}
+	}
+
+	t.Run("File", func(t *testing.T) {
+		path := filepath.Join(dir, "resumed")
+		writePart(path, content[:1000], lastModified)
+		drops, ignoreRange, ranges = 0, false, nil
+		_, resp, err := conn.DownloadFile(ctx, "/data", path, DownloadOptions{DigestHeader: "Repr-Digest"})
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if resp.StatusCode != http.StatusPartialContent || ranges[0] != "bytes=1000-" {
+			t.Errorf("Expected a partial download, got %s for %q", resp.Status, ranges)
+		}
+		if got, _ := ioutil.ReadFile(path); !bytes.Equal(got, content) {
+			t.Errorf("Got %d bytes, expected %d", len(got), len(content))
+		}
+		for _, p := range []string{path + partSuffix, path + partSuffix + validatorSuffix} {
+			if _, err := os.Stat(p); !os.IsNotExist(err) {
+				t.Errorf("Expected %s to be gone: %v", p, err)
+			}
+		}
+	})
+
+	// A part file that can't be checked against the file on the server isn't resumed,
+	// and one that's out of date gets the whole file from the If-Range.
+	for name, validator := range map[string]string{"no validator": "", "changed": modTime.Add(-time.Hour).UTC().Format(http.TimeFormat)} {
+		t.Run("File, "+name, func(t *testing.T) {
+			path := filepath.Join(dir, "stale")
+			writePart(path, []byte("from another version of the file"), validator)
+			drops, ignoreRange, ranges = 0, false, nil
+			_, resp, err := conn.DownloadFile(ctx, "/data", path, DownloadOptions{SHA256: sha})
+			if err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+			if resp.StatusCode != http.StatusOK || (validator == "" && ranges[0] != "") {
+				t.Errorf("Expected the whole file, got %s for %q", resp.Status, ranges)
+			}
+			if got, _ := ioutil.ReadFile(path); !bytes.Equal(got, content) {
+				t.Errorf("Got %d bytes, expected %d", len(got), len(content))
+			}
+		})
+	}
+
+	t.Run("File interrupted", func(t *testing.T) {
+		path := filepath.Join(dir, "interrupted")
+		drops, ignoreRange = 1, false
+		c := conn
+		c.Retry = RetryPolicy{}
+		if _, _, err := c.DownloadFile(ctx, "/data", path, DownloadOptions{}); err == nil {
+			t.Fatalf("Expected an error without resumes")
+		}
+		if v, _ := ioutil.ReadFile(path + partSuffix + validatorSuffix); string(v) != lastModified+"\n" {
+			t.Errorf("Expected the validator to be kept, got %q", v)
+		}
+	})
+
+	t.Run("File already complete", func(t *testing.T) {
+		path := filepath.Join(dir, "complete")
+		writePart(path, content, lastModified)
+		_, resp, err := conn.DownloadFile(ctx, "/data", path, DownloadOptions{SHA256: sha})
+		if err != nil || resp.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+			t.Fatalf("Got %v, error: %v", resp.Status, err)
+		}
+		if got, _ := ioutil.ReadFile(path); !bytes.Equal(got, content) {
+			t.Errorf("Got %d bytes, expected %d", len(got), len(content))
+		}
+	})
+
+	t.Run("Checksum mismatch", func(t *testing.T) {
+		path := filepath.Join(dir, "bad")
+		writePart(path, []byte("garbage"), lastModified)
+		_, _, err := conn.DownloadFile(ctx, "/data", path, DownloadOptions{DigestHeader: "Repr-Digest"})
+		var cerr *ChecksumError
+		if !errors.As(err, &cerr) || cerr.Expected != sha {
+			t.Errorf("Expected a ChecksumError, got: %v", err)
+		}
+		for _, p := range []string{path, path + partSuffix, path + partSuffix + validatorSuffix} {
+			if _, err := os.Stat(p); !os.IsNotExist(err) {
+				t.Errorf("Expected %s to be gone: %v", p, err)
+			}
+		}
+	})
+}
+
+// A download that's changed isn't spliced onto what's already been written.
+func TestDownloadChanged(t *testing.T) {
+	for _, lastModified := range []string{"", time.Now().UTC().Format(http.TimeFormat)} {
+		requests := 0
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			w.Header().Set("Content-Length", "20")
+			if requests == 1 {
+				if lastModified != "" {
+					w.Header().Set("Last-Modified", lastModified)
+				}
+				w.Write([]byte("AAAAAAAAAA"))
+				w.(http.Flusher).Flush()
+				panic(http.ErrAbortHandler)
+			}
+			// A new version, and the server ignores the If-Range.
+			w.Header().Set("Last-Modified", time.Now().Add(time.Hour).UTC().Format(http.TimeFormat))
+			w.Write([]byte("BBBBBBBBBBBBBBBBBBBB"))
+		}))
+
+		conn := Connection{ServiceURL: ts.URL, Retry: RetryPolicy{MaxAttempts: 3}}
+		var buf bytes.Buffer
+		_, _, err := conn.Download(context.Background(), "/data", &buf, DownloadOptions{})
+		if err == nil || strings.Contains(buf.String(), "B") {
+			t.Errorf("Last-Modified %q: got %q, error: %v", lastModified, buf.String(), err)
+		}
+		if want := map[bool]int{true: 1, false: 2}[lastModified == ""]; requests != want {
+			t.Errorf("Last-Modified %q: got %d requests, expected %d", lastModified, requests, want)
+		}
+		ts.Close()
+	}
+}
+
+func TestParseDigest(t *testing.T) {
+	d := sha256.Sum256([]byte("test"))
+	h := hex.EncodeToString(d[:])
+	b := base64.StdEncoding.EncodeToString(d[:])
+	cases := []struct {
+		value string
+		ok    bool
+	}{
+		{h, true},
+		{strings.ToUpper(h), true},
+		{b, true},
+		{"sha-256=" + b, true},
+		{"SHA-256=" + b, true},
+		{"md5=abc, sha-256=:" + b + ":", true},
+		{"md5=" + b, false},
+		{"abc", false},
+	}
+	for _, tc := range cases {
+		got, ok := parseDigest(tc.value)
+		if ok != tc.ok || ok && !bytes.Equal(got, d[:]) {
+			t.Errorf("%q: got %x, %v", tc.value, got, ok)
+		}
+	}
+}
@@ -0,0 +1,431 @@
+package conman
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/scrypt"
+)
+
+// SecretKey is the key ENC[...] values in the configuration are encrypted with (see config.go).
+// It's either a Passphrase, which the key is derived from with scrypt, or a 32 byte Key,
+// e.g. from a key file.
+type SecretKey struct {
+	Passphrase string
+	Key        []byte
+}
+
+// DefaultPassphraseEnv is the environment variable the passphrase is read from,
+// if the encryption section doesn't name another.
+const DefaultPassphraseEnv = "CONMAN_PASSPHRASE"
+
+// PassphraseFunc, if set, is called for the passphrase when there's no key file and the
+// passphrase isn't in the environment, e.g. to prompt for it. It's called at most once.
+var PassphraseFunc func() (string, error)
+
+// An encrypted value is ENC[v1:scrypt:<salt>:<data>] for a passphrase, or ENC[v1:key:<data>]
+// for a key, where data is the AES-256-GCM nonce followed by the ciphertext. Both are
+// unpadded base64url.
+const (
+	encPrefix  = "ENC["
+	encSuffix  = "]"
+	encVersion = "v1"
+	encScrypt  = "scrypt"
+	encKey     = "key"
+	keySize    = 32
+	saltSize   = 16
+)
+
+// scrypt cost parameters, the recommended ones for interactive use.
+const (
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+var (
+	secretKeyMu sync.Mutex
+	secretKey   *SecretKey
+
+	// Deriving a key is slow on purpose, so they're kept by passphrase and salt.
+	derivedKeys = make(map[string][]byte)
+)
+
+// SetSecretKey sets the key for ENC[...] values, in place of the configured one.
+// nil goes back to the configuration.
+func SetSecretKey(k *SecretKey) {
+	secretKeyMu.Lock()
+	defer secretKeyMu.Unlock()
+	secretKey = k
+}
+
+// KeyFromFile reads a key file. It holds 32 bytes, or their base64 or hex encoding.
+func KeyFromFile(path string) (*SecretKey, error) {
+	b, err := ioutil.ReadFile(expandPath(path))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == keySize {
+		return &SecretKey{Key: b}, nil
+	}
+	s := strings.TrimSpace(string(b))
+	for _, decode := range []func(string) ([]byte, error){
+		base64.StdEncoding.DecodeString, base64.RawURLEncoding.DecodeString, hex.DecodeString,
+	} {
+		if k, err := decode(s); err == nil && len(k) == keySize {
+			return &SecretKey{Key: k}, nil
+		}
+	}
+	return nil, fmt.Errorf("key file %s doesn't hold a %d byte key", path, keySize)
+}
+
+// GenerateKeyFile writes a new random key to path, base64 encoded and only readable by its owner.
+// It won't replace a file that's already there.
+func GenerateKeyFile(path string) (*SecretKey, error) {
+	k := make([]byte, keySize)
+	if _, err := rand.Read(k); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(expandPath(path), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = fmt.Fprintln(f, base64.StdEncoding.EncodeToString(k)); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &SecretKey{Key: k}, f.Close()
+}
+
+// currentSecretKey is the key set with SetSecretKey, otherwise the configured key file,
+// otherwise the passphrase from the environment or PassphraseFunc.
+func currentSecretKey() (*SecretKey, error) {
+	secretKeyMu.Lock()
+	defer secretKeyMu.Unlock()
+	if secretKey != nil {
+		return secretKey, nil
+	}
+	if kf := viper.GetString(fmt.Sprintf("%s.%s", EncryptionKey, EncryptionKeyFileKey)); kf != "" {
+		return KeyFromFile(kf)
+	}
+	env := viper.GetString(fmt.Sprintf("%s.%s", EncryptionKey, PassphraseEnvKey))
+	if env == "" {
+		env = DefaultPassphraseEnv
+	}
+	if p := os.Getenv(env); p != "" {
+		return &SecretKey{Passphrase: p}, nil
+	}
+	if PassphraseFunc != nil {
+		p, err := PassphraseFunc()
+		if err != nil {
+			return nil, err
+		}
+		secretKey = &SecretKey{Passphrase: p}
+		return secretKey, nil
+	}
+	return nil, fmt.Errorf("there's no key for encrypted values: set %s.%s, or the passphrase in $%s", EncryptionKey, EncryptionKeyFileKey, env)
+}
+
+func isEncrypted(s string) bool {
+	return strings.HasPrefix(s, encPrefix) && strings.HasSuffix(s, encSuffix)
+}
+
+// encrypt returns plain as an ENC[...] value.
+func (k *SecretKey) encrypt(plain string) (string, error) {
+	var salt []byte
+	parts := []string{encVersion, encKey}
+	if k.Key == nil {
+		salt = make([]byte, saltSize)
+		if _, err := rand.Read(salt); err != nil {
+			return "", err
+		}
+		parts = []string{encVersion, encScrypt, base64.RawURLEncoding.EncodeToString(salt)}
+	}
+	aead, err := k.aead(salt)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return "", err
+	}
+	data := aead.Seal(nonce, nonce, []byte(plain), nil)
+	parts = append(parts, base64.RawURLEncoding.EncodeToString(data))
+	return encPrefix + strings.Join(parts, ":") + encSuffix, nil
+}
+
+// decrypt returns the plain text of an ENC[...] value.
+func (k *SecretKey) decrypt(value string) (string, error) {
+	parts := strings.Split(strings.TrimSuffix(strings.TrimPrefix(value, encPrefix), encSuffix), ":")
+	if len(parts) < 3 || parts[0] != encVersion {
+		return "", fmt.Errorf("encrypted value isn't %s[%s:...]", strings.TrimSuffix(encPrefix, "["), encVersion)
+	}
+	var salt []byte
+	var err error
+	switch {
+	case parts[1] == encKey && len(parts) == 3:
+		if k.Key == nil {
+			return "", fmt.Errorf("value was encrypted with a key file, not a passphrase")
+		}
+	case parts[1] == encScrypt && len(parts) == 4:
+		if k.Key != nil {
+			return "", fmt.Errorf("value was encrypted with a passphrase, not a key file")
+		}
+		if salt, err = base64.RawURLEncoding.DecodeString(parts[2]); err != nil {
+			return "", fmt.Errorf("encrypted value has a bad salt: %v", err)
+		}
+	default:
+		return "", fmt.Errorf("encrypted value has an unknown form")
+	}
+	data, err := base64.RawURLEncoding.DecodeString(parts[len(parts)-1])
+	if err != nil {
+		return "", fmt.Errorf("encrypted value isn't base64: %v", err)
+	}
+
+	aead, err := k.aead(salt)
+	if err != nil {
+		return "", err
+	}
+	if len(data) < aead.NonceSize() {
+		return "", fmt.Errorf("encrypted value is too short")
+	}
+	plain, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], nil)
+	if err != nil {
+		return "", fmt.Errorf("couldn't decrypt, is it the right key?")
+	}
+	return string(plain), nil
+}
+
+// aead is AES-256-GCM with the key, or the key derived from the passphrase and salt.
+func (k *SecretKey) aead(salt []byte) (cipher.AEAD, error) {
+	key := k.Key
+	if key == nil {
+		if k.Passphrase == "" {
+			return nil, fmt.Errorf("secret key has no passphrase or key")
+		}
+		var err error
+		if key, err = deriveKey(k.Passphrase, salt); err != nil {
+			return nil, err
+		}
+	}
+	if len(key) != keySize {
+		return nil, fmt.Errorf("secret key is %d bytes, it should be %d", len(key), keySize)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func deriveKey(passphrase string, salt []byte) ([]byte, error) {
+	id := passphrase + "\x00" + string(salt)
+	secretKeyMu.Lock()
+	key, ok := derivedKeys[id]
+	secretKeyMu.Unlock()
+	if ok {
+		return key, nil
+	}
+	key, err := scrypt.Key([]byte(passphrase), salt, scryptN, scryptR, scryptP, keySize)
+	if err != nil {
+		return nil, err
+	}
+	secretKeyMu.Lock()
+	derivedKeys[id] = key
+	secretKeyMu.Unlock()
+	return key, nil
+}
+
+// decryptValue decrypts an ENC[...] value with the current key.
+func decryptValue(value string) (string, error) {
+	k, err := currentSecretKey()
+	if err != nil {
+		return "", err
+	}
+	return k.decrypt(value)
+}
+
+// encryptChangedRefs encrypts the values that were encrypted in the configuration and have
+// changed since, e.g. a rotated refresh token, so they're not written back in clear text.
+// Values encrypted with a key that's since been rotated out are encrypted again with the current one.
+func (conn *Connection) encryptChangedRefs() error {
+	var k *SecretKey
+	for key, ref := range conn.refs {
+		v, ok := conn.refValue(key)
+		if !ok || v == "" || !isEncrypted(ref.raw) {
+			continue
+		}
+		if k == nil {
+			var err error
+			if k, err = currentSecretKey(); err != nil {
+				return fmt.Errorf("connection %q couldn't encrypt %s: %w", conn.Name, key, err)
+			}
+		}
+		if v == ref.value {
+			if _, err := k.decrypt(ref.raw); err == nil {
+				continue
+			}
+			// Loaded before RotateSecretKey, with the old key.
+		}
+		enc, err := k.encrypt(v)
+		if err != nil {
+			return fmt.Errorf("connection %q couldn't encrypt %s: %w", conn.Name, key, err)
+		}
+		conn.refs[key] = secretRef{raw: enc, value: v}
+	}
+	return nil
+}
+
+// EncryptConnectionValue encrypts the value at key in the named connection, e.g. authToken
+// or headers.X-Api-Key, with the current SecretKey. Only the secrets that are decrypted when
+// the connection loads can be encrypted: authToken, headers, the oauth2 clientID, clientSecret
+// and refreshToken, and the signing secret and sessionToken. It's changed in the config file,
+// if there is one, and in memory. A value that's already encrypted is left alone.
+func EncryptConnectionValue(name, key string) error {
+	if !connectionExists(name) {
+		return fmt.Errorf("couldn't find connection: %q", name)
+	}
+	if !encryptable(key) {
+		return fmt.Errorf("%s can't be encrypted, only authToken, headers, the oauth2 and signing secrets can", key)
+	}
+	raw, ok := viper.Get(fmt.Sprintf("%s.%s.%s", ConnectionsKey, name, key)).(string)
+	if !ok || raw == "" {
+		return fmt.Errorf("connection %q has no %s to encrypt", name, key)
+	}
+	if isEncrypted(raw) {
+		return nil
+	}
+	if strings.Contains(raw, "${") {
+		return fmt.Errorf("connection %q %s is a reference, there's no secret to encrypt", name, key)
+	}
+	plain, err := expandRefs(raw) // For $$.
+	if err != nil {
+		return err
+	}
+
+	k, err := currentSecretKey()
+	if err != nil {
+		return err
+	}
+	enc, err := k.encrypt(plain)
+	if err != nil {
+		return err
+	}
+	path := append([]string{name}, strings.Split(key, ".")...)
+	return updateConnectionsConfig(func(conns map[string]interface{}) {
+		setPath(conns, path, enc)
+	})
+}
+
+// encryptable is true for the keys resolveRefs decrypts, other than serviceURL,
+// which List and Describe show.
+func encryptable(key string) bool {
+	if strings.HasPrefix(strings.ToLower(key), strings.ToLower(HeadersKey)+".") {
+		return len(key) > len(HeadersKey)+1
+	}
+	for _, f := range (&Connection{}).refFields() {
+		if f.key != ServiceURLKey && strings.EqualFold(f.key, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// RotateSecretKey encrypts all the ENC[...] values in the connections again, with newKey,
+// in the config file and in memory, and then makes newKey the current key.
+// If any value can't be decrypted with the current key, nothing is changed.
+// For the next run, point encryption.keyFile or the passphrase at the new key.
+func RotateSecretKey(newKey *SecretKey) error {
+	old, err := currentSecretKey()
+	if err != nil {
+		return err
+	}
+
+	replace := make(map[string]string)
+	walkStrings(copyMap(viper.GetStringMap(ConnectionsKey)), func(s string) string {
+		if err != nil || !isEncrypted(s) {
+			return s
+		}
+		if _, done := replace[s]; done {
+			return s
+		}
+		var plain string
+		if plain, err = old.decrypt(s); err != nil {
+			return s
+		}
+		replace[s], err = newKey.encrypt(plain)
+		return s
+	})
+	if err != nil {
+		return fmt.Errorf("couldn't rotate the key: %w", err)
+	}
+
+	err = updateConnectionsConfig(func(conns map[string]interface{}) {
+		walkStrings(conns, func(s string) string {
+			if r, ok := replace[s]; ok {
+				return r
+			}
+			return s
+		})
+	})
+	if err != nil {
+		return err
+	}
+	SetSecretKey(newKey)
+	return nil
+}
+
+// walkStrings calls f for every string in v, replacing it with what f returns.
+func walkStrings(v interface{}, f func(string) string) interface{} {
+	switch vv := v.(type) {
+	case string:
+		return f(vv)
+	case map[string]interface{}:
+		for k, e := range vv {
+			vv[k] = walkStrings(e, f)
+		}
+	case map[interface{}]interface{}:
+		for k, e := range vv {
+			vv[k] = walkStrings(e, f)
+		}
+	case []interface{}:
+		for i, e := range vv {
+			vv[i] = walkStrings(e, f)
+		}
+	}
+	return v
+}
+
+// setPath sets the value at a path of keys in nested maps, matching keys viper style.
+func setPath(m map[string]interface{}, path []string, value interface{}) {
+	for i, p := range path {
+		k, v := findKey(m, p)
+		if k == "" {
+			k = p
+		}
+		if i == len(path)-1 {
+			m[k] = value
+			return
+		}
+		var sub map[string]interface{}
+		switch vv := v.(type) {
+		case map[string]interface{}:
+			sub = vv
+		case map[interface{}]interface{}:
+			sub = normalizeMap(vv)
+		default:
+			sub = make(map[string]interface{})
+		}
+		m[k] = sub
+		m = sub
+	}
+}
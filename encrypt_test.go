@@ -0,0 +1,286 @@
+package conman
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestEncryptDecrypt(t *testing.T) {
+	dir := t.TempDir()
+	fn := filepath.Join(dir, "key")
+	key, err := GenerateKeyFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = GenerateKeyFile(fn); err == nil {
+		t.Errorf("Expected an error generating over an existing key file")
+	}
+	read, err := KeyFromFile(fn)
+	if err != nil || string(read.Key) != string(key.Key) {
+		t.Fatalf("Got key %v from the file, error: %v", read, err)
+	}
+
+	passphrase := &SecretKey{Passphrase: "correct horse battery staple"}
+	for _, k := range []*SecretKey{key, passphrase} {
+		enc, err := k.encrypt("s3cret-token")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !isEncrypted(enc) || strings.Contains(enc, "s3cret") {
+			t.Errorf("Got encrypted value %q", enc)
+		}
+		if again, _ := k.encrypt("s3cret-token"); again == enc {
+			t.Errorf("Expected a new nonce each time")
+		}
+		if plain, err := k.decrypt(enc); err != nil || plain != "s3cret-token" {
+			t.Errorf("Got %q, error: %v", plain, err)
+		}
+	}
+
+	enc, _ := key.encrypt("s3cret-token")
+	wrong := &SecretKey{Key: make([]byte, keySize)}
+	for _, c := range []struct {
+		key   *SecretKey
+		value string
+	}{
+		{wrong, enc},
+		{passphrase, enc},
+		{key, "ENC[v2:key:abc]"},
+		{key, "ENC[v1:key:not base64!]"},
+		{key, enc[:len(enc)-5] + "AAAA]"},
+	} {
+		if plain, err := c.key.decrypt(c.value); err == nil {
+			t.Errorf("Expected an error decrypting %q, got %q", c.value, plain)
+		}
+	}
+}
+
+func TestLoadEncrypted(t *testing.T) {
+	defer resetConfig()
+	defer SetSecretKey(nil)
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "key")
+	key, err := GenerateKeyFile(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, _ := key.encrypt("file-token")
+	header, _ := key.encrypt("header-secret")
+
+	fn := filepath.Join(dir, "config.yaml")
+	config := fmt.Sprintf(`showSecrets: true
+encryption:
+  keyFile: %s
+connections:
+  enc:
+    serviceURL: http://localhost:8080
+    authToken: %s
+    headers:
+      X-Secret: %s
+      X-Plain: plain
+`, keyFile, token, header)
+	if err = ioutil.WriteFile(fn, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	viper.SetConfigFile(fn)
+	if err = viper.ReadInConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := LoadConnection("enc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn.AuthToken != "file-token" || conn.Headers["x-secret"] != "header-secret" {
+		t.Errorf("Got authToken %q, headers %v", conn.AuthToken, conn.Headers)
+	}
+	// Even with showSecrets, Describe doesn't show what's encrypted.
+	body := conn.describeBody()
+	if strings.Contains(body, "file-token") || strings.Contains(body, "header-secret") || !strings.Contains(body, encryptedDisplay) {
+		t.Errorf("Describe shows %q", body)
+	}
+
+	// Updating the connection keeps the values encrypted.
+	conn.Timeout = 0
+	if err = UpdateConnection(conn); err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadFile(fn)
+	if !strings.Contains(string(b), token) || !strings.Contains(string(b), header) {
+		t.Errorf("Expected the encrypted values in the file, got:\n%s", b)
+	}
+
+	// Without the key it doesn't load.
+	SetSecretKey(&SecretKey{Passphrase: "wrong"})
+	if _, err = LoadConnection("enc"); err == nil || !strings.Contains(err.Error(), "couldn't decrypt authToken") {
+		t.Errorf("Expected a decryption error, got %v", err)
+	}
+}
+
+func TestEncryptConnectionValue(t *testing.T) {
+	defer resetConfig()
+	defer SetSecretKey(nil)
+	t.Setenv(DefaultPassphraseEnv, "first passphrase")
+	t.Setenv("CONMAN_TOKEN", "env-token")
+
+	dir := t.TempDir()
+	fn := filepath.Join(dir, "config.yaml")
+	config := `connections:
+  enc:
+    serviceURL: http://localhost:8080
+    authToken: clear-token
+    headers:
+      X-Api-Key: clear-key
+    oauth2:
+      tokenURL: https://auth.example.com/token
+      clientID: client
+      clientSecret: ${env:CONMAN_TOKEN}
+`
+	if err := ioutil.WriteFile(fn, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	viper.SetConfigFile(fn)
+	if err := viper.ReadInConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{AuthTokenKey, HeadersKey + ".X-Api-Key", AuthTokenKey} {
+		if err := EncryptConnectionValue("enc", key); err != nil {
+			t.Fatalf("Encrypting %s: %v", key, err)
+		}
+	}
+	for _, key := range []string{OAuth2Key + "." + ClientSecretKey, OAuth2Key + "." + ScopesKey,
+		OAuth2Key + "." + TokenURLKey, ServiceURLKey, AuthSchemeKey, TimeoutKey, HeadersKey} {
+		if err := EncryptConnectionValue("enc", key); err == nil {
+			t.Errorf("Expected an error encrypting %s", key)
+		}
+	}
+	if err := EncryptConnectionValue("missing", AuthTokenKey); err == nil {
+		t.Errorf("Expected an error for a missing connection")
+	}
+
+	check := func(when, prefix string) {
+		t.Helper()
+		b, _ := ioutil.ReadFile(fn)
+		if strings.Contains(string(b), "clear-") || strings.Count(string(b), prefix) != 2 {
+			t.Errorf("%s: expected the values encrypted in the file, got:\n%s", when, b)
+		}
+		conn, err := LoadConnection("enc")
+		if err != nil {
+			t.Fatalf("%s: %v", when, err)
+		}
+		if conn.AuthToken != "clear-token" || conn.Headers["x-api-key"] != "clear-key" || conn.OAuth2.ClientSecret != "env-token" {
+			t.Errorf("%s: got %#v", when, conn)
+		}
+	}
+	check("encrypted", "ENC[v1:scrypt:")
+
+	// Rotating to a key file encrypts them again, and the passphrase no longer works.
+	loaded, err := LoadConnection("enc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	before, _ := ioutil.ReadFile(fn)
+	key, err := GenerateKeyFile(filepath.Join(dir, "key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = RotateSecretKey(key); err != nil {
+		t.Fatal(err)
+	}
+	SetSecretKey(nil)
+	if _, err = LoadConnection("enc"); err == nil {
+		t.Errorf("Expected the passphrase to fail after rotating")
+	}
+	SetSecretKey(key)
+	check("rotated", "ENC[v1:key:")
+
+	// A connection loaded before the rotation doesn't write the old values back.
+	loaded.Timeout = 5 * time.Second
+	if err = UpdateConnection(loaded); err != nil {
+		t.Fatal(err)
+	}
+	check("updated after rotating", "ENC[v1:key:")
+	b, _ := ioutil.ReadFile(fn)
+
+	// Nothing changes if the current key is wrong.
+	SetSecretKey(&SecretKey{Passphrase: "first passphrase"})
+	if err = RotateSecretKey(&SecretKey{Passphrase: "another"}); err == nil {
+		t.Errorf("Expected rotating with the wrong key to fail")
+	}
+	if after, _ := ioutil.ReadFile(fn); string(after) != string(b) || string(after) == string(before) {
+		t.Errorf("Expected the file unchanged by a failed rotation")
+	}
+}
+
+func TestRotatedRefreshTokenStaysEncrypted(t *testing.T) {
+	defer resetConfig()
+	defer SetSecretKey(nil)
+	key := &SecretKey{Key: make([]byte, keySize)}
+	SetSecretKey(key)
+	tokens := newTokenServer(3600, true)
+	defer tokens.Close()
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer api.Close()
+
+	refresh, _ := key.encrypt("refresh-0")
+	token, _ := key.encrypt("old-token")
+	dir := t.TempDir()
+	fn := filepath.Join(dir, "config.yaml")
+	config := fmt.Sprintf(`connections:
+  rotating:
+    serviceURL: %s
+    authToken: %s
+    oauth2:
+      tokenURL: %s
+      clientID: client
+      refreshToken: %s
+`, api.URL, token, tokens.URL, refresh)
+	if err := ioutil.WriteFile(fn, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	viper.SetConfigFile(fn)
+	if err := viper.ReadInConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := LoadConnection("rotating")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = conn.Get("/", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err = conn.SaveRefreshToken(); err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadFile(fn)
+	if strings.Contains(string(b), "refresh-1") || strings.Contains(string(b), refresh) {
+		t.Errorf("Expected the new refresh token encrypted in the file, got:\n%s", b)
+	}
+	saved, err := LoadConnection("rotating")
+	if err != nil || saved.OAuth2.RefreshToken != "refresh-1" {
+		t.Errorf("Got refresh token %q, error: %v", saved.OAuth2.RefreshToken, err)
+	}
+
+	// So is a changed authToken.
+	saved.AuthToken = "new-token"
+	if err = UpdateConnection(saved); err != nil {
+		t.Fatal(err)
+	}
+	b, _ = ioutil.ReadFile(fn)
+	if strings.Contains(string(b), "new-token") || strings.Contains(string(b), token) {
+		t.Errorf("Expected the new authToken encrypted in the file, got:\n%s", b)
+	}
+	if saved, _ = LoadConnection("rotating"); saved.AuthToken != "new-token" {
+		t.Errorf("Got authToken %q", saved.AuthToken)
+	}
+}
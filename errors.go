@@ -0,0 +1,176 @@
+package conman
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// HTTPError is returned by Send and friends when the response
+// status is 300 or above. Use errors.As to get at it:
+//
+//	var herr *conman.HTTPError
+//	if errors.As(err, &herr) && herr.StatusCode == http.StatusNotFound { ... }
+type HTTPError struct {
+	Method     string
+	URL        string
+	StatusCode int
+	Status     string
+	Header     http.Header
+	Body       []byte   // The raw response body, up to the MaxBodySize.
+	Problem    *Problem // Set if the body was application/problem+json.
+	Hint       string   // Suggestion for the user, from the connection's hints.
+
+	displayURL string // URL with any secrets redacted.
+}
+
+// Problem is an RFC 7807 problem details object.
+type Problem struct {
+	Type     string `json:"type,omitempty"`
+	Title    string `json:"title,omitempty"`
+	Status   int    `json:"status,omitempty"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+
+	// Any other members of the problem object.
+	Extensions map[string]interface{} `json:"-"`
+}
+
+// ProblemContentType is the media type of a problem details body.
+const ProblemContentType = "application/problem+json"
+
+func (e *HTTPError) Error() string {
+	u := e.displayURL
+	if u == "" {
+		u = e.URL
+	}
+	msg := fmt.Sprintf("HTTP Request %s:%s, HTTP Response: %s.", e.Method, u, e.Status)
+	if e.Problem != nil {
+		switch {
+		case e.Problem.Title != "" && e.Problem.Detail != "":
+			msg += fmt.Sprintf(" %s: %s.", e.Problem.Title, e.Problem.Detail)
+		case e.Problem.Detail != "":
+			msg += fmt.Sprintf(" %s.", e.Problem.Detail)
+		case e.Problem.Title != "":
+			msg += fmt.Sprintf(" %s.", e.Problem.Title)
+		}
+	}
+	if e.Hint != "" {
+		msg += " " + e.Hint
+	}
+	return msg
+}
+
+// DefaultHints are the hints added to an HTTPError for connections
+// that don't have Hints of their own.
+var DefaultHints = map[int]string{
+	http.StatusNotFound:     "Check for valid argument (user, group etc).",
+	http.StatusUnauthorized: "Check for valid token.",
+	http.StatusForbidden:    "Check for valid token and token user must be an admin",
+}
+
+// SetHint sets the hint for HTTP errors with the status code on this connection.
+// Once a connection has any hints of its own, DefaultHints aren't used for it.
+func (conn *Connection) SetHint(statusCode int, hint string) {
+	if conn.Hints == nil {
+		conn.Hints = make(map[int]string)
+	}
+	conn.Hints[statusCode] = hint
+}
+
+func (conn *Connection) hint(statusCode int) string {
+	hints := conn.Hints
+	if hints == nil {
+		hints = DefaultHints
+	}
+	return hints[statusCode]
+}
+
+// checkReturnCode returns an *HTTPError if the status is 300 or above,
+// or, if any expected status codes are given, if it isn't one of them.
+// Up to limit bytes of the response body (all of it for 0) are read into the error, and
+// restored in the response. The URL in the error's message is redacted with redact.
+func (conn *Connection) checkReturnCode(resp *http.Response, redact *redactor, limit int64, expect ...int) error {
+	if len(expect) == 0 && resp.StatusCode < 300 {
+		return nil
+	}
+	for _, code := range expect {
+		if resp.StatusCode == code {
+			return nil
+		}
+	}
+
+	herr := &HTTPError{
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+		Header:     resp.Header,
+		Hint:       conn.hint(resp.StatusCode),
+	}
+	if resp.Request != nil {
+		herr.Method = resp.Request.Method
+		herr.URL = resp.Request.URL.String()
+		herr.displayURL = redact.url(herr.URL)
+	}
+
+	if resp.Body != nil && resp.Body != http.NoBody {
+		if b, err := peekBody(resp, limit); err == nil {
+			herr.Body = b
+		}
+	}
+	herr.Problem = parseProblem(resp.Header.Get("Content-Type"), herr.Body)
+	return herr
+}
+
+// parseProblem decodes an application/problem+json body,
+// returns nil if it isn't one.
+func parseProblem(contentType string, body []byte) *Problem {
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil || mt != ProblemContentType || len(body) == 0 {
+		return nil
+	}
+	var p Problem
+	if err = json.Unmarshal(body, &p); err != nil {
+		return nil
+	}
+	var all map[string]interface{}
+	if json.Unmarshal(body, &all) == nil {
+		for _, k := range []string{"type", "title", "status", "detail", "instance"} {
+			delete(all, k)
+		}
+		if len(all) > 0 {
+			p.Extensions = all
+		}
+	}
+	return &p
+}
+
+// getHints reads a map of status code to hint from the config.
+func getHints(hk string) (hints map[int]string) {
+	if !viper.IsSet(hk) {
+		return nil
+	}
+	for k, v := range viper.GetStringMapString(hk) {
+		code, err := strconv.Atoi(strings.TrimSpace(k))
+		if err != nil {
+			continue
+		}
+		if hints == nil {
+			hints = make(map[int]string)
+		}
+		hints[code] = v
+	}
+	return hints
+}
+
+func hintsConfig(hints map[int]string) map[string]interface{} {
+	m := make(map[string]interface{}, len(hints))
+	for k, v := range hints {
+		m[strconv.Itoa(k)] = v
+	}
+	return m
+}
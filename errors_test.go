@@ -0,0 +1,100 @@
+package conman
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHTTPError(t *testing.T) {
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/problem":
+			w.Header().Set("Content-Type", ProblemContentType)
+			w.WriteHeader(http.StatusConflict)
+			fmt.Fprintln(w, `{"type": "https://example.com/probs/busy", "title": "Busy", "status": 409, "detail": "Try later.", "retryIn": 5}`)
+		case "/missing":
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	conn := Connection{ServiceURL: ts.URL}
+
+	_, resp, err := conn.Get("/problem", nil)
+	var herr *HTTPError
+	if !errors.As(err, &herr) {
+		t.Fatalf("Expected an *HTTPError, got: %#v", err)
+	}
+	if herr.StatusCode != http.StatusConflict || herr.Method != http.MethodGet || herr.URL != ts.URL+"/problem" {
+		t.Errorf("Got HTTPError: %#v", herr)
+	}
+	if herr.Problem == nil || herr.Problem.Title != "Busy" || herr.Problem.Detail != "Try later." ||
+		herr.Problem.Extensions["retryIn"] != float64(5) {
+		t.Errorf("Got problem: %#v", herr.Problem)
+	}
+	if !strings.Contains(err.Error(), "Busy: Try later.") {
+		t.Errorf("Error message missing problem details: %q", err.Error())
+	}
+
+	// The body should still be there for the caller.
+	b, _ := ioutil.ReadAll(resp.Body)
+	if string(b) != string(herr.Body) || len(b) == 0 {
+		t.Errorf("Body got: %q, expected %q", b, herr.Body)
+	}
+
+	// Default hints.
+	_, _, err = conn.Get("/missing", nil)
+	if !errors.As(err, &herr) || herr.Problem != nil || herr.Hint != DefaultHints[http.StatusNotFound] {
+		t.Errorf("Got error: %#v", err)
+	}
+
+	// Connection hints replace the defaults.
+	conn.SetHint(http.StatusNotFound, "Check the project name.")
+	_, _, err = conn.Get("/missing", nil)
+	if !errors.As(err, &herr) || !strings.HasSuffix(err.Error(), "Check the project name.") {
+		t.Errorf("Got error: %v", err)
+	}
+	_, _, err = conn.Get("/problem", nil)
+	if errors.As(err, &herr) && herr.Hint != "" {
+		t.Errorf("Didn't expect a hint, got %q", herr.Hint)
+	}
+}
+
+// An error body, and the debug dump, are only read up to the MaxBodySize.
+func TestHTTPErrorBodyLimit(t *testing.T) {
+	body := strings.Repeat("x", 1<<20)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, body)
+	}))
+	defer ts.Close()
+
+	var buf bytes.Buffer
+	conn := Connection{
+		ServiceURL: ts.URL,
+		Decode:     DecodeOptions{MaxBodySize: 100},
+		Logger:     slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})),
+	}
+	_, resp, err := conn.Get("/", nil)
+	var herr *HTTPError
+	if !errors.As(err, &herr) || len(herr.Body) != 100 {
+		t.Fatalf("Expected an HTTPError with 100 bytes of body, got: %v", err)
+	}
+	if buf.Len() > 10000 {
+		t.Errorf("Expected a bounded dump, got %d bytes of log", buf.Len())
+	}
+	// The caller can still read it all.
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(b) != body {
+		t.Errorf("Got %d bytes of body", len(b))
+	}
+}
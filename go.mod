@@ -1,13 +1,36 @@
 module github.com/jdrivas/conman
 
-go 1.13
+go 1.21
 
 require (
+	github.com/gorilla/websocket v1.4.2
 	github.com/jdrivas/termtext v0.2.9
 	github.com/jdrivas/vconfig v0.2.5
 	github.com/juju/ansiterm v0.0.0-20180109212912-720a0952cc2a
+	github.com/pelletier/go-toml v1.6.0
 	github.com/spf13/pflag v1.0.5
 	github.com/spf13/viper v1.6.1
+	golang.org/x/crypto v0.14.0
+	gopkg.in/yaml.v2 v2.2.7
+)
+
+require (
+	github.com/fatih/color v1.7.0 // indirect
+	github.com/fsnotify/fsnotify v1.4.7 // indirect
+	github.com/hashicorp/hcl v1.0.0 // indirect
+	github.com/lunixbochs/vtclean v1.0.0 // indirect
+	github.com/magiconair/properties v1.8.1 // indirect
+	github.com/mattn/go-colorable v0.1.4 // indirect
+	github.com/mattn/go-isatty v0.0.11 // indirect
+	github.com/mitchellh/go-homedir v1.1.0 // indirect
+	github.com/mitchellh/mapstructure v1.1.2 // indirect
+	github.com/spf13/afero v1.2.2 // indirect
+	github.com/spf13/cast v1.3.1 // indirect
+	github.com/spf13/jwalterweatherman v1.1.0 // indirect
+	github.com/subosito/gotenv v1.2.0 // indirect
+	golang.org/x/sys v0.13.0 // indirect
+	golang.org/x/text v0.13.0 // indirect
+	gopkg.in/ini.v1 v1.51.1 // indirect
 )
 
 // replace github.com/jdrivas/vconfig => /Users/david.rivas/Dropbox/Development/golang/vconfig
@@ -1,23 +1,22 @@
 package conman
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"log/slog"
 	"net/http"
 	"net/http/httputil"
-	"os"
+	"net/url"
 	"strings"
 	"time"
-
-	t "github.com/jdrivas/termtext"
-	"github.com/jdrivas/vconfig"
 )
 
-var httpClient = http.DefaultClient
-
 //
 // Public API
 //
@@ -31,29 +30,20 @@ var httpClient = http.DefaultClient
 // If result is non-nil Send umarshalls the response body,
 // aasumed to be JSON encoded, into the result object passed in.
 // If result is a []map[string]interface{}, you'll get a map of the JSON object.
+// If the response can't be decoded into result, or isn't JSON, the error is returned
+// (along with the response).
 func (conn Connection) Send(method, cmd string, content interface{}, result interface{}) (effect *SideEffect, resp *http.Response, err error) {
+	return conn.SendContext(context.Background(), method, cmd, content, result)
+}
 
-	if content == nil {
-		req := conn.newRequest(method, cmd, nil)
-		effect, resp, err = sendReq(req, result)
-	} else {
-		var b []byte
-		switch c := content.(type) {
-		case string:
-			// If we marshall the string, it escapes the quotes: "foo" => \"foo\".
-			// This makes for bad JSON.
-			b = []byte(c)
-		default:
-			b, err = json.Marshal(c)
-		}
-		if err == nil {
-			buff := bytes.NewBuffer(b)
-			req := conn.newRequest(method, cmd, buff)
-			req.Header.Add("Content-Type", "application/json")
-			effect, resp, err = sendReq(req, result)
-		}
-	}
-	return effect, resp, err
+// SendContext works like Send, but the request is made with ctx so
+// it can be cancelled.
+// If the connection has a Timeout, it's applied on top of ctx and covers reading
+// the response body, so close the body of the returned response when you're done with it.
+// opts change how this call is made, e.g. WithDecodeOptions, or WithContentType and
+// WithAccept to use codecs other than JSON (see codec.go).
+func (conn Connection) SendContext(ctx context.Context, method, cmd string, content interface{}, result interface{}, opts ...SendOption) (effect *SideEffect, resp *http.Response, err error) {
+	return conn.send(ctx, method, conn.ServiceURL+cmd, content, result, nil, conn.sendOptions(opts))
 }
 
 // Get works like Send with the GET verb,  but doesn't require a content object.
@@ -81,61 +71,212 @@ func (conn Connection) Patch(cmd string, content, result interface{}) (effect *S
 	return conn.Send(http.MethodPatch, cmd, content, result)
 }
 
+// GetContext works like SendContext with the GET verb.
+func (conn Connection) GetContext(ctx context.Context, cmd string, result interface{}) (effect *SideEffect, resp *http.Response, err error) {
+	return conn.SendContext(ctx, http.MethodGet, cmd, nil, result)
+}
+
+// PostContext works like SendContext using the POST verb.
+func (conn Connection) PostContext(ctx context.Context, cmd string, content, result interface{}) (effect *SideEffect, resp *http.Response, err error) {
+	return conn.SendContext(ctx, http.MethodPost, cmd, content, result)
+}
+
+// DeleteContext works like SendContext using the DELETE verb.
+func (conn Connection) DeleteContext(ctx context.Context, cmd string, content, result interface{}) (effect *SideEffect, resp *http.Response, err error) {
+	return conn.SendContext(ctx, http.MethodDelete, cmd, content, result)
+}
+
+// PatchContext works like SendContext using the PATCH verb.
+func (conn Connection) PatchContext(ctx context.Context, cmd string, content, result interface{}) (effect *SideEffect, resp *http.Response, err error) {
+	return conn.SendContext(ctx, http.MethodPatch, cmd, content, result)
+}
+
+// Put works like Send using the PUT verb.
+func (conn Connection) Put(cmd string, content, result interface{}) (effect *SideEffect, resp *http.Response, err error) {
+	return conn.Send(http.MethodPut, cmd, content, result)
+}
+
+// PutContext works like SendContext using the PUT verb.
+func (conn Connection) PutContext(ctx context.Context, cmd string, content, result interface{}) (effect *SideEffect, resp *http.Response, err error) {
+	return conn.SendContext(ctx, http.MethodPut, cmd, content, result)
+}
+
+// Head works like Send using the HEAD verb. There's no body, so no result, look at resp.Header.
+func (conn Connection) Head(cmd string) (effect *SideEffect, resp *http.Response, err error) {
+	return conn.Send(http.MethodHead, cmd, nil, nil)
+}
+
+// HeadContext works like SendContext using the HEAD verb.
+func (conn Connection) HeadContext(ctx context.Context, cmd string) (effect *SideEffect, resp *http.Response, err error) {
+	return conn.SendContext(ctx, http.MethodHead, cmd, nil, nil)
+}
+
+// Options works like Send using the OPTIONS verb.
+func (conn Connection) Options(cmd string, result interface{}) (effect *SideEffect, resp *http.Response, err error) {
+	return conn.Send(http.MethodOptions, cmd, nil, result)
+}
+
+// OptionsContext works like SendContext using the OPTIONS verb.
+func (conn Connection) OptionsContext(ctx context.Context, cmd string, result interface{}) (effect *SideEffect, resp *http.Response, err error) {
+	return conn.SendContext(ctx, http.MethodOptions, cmd, nil, result)
+}
+
 //
 // Private API
 //
 
+// send encodes content, builds the request for the URL target and sends it.
+// If edit is non-nil it gets to change the request before it's sent.
+// The connection's Timeout is applied on top of ctx here.
+func (conn Connection) send(ctx context.Context, method, target string, content, result interface{}, edit func(*http.Request), opts *sendOptions) (effect *SideEffect, resp *http.Response, err error) {
+
+	if conn.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, conn.Timeout)
+		defer func() {
+			if resp != nil && resp.Body != nil {
+				resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+			} else {
+				cancel()
+			}
+		}()
+	}
+
+	var body io.Reader
+	contentType := opts.contentType
+	var mp Multipart
+	var openBody func() (io.ReadCloser, error)
+	contentLength := int64(-1)
+	if m, ok := content.(Multipart); ok {
+		mp = m
+		contentType, openBody, contentLength = mp.body()
+		if body, err = openBody(); err != nil {
+			return effect, resp, err
+		}
+		opts.streamRequest = true
+	} else if content != nil {
+		if contentType == "" {
+			contentType = JSONContentType
+			if isRaw(content) {
+				if _, ok := content.(string); !ok {
+					contentType = RawContentType
+				}
+			}
+		}
+		if body, err = encodeContent(contentType, content); err != nil {
+			return effect, resp, err
+		}
+	}
+
+	var req *http.Request
+	if req, err = conn.newRequest(ctx, method, target, body); err == nil {
+		if content != nil {
+			req.Header.Set("Content-Type", contentType)
+		}
+		if openBody != nil {
+			req.ContentLength = contentLength
+			if mp.rewindable() {
+				req.GetBody = openBody
+			}
+		}
+		if result != nil && req.Header.Get("Accept") == "" {
+			if opts.accept != "" {
+				req.Header.Set("Accept", opts.accept)
+			} else {
+				req.Header.Set("Accept", accept(result))
+			}
+		}
+		if edit != nil {
+			edit(req)
+		}
+		effect, resp, err = conn.sendReq(req, result, opts)
+	}
+	return effect, resp, err
+}
+
 // sendReq sends along the request with some logging along the way.
-func sendReq(req *http.Request, result interface{}) (effect *SideEffect, resp *http.Response, err error) {
+func (conn Connection) sendReq(req *http.Request, result interface{}, opts *sendOptions) (effect *SideEffect, resp *http.Response, err error) {
 
-	switch {
-	// TODO: This wil dump the authorization token. Which it probably shouldn't do.
-	case vconfig.Debug():
-		reqDump, dumpErr := httputil.DumpRequestOut(req, true)
-		reqStr := string(reqDump)
+	client, err := conn.HTTPClient()
+	if err != nil {
+		return effect, resp, err
+	}
+
+	ctx := req.Context()
+	log := conn.logger()
+	debug := log.Enabled(ctx, slog.LevelDebug)
+	// Always redact, the warning for a failed request goes out at the default level.
+	redact := newRedactor(&conn)
+	reqURL := redact.url(req.URL.String())
+
+	if debug {
+		reqDump, dumpErr := httputil.DumpRequestOut(req, !opts.streamRequest)
+		reqStr := string(redact.dump(reqDump))
 		if dumpErr != nil {
-			fmt.Printf("Error dumping request (display as generic object): %v\n", dumpErr)
+			log.DebugContext(ctx, "error dumping request (display as generic object)", "error", dumpErr)
 			reqStr = fmt.Sprintf("%v", req)
 		}
-		fmt.Printf("%s %s\n", t.Title("Request"), t.Text(reqStr))
-		fmt.Println()
-	case vconfig.Verbose():
-		fmt.Printf("%s %s\n", t.Title("Request:"), t.Text("%s %s", req.Method, req.URL))
-		// fmt.Println()
+		log.DebugContext(ctx, "request", LogMethodKey, req.Method, LogURLKey, reqURL, "dump", reqStr)
+	} else {
+		log.InfoContext(ctx, "request", LogMethodKey, req.Method, LogURLKey, reqURL)
 	}
 
 	// Send the request
 	start := time.Now()
-	resp, err = httpClient.Do(req)
-	effect = &SideEffect{
-		ElapsedTime: time.Since(start),
+	effect = &SideEffect{}
+	sent := &byteCounter{progress: opts.progress}
+	sent.countRequest(req)
+	var orig *http.Request
+	if conn.tokenSource() != nil {
+		orig = req.Clone(ctx)
 	}
-	if vconfig.Verbose() {
-		fmt.Printf("%s %s\n", t.Title("Elapsed request time:"), t.Text("%d milliseconds", effect.ElapsedTime.Milliseconds()))
+	resp, err = conn.doWithRetry(client, req, effect)
+	if err == nil && orig != nil && resp.StatusCode == http.StatusUnauthorized {
+		resp, err = conn.retryUnauthorized(client, orig, resp, start, effect)
 	}
+	effect.ElapsedTime = time.Since(start)
+	effect.BytesSent = sent.count()
 
 	// Process
-	if err == nil {
+	var uerr *url.Error
+	if errors.As(err, &uerr) {
+		// The client's errors have the URL in them, with any query token.
+		uerr.URL = redact.url(uerr.URL)
+	}
+	if err != nil {
+		log.WarnContext(ctx, "request failed", LogMethodKey, req.Method, LogURLKey, reqURL,
+			LogElapsedKey, effect.ElapsedTime, LogAttemptsKey, effect.Attempts, "error", err)
+	} else {
+		log.InfoContext(ctx, "response", LogMethodKey, req.Method, LogURLKey, reqURL, LogStatusKey, resp.StatusCode,
+			LogElapsedKey, effect.ElapsedTime, LogAttemptsKey, effect.Attempts)
+		if effect.Attempts > 1 {
+			log.DebugContext(ctx, "attempt times", LogURLKey, reqURL, "times", effect.AttemptTimes)
+		}
 
-		if vconfig.Debug() {
-			respDump, dumpErr := httputil.DumpResponse(resp, true)
-			respStr := string(respDump)
+		if debug {
+			// Only as much of the body as the MaxBodySize, which is all that's decoded.
+			respDump, dumpErr := httputil.DumpResponse(resp, false)
+			if dumpErr == nil && !opts.streamResponse && resp.Body != nil && resp.Body != http.NoBody {
+				var b []byte
+				b, dumpErr = peekBody(resp, opts.decode.MaxBodySize)
+				respDump = append(respDump, b...)
+			}
+			respStr := string(redact.dump(respDump))
 			if dumpErr != nil {
-				fmt.Printf("Error dumping response (display as generic object): %v\n", dumpErr)
+				log.DebugContext(ctx, "error dumping response (display as generic object)", "error", dumpErr)
 				respStr = fmt.Sprintf("%v", resp)
 			}
-			fmt.Printf("%s\n%s\n", t.Title("Respose:"), t.Text(respStr))
-			fmt.Println()
+			log.DebugContext(ctx, "response dump", LogURLKey, reqURL, "dump", respStr)
 		}
 
 		// Do this after the Dump, the dump reads out the response for reprting and
 		// replaces the reader with anothe rone that has the data.
-		// TODO: Figure out how to do the same replacement here so
-		// th unmarshal doesn't eat the Response body.
-		err = checkReturnCode(*resp)
+		// checkReturnCode and unmarshal do the same, so the body is still there
+		// for the caller.
+		err = conn.checkReturnCode(resp, redact, opts.decode.MaxBodySize, opts.expect...)
 		if result != nil {
 			if err == nil {
-				err = unmarshal(resp, result)
+				err = unmarshal(ctx, resp, result, *opts.decode, req.Header.Get("Accept"), log, redact)
 			}
 		}
 
@@ -143,117 +284,185 @@ func sendReq(req *http.Request, result interface{}) (effect *SideEffect, resp *h
 	return effect, resp, err
 }
 
-// newRequest creates a request as usual prepending the connections ServiceURL to the cmd.
-func (conn Connection) newRequest(method, cmd string, body io.Reader) *http.Request {
-	req, err := http.NewRequest(method, conn.ServiceURL+cmd, body)
+// newRequest creates a request for the URL target as usual.
+// The connection's headers are added, and then the token according to the AuthScheme.
+// The token is the AuthToken, unless the connection has a TokenSource or OAuth2 configuration.
+func (conn Connection) newRequest(ctx context.Context, method, target string, body io.Reader) (req *http.Request, err error) {
+	req, err = http.NewRequestWithContext(ctx, method, target, body)
 	if err != nil {
-		panic(fmt.Sprintf("Coulnd't generate HTTP request - %s\n", err.Error()))
+		return nil, fmt.Errorf("couldn't generate HTTP request: %v", err)
 	}
 
 	for k, v := range conn.Headers {
 		req.Header.Add(k, v)
 	}
 
-	return req
+	token, err := conn.token(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err = conn.applyAuth(req, token); err != nil {
+		return nil, err
+	}
+
+	return req, nil
+}
+
+// responseURL is the URL of the request that got resp, if there is one.
+func responseURL(resp *http.Response) string {
+	if resp.Request == nil || resp.Request.URL == nil {
+		return ""
+	}
+	return resp.Request.URL.String()
 }
 
-var emptyBody = ioutil.NopCloser(strings.NewReader(""))
+// cancelBody releases the request's timeout context
+// when the response body is closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
 
-// unmarshal will attemp to unmarhsall JSON into obj.
-// It restores the body to the resp, in any case.
-func unmarshal(resp *http.Response, obj interface{}) (err error) {
-	var body []byte
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
 
-	// lifted from source to http.DumpResponse
-	// Save body
-	save := resp.Body
-	savecl := resp.ContentLength
-	if resp.Body == nil {
-		resp.Body = emptyBody
+// unmarshal will attemp to unmarhsall the body into obj, with the codec for its Content-Type,
+// or the first type in accept if it doesn't have one.
+// Unless decode.DiscardBody is set the body is read into a pooled buffer, and left in resp.Body
+// to be read again. Otherwise it's decoded as it's read, if the codec can, and resp.Body is left empty.
+// An empty body leaves obj alone, a body we don't have a codec for is a *ContentTypeError.
+// Debug output goes to log, redacted with redact.
+func unmarshal(ctx context.Context, resp *http.Response, obj interface{}, decode DecodeOptions, accept string, log *slog.Logger, redact *redactor) (err error) {
+	if resp.Body == nil || resp.Body == http.NoBody {
+		return nil
+	}
+	debug := log.Enabled(ctx, slog.LevelDebug)
+	ct := resp.Header.Get("Content-Type")
+	u := redact.url(responseURL(resp))
+	body := newLimitReader(resp.Body, decode.MaxBodySize, u)
+
+	if decode.DiscardBody && !debug {
+		defer func() {
+			resp.Body.Close()
+			resp.Body = http.NoBody
+		}()
+		br := bufio.NewReader(body)
+		if _, peekErr := br.Peek(1); peekErr == io.EOF {
+			return nil
+		}
+		err = streamBody(ct, accept, br, obj, decode)
 	} else {
-		save, resp.Body, err = drainBody(resp.Body)
+		buf := getBuffer()
+		_, err = buf.ReadFrom(body)
+		resp.Body.Close()
+		resp.Body = newPooledBody(buf)
 		if err != nil {
 			return err
 		}
-	}
-
-	body, err = ioutil.ReadAll(resp.Body)
-	defer resp.Body.Close()
-	if err == nil {
+		b := buf.Bytes()
 
-		if vconfig.Debug() {
-			// TODO: Printf-ing the output of json.Indent through the bytes.Buffer.String
-			// produces cruft. However writting directly to it, works o.k.
-			// prettyJSON := bytes.Buffer{}
+		if debug {
 			var prettyJSON bytes.Buffer
-			fmt.Fprintf(&prettyJSON, t.Title("Pretty print response body:\n"))
-			indentErr := json.Indent(&prettyJSON, body, "", " ")
-			if indentErr == nil {
-				// fmt.Printf("%s %s\n", t.Title("Response body is:"), t.Text("%s\n", prettyJSON))
-				prettyJSON.WriteTo(os.Stdout)
-				fmt.Println()
-				fmt.Println()
+			if indentErr := json.Indent(&prettyJSON, redact.json(b), "", " "); indentErr == nil {
+				log.DebugContext(ctx, "pretty print response body", "body", prettyJSON.String())
 			} else {
-				fmt.Printf("%s\n", t.Fail("Error indenting JSON - %s", indentErr.Error()))
-				fmt.Printf("%s %s\n", t.Title("Body:"), t.Text(string(body)))
+				log.DebugContext(ctx, "error indenting JSON", "error", indentErr,
+					"body", string(redact.body(ct, b)))
 			}
 		}
 
-		json.Unmarshal(body, &obj)
-		if vconfig.Debug() {
-			fmt.Printf("%s %s\n", t.Title("Unmarshaled object: "), t.Text("%#v", obj))
-			fmt.Println()
+		if len(b) == 0 {
+			return nil
+		}
+		var raw bool
+		if raw, err = decodeRaw(ct, b, obj); !raw {
+			err = decodeBody(ct, accept, b, obj, decode)
 		}
 	}
 
-	// Restore body.
-	resp.Body = save
-	resp.ContentLength = savecl
-	return err
-}
+	var cterr *ContentTypeError
+	var tooLarge *BodyTooLargeError
+	switch {
+	case errors.As(err, &cterr):
+		cterr.URL = u
+	case errors.As(err, &tooLarge):
+	case err != nil:
+		err = fmt.Errorf("couldn't decode response from %s: %w", u, err)
+	}
 
-// Returns an "informative" error if not 200
-func checkReturnCode(resp http.Response) (err error) {
-	err = nil
-	if resp.StatusCode >= 300 {
-		switch resp.StatusCode {
-		case http.StatusNotFound:
-			err = httpErrorMesg(resp, "Check for valid argument (user, group etc).")
-		case http.StatusUnauthorized:
-			err = httpErrorMesg(resp, "Check for valid token.")
-		case http.StatusForbidden:
-			err = httpErrorMesg(resp, "Check for valid token and token user must be an admin")
-		default:
-			err = httpError(resp)
+	if err == nil && debug {
+		// With redaction on we can't show the Go value, but we can show it re-encoded.
+		objStr := fmt.Sprintf("%#v", obj)
+		if redact != nil {
+			if b, mErr := json.Marshal(obj); mErr == nil {
+				objStr = string(redact.json(b))
+			}
 		}
+		log.DebugContext(ctx, "unmarshaled object", "object", objStr)
 	}
 	return err
 }
 
-func httpErrorMesg(resp http.Response, message string) error {
-	return fmt.Errorf("HTTP Request %s:%s, HTTP Response: %s. %s",
-		resp.Request.Method, resp.Request.URL, resp.Status, message)
+// decodeBody decodes body into obj with the codec for contentType.
+// Without a contentType, the first type in accept is used, or JSON.
+func decodeBody(contentType, accept string, body []byte, obj interface{}, decode DecodeOptions) error {
+	codec, err := lookupDecoder(contentType, accept, decode)
+	if err != nil {
+		return err
+	}
+	return codec.Unmarshal(body, obj)
 }
 
-func httpError(resp http.Response) error {
-	return httpErrorMesg(resp, "")
+// streamBody decodes from r into obj, as it's read if the codec is a StreamDecoder.
+func streamBody(contentType, accept string, r io.Reader, obj interface{}, decode DecodeOptions) error {
+	if w, ok := obj.(io.Writer); ok && isRaw(obj) {
+		_, err := io.Copy(w, r)
+		return err
+	}
+	if !isRaw(obj) {
+		codec, err := lookupDecoder(contentType, accept, decode)
+		if err != nil {
+			return err
+		}
+		if sd, ok := codec.(StreamDecoder); ok {
+			if err = sd.Decode(r, obj); err == io.EOF {
+				err = nil
+			}
+			// Read what's left, so the connection can be used again.
+			io.Copy(ioutil.Discard, r)
+			return err
+		}
+	}
+
+	buf := getBuffer()
+	defer putBuffer(buf)
+	if _, err := buf.ReadFrom(r); err != nil {
+		return err
+	}
+	if raw, err := decodeRaw(contentType, buf.Bytes(), obj); raw {
+		return err
+	}
+	return decodeBody(contentType, accept, buf.Bytes(), obj, decode)
 }
 
-// Copied from http.httputil/dump.go
-// http.DumpResponse keeps a copy of the body
-// around for use once its' been read off of the http.Resp.
-// Let's do that too.
-func drainBody(b io.ReadCloser) (r1, r2 io.ReadCloser, err error) {
-	if b == http.NoBody {
-		// no copying neede. Preserve the magic sentinel meaning of NoBody.
-		return http.NoBody, http.NoBody, nil
+// lookupDecoder finds the codec for contentType, or the first type in accept if there isn't one.
+func lookupDecoder(contentType, accept string, decode DecodeOptions) (Codec, error) {
+	mt := contentType
+	if mt == "" {
+		mt = strings.TrimSpace(strings.Split(accept, ",")[0])
+		if mt == "" || strings.HasPrefix(mt, "*/") {
+			mt = JSONContentType
+		}
 	}
-	var buf bytes.Buffer
-	if _, err = buf.ReadFrom(b); err != nil {
-		return nil, b, err
+	codec, ok := LookupCodec(mt)
+	if !ok {
+		return nil, &ContentTypeError{ContentType: contentType}
 	}
-	if err = b.Close(); err != nil {
-		return nil, b, err
+	if _, ok = codec.(JSONCodec); ok {
+		codec = JSONCodec{decode}
 	}
-	return ioutil.NopCloser(&buf), ioutil.NopCloser(bytes.NewReader(buf.Bytes())), nil
+	return codec, nil
 }
@@ -0,0 +1,80 @@
+package conman
+
+import (
+	"log/slog"
+	"os"
+	"sync"
+
+	"github.com/jdrivas/vconfig"
+)
+
+//
+// Logging
+//
+// Diagnostics go through a log/slog Logger, never stdout, so they don't
+// get mixed up with a program's output.
+// The default logger writes text to stderr, and takes its level from vconfig:
+// Debug() logs everything (including request and response dumps), Verbose() logs
+// requests and timings, otherwise only warnings and errors are logged.
+// log/slog needs Go 1.21, which is the module's minimum.
+//
+
+// Attribute keys used in log records.
+const (
+	LogConnectionKey = "connection"
+	LogMethodKey     = "method"
+	LogURLKey        = "url"
+	LogStatusKey     = "status"
+	LogElapsedKey    = "elapsed"
+	LogAttemptsKey   = "attempts"
+)
+
+var (
+	loggerMu      sync.RWMutex
+	packageLogger = defaultLogger()
+)
+
+func defaultLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: vconfigLevel{}}))
+}
+
+// SetLogger sets the logger for connections that don't have their own Logger.
+// Passing nil restores the default.
+func SetLogger(l *slog.Logger) {
+	if l == nil {
+		l = defaultLogger()
+	}
+	loggerMu.Lock()
+	packageLogger = l
+	loggerMu.Unlock()
+}
+
+// Logger returns the logger set with SetLogger, or the default.
+func Logger() *slog.Logger {
+	loggerMu.RLock()
+	defer loggerMu.RUnlock()
+	return packageLogger
+}
+
+// logger returns the connection's logger, with the connection name attached.
+func (conn *Connection) logger() *slog.Logger {
+	l := conn.Logger
+	if l == nil {
+		l = Logger()
+	}
+	return l.With(LogConnectionKey, conn.Name)
+}
+
+// vconfigLevel is a slog.Leveler that follows the vconfig debug and verbose settings,
+// which can change while we run.
+type vconfigLevel struct{}
+
+func (vconfigLevel) Level() slog.Level {
+	switch {
+	case vconfig.Debug():
+		return slog.LevelDebug
+	case vconfig.Verbose():
+		return slog.LevelInfo
+	}
+	return slog.LevelWarn
+}
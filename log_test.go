@@ -0,0 +1,92 @@
+package conman
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLogger(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintln(w, `{"test": "value"}`)
+	}))
+	defer ts.Close()
+
+	const secret = "s3cr3t-t0k3n-v4lu3-1234"
+	var buf bytes.Buffer
+	conn := Connection{
+		Name:       "logged",
+		ServiceURL: ts.URL,
+		AuthToken:  secret,
+		Logger:     slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})),
+	}
+
+	var result map[string]string
+	if _, _, err := conn.Get("/path", &result); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	if strings.Contains(buf.String(), secret) {
+		t.Errorf("Secret in log output:\n%s", buf.String())
+	}
+
+	var found bool
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var rec map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			t.Fatalf("Bad log line %q: %v", line, err)
+		}
+		if rec[LogConnectionKey] != "logged" {
+			t.Errorf("Log record without connection: %v", rec)
+		}
+		if rec[slog.MessageKey] == "response" {
+			found = true
+			if rec[LogMethodKey] != http.MethodGet || rec[LogURLKey] != ts.URL+"/path" ||
+				rec[LogStatusKey] != float64(http.StatusOK) || rec[LogElapsedKey] == nil {
+				t.Errorf("Response record missing fields: %v", rec)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("No response record in:\n%s", buf.String())
+	}
+
+	// Nothing at the default level.
+	buf.Reset()
+	conn.Logger = slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: vconfigLevel{}}))
+	if _, _, err := conn.Get("/path", &result); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if buf.Len() > 0 {
+		t.Errorf("Expected no logging, got:\n%s", buf.String())
+	}
+}
+
+// A failed request is logged at the default level, without a query token.
+func TestFailureLogRedacted(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	ts.Close()
+
+	const secret = "s3cr3t-t0k3n-v4lu3-1234"
+	var buf bytes.Buffer
+	conn := Connection{
+		Name:       "failing",
+		ServiceURL: ts.URL,
+		AuthToken:  secret,
+		AuthScheme: AuthSchemeQuery,
+		Logger:     slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelWarn})),
+	}
+	_, _, err := conn.Get("/path", nil)
+	if err == nil {
+		t.Fatal("Expected the request to fail")
+	}
+	if !strings.Contains(buf.String(), "request failed") || strings.Contains(buf.String(), secret) || strings.Contains(err.Error(), secret) {
+		t.Errorf("Got error %v, log:\n%s", err, buf.String())
+	}
+}
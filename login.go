@@ -0,0 +1,304 @@
+package conman
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// LoginOptions control Login.
+type LoginOptions struct {
+	// Device uses the device flow even if there's an AuthURL, e.g. in an ssh session.
+	Device bool
+
+	// OpenURL is called with the URL to log in at, for the authorization code flow.
+	// It defaults to printing the URL to Output and trying to open it in a browser.
+	OpenURL func(u string) error
+
+	// Prompt is called with the code the person has to enter, and where, for the device flow.
+	// It defaults to printing them to Output.
+	Prompt func(dc DeviceCode)
+
+	// RedirectPort is the port of the loopback redirect, for providers that need the
+	// redirect URI registered with the port. Zero picks a free one.
+	RedirectPort int
+
+	// Output is where the defaults print to, os.Stderr if nil.
+	Output io.Writer
+}
+
+// DeviceCode is what a person needs to finish a device flow login on another device.
+type DeviceCode struct {
+	UserCode                string
+	VerificationURI         string
+	VerificationURIComplete string    // VerificationURI with the code in it, if the server gives one.
+	Expiry                  time.Time // Zero if the server didn't say.
+}
+
+// DefaultDevicePollInterval is how often the token endpoint is polled during a device
+// flow login, if the server doesn't say.
+var DefaultDevicePollInterval = 5 * time.Second
+
+const (
+	loginCallbackPath = "/callback"
+	deviceGrantType   = "urn:ietf:params:oauth:grant-type:device_code"
+)
+
+// Login gets tokens for a person, rather than a service, with the connection's OAuth2 configuration.
+// If there's an AuthURL it uses the authorization code flow with PKCE (RFC 7636), with
+// the browser redirected back to a listener on the loopback interface (RFC 8252).
+// Otherwise, or if opts.Device is set, it uses the device flow (RFC 8628).
+// It waits for the person to log in, use ctx to give up.
+//
+// The refresh token is kept in conn.OAuth2.RefreshToken, or if the server didn't send one
+// the access token is kept in conn.AuthToken, and the connection is updated in the
+// configuration if it's there.
+func (conn *Connection) Login(ctx context.Context, opts LoginOptions) (*Token, error) {
+	oc := conn.OAuth2
+	if oc.TokenURL == "" || !oc.interactive() {
+		return nil, fmt.Errorf("connection %q has no %s %s or %s to log in with", conn.Name, OAuth2Key, AuthURLKey, DeviceAuthURLKey)
+	}
+	if opts.Output == nil {
+		opts.Output = os.Stderr
+	}
+
+	var tok *Token
+	var err error
+	if opts.Device || oc.AuthURL == "" {
+		if oc.DeviceAuthURL == "" {
+			return nil, fmt.Errorf("connection %q has no %s %s for a device login", conn.Name, OAuth2Key, DeviceAuthURLKey)
+		}
+		tok, err = conn.deviceLogin(ctx, opts)
+	} else {
+		tok, err = conn.browserLogin(ctx, opts)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("connection %q login failed: %w", conn.Name, err)
+	}
+	conn.logger().InfoContext(ctx, "logged in", "connection", conn.Name, "expiry", tok.Expiry, "refresh", tok.RefreshToken != "")
+
+	if tok.RefreshToken != "" {
+		conn.OAuth2.RefreshToken = tok.RefreshToken
+		conn.AuthToken = ""
+		// Requests can use the token we've got, rather than refreshing it straight away.
+		tokenSourcesMu.Lock()
+		tokenSources[conn.Name] = keyedTokenSource{key: conn.tokenSourceKey(), ts: &cachedTokenSource{
+			src: &oauth2TokenSource{conn: *conn, refreshToken: tok.RefreshToken},
+			tok: tok, fetched: time.Now(),
+		}}
+		tokenSourcesMu.Unlock()
+	} else {
+		// A refresh token from an earlier login would be used instead of this token.
+		conn.OAuth2.RefreshToken = ""
+		conn.AuthToken = tok.AccessToken
+	}
+	if _, ok := GetConnection(conn.Name); ok {
+		if err = UpdateConnection(conn); err != nil {
+			return tok, fmt.Errorf("connection %q logged in, but the token couldn't be saved: %w", conn.Name, err)
+		}
+	}
+	return tok, nil
+}
+
+// browserLogin runs the authorization code flow, with PKCE.
+func (conn *Connection) browserLogin(ctx context.Context, opts LoginOptions) (*Token, error) {
+	oc := conn.OAuth2
+	verifier, err := randomString(32)
+	if err != nil {
+		return nil, err
+	}
+	state, err := randomString(16)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256([]byte(verifier))
+
+	l, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", opts.RedirectPort))
+	if err != nil {
+		return nil, fmt.Errorf("couldn't listen for the login redirect: %v", err)
+	}
+	redirect := fmt.Sprintf("http://%s%s", l.Addr(), loginCallbackPath)
+
+	type result struct {
+		code string
+		err  error
+	}
+	results := make(chan result, 1)
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != loginCallbackPath {
+			http.NotFound(w, r)
+			return
+		}
+		q := r.URL.Query()
+		// Anything on this machine can reach the listener, so only a redirect with
+		// our state ends the login.
+		if q.Get("state") != state {
+			http.Error(w, "Login failed: the redirect has the wrong state", http.StatusBadRequest)
+			return
+		}
+		var res result
+		switch {
+		case q.Get("error") != "":
+			res.err = &OAuth2Error{Code: q.Get("error"), Description: q.Get("error_description")}
+		case q.Get("code") == "":
+			res.err = fmt.Errorf("login redirect has no code")
+		default:
+			res.code = q.Get("code")
+		}
+		if res.err != nil {
+			http.Error(w, "Login failed: "+res.err.Error(), http.StatusBadRequest)
+		} else {
+			fmt.Fprintln(w, "Logged in, you can close this window.")
+		}
+		select {
+		case results <- res:
+		default:
+		}
+	})}
+	go srv.Serve(l)
+	defer srv.Close()
+
+	u, err := url.Parse(oc.AuthURL)
+	if err != nil {
+		return nil, err
+	}
+	q := u.Query()
+	q.Set("response_type", "code")
+	q.Set("client_id", oc.ClientID)
+	q.Set("redirect_uri", redirect)
+	q.Set("state", state)
+	q.Set("code_challenge", base64.RawURLEncoding.EncodeToString(sum[:]))
+	q.Set("code_challenge_method", "S256")
+	if len(oc.Scopes) > 0 {
+		q.Set("scope", strings.Join(oc.Scopes, " "))
+	}
+	u.RawQuery = q.Encode()
+
+	open := opts.OpenURL
+	if open == nil {
+		open = func(u string) error {
+			fmt.Fprintf(opts.Output, "Open this URL in a browser to log in:\n\n    %s\n\n", u)
+			openBrowser(u)
+			return nil
+		}
+	}
+	if err = open(u.String()); err != nil {
+		return nil, err
+	}
+
+	var res result
+	select {
+	case res = <-results:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if res.err != nil {
+		return nil, res.err
+	}
+	return conn.tokenRequest(ctx, url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {res.code},
+		"redirect_uri":  {redirect},
+		"code_verifier": {verifier},
+	})
+}
+
+// deviceLogin runs the device flow.
+func (conn *Connection) deviceLogin(ctx context.Context, opts LoginOptions) (*Token, error) {
+	oc := conn.OAuth2
+	form := url.Values{}
+	if len(oc.Scopes) > 0 {
+		form.Set("scope", strings.Join(oc.Scopes, " "))
+	}
+	var dr struct {
+		DeviceCode              string      `json:"device_code"`
+		UserCode                string      `json:"user_code"`
+		VerificationURI         string      `json:"verification_uri"`
+		VerificationURIComplete string      `json:"verification_uri_complete"`
+		ExpiresIn               json.Number `json:"expires_in"`
+		Interval                json.Number `json:"interval"`
+	}
+	if err := conn.postForm(ctx, oc.DeviceAuthURL, form, &dr); err != nil {
+		return nil, err
+	}
+	if dr.DeviceCode == "" || dr.UserCode == "" || dr.VerificationURI == "" {
+		return nil, fmt.Errorf("device authorization response from %s is missing the codes", newRedactor(conn).url(oc.DeviceAuthURL))
+	}
+
+	dc := DeviceCode{UserCode: dr.UserCode, VerificationURI: dr.VerificationURI, VerificationURIComplete: dr.VerificationURIComplete}
+	if secs, err := dr.ExpiresIn.Int64(); err == nil && secs > 0 {
+		dc.Expiry = time.Now().Add(time.Duration(secs) * time.Second)
+	}
+	interval := DefaultDevicePollInterval
+	if secs, err := dr.Interval.Int64(); err == nil && secs > 0 {
+		interval = time.Duration(secs) * time.Second
+	}
+	if opts.Prompt != nil {
+		opts.Prompt(dc)
+	} else {
+		fmt.Fprintf(opts.Output, "To log in, visit %s and enter the code %s\n", dc.VerificationURI, dc.UserCode)
+	}
+
+	for {
+		if err := sleepContext(ctx, interval); err != nil {
+			return nil, err
+		}
+		if !dc.Expiry.IsZero() && time.Now().After(dc.Expiry) {
+			return nil, fmt.Errorf("the device code expired before the login was finished")
+		}
+		tok, err := conn.tokenRequest(ctx, url.Values{
+			"grant_type":  {deviceGrantType},
+			"device_code": {dr.DeviceCode},
+		})
+		var oerr *OAuth2Error
+		if errors.As(err, &oerr) {
+			switch oerr.Code {
+			case "authorization_pending":
+				continue
+			case "slow_down":
+				interval += 5 * time.Second
+				continue
+			}
+		}
+		return tok, err
+	}
+}
+
+// randomString is n random bytes, base64url encoded.
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// openBrowser does its best to open u in a browser. If it can't, there's
+// always the URL that was printed.
+func openBrowser(u string) {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("open", u)
+	case "windows":
+		cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", u)
+	default:
+		cmd = exec.Command("xdg-open", u)
+	}
+	if cmd.Start() == nil {
+		go cmd.Wait()
+	}
+}
@@ -0,0 +1,303 @@
+package conman
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// authServer is a fake authorization server, with authorization code + PKCE,
+// device and refresh grants.
+type authServer struct {
+	*httptest.Server
+	t       *testing.T
+	refresh bool // Send refresh tokens.
+
+	mu        sync.Mutex
+	challenge string
+	redirect  string
+	pending   int // Device polls to answer authorization_pending.
+	polls     int
+	grants    []string
+}
+
+func newAuthServer(t *testing.T, refresh bool) *authServer {
+	s := &authServer{t: t, refresh: refresh}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		q := r.URL.Query()
+		if q.Get("response_type") != "code" || q.Get("client_id") != "cli" || q.Get("code_challenge_method") != "S256" || q.Get("scope") != "openid profile" {
+			t.Errorf("Bad authorization request %v", q)
+		}
+		s.challenge, s.redirect = q.Get("code_challenge"), q.Get("redirect_uri")
+		to, _ := url.Parse(s.redirect)
+		rq := url.Values{"state": {q.Get("state")}}
+		if q.Get("deny") != "" {
+			rq.Set("error", "access_denied")
+		} else {
+			rq.Set("code", "the-code")
+		}
+		to.RawQuery = rq.Encode()
+		http.Redirect(w, r, to.String(), http.StatusFound)
+	})
+	mux.HandleFunc("/device", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.PostForm.Get("client_id") != "cli" {
+			t.Errorf("Bad device request %v", r.PostForm)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"device_code": "dev-code", "user_code": "ABCD-EFGH", "verification_uri": "https://example.com/device", "expires_in": 600}`)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		r.ParseForm()
+		f := r.PostForm
+		s.grants = append(s.grants, f.Get("grant_type"))
+		w.Header().Set("Content-Type", "application/json")
+		fail := func(code string) {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, `{"error": %q}`, code)
+		}
+		switch f.Get("grant_type") {
+		case "authorization_code":
+			sum := sha256.Sum256([]byte(f.Get("code_verifier")))
+			if f.Get("code") != "the-code" || f.Get("redirect_uri") != s.redirect ||
+				base64.RawURLEncoding.EncodeToString(sum[:]) != s.challenge {
+				fail("invalid_grant")
+				return
+			}
+		case deviceGrantType:
+			s.polls++
+			if f.Get("device_code") != "dev-code" {
+				fail("invalid_grant")
+				return
+			}
+			if s.polls <= s.pending {
+				fail("authorization_pending")
+				return
+			}
+		case "refresh_token":
+		default:
+			fail("unsupported_grant_type")
+			return
+		}
+		resp := map[string]interface{}{"access_token": fmt.Sprintf("access-%d", len(s.grants)), "expires_in": 3600}
+		if s.refresh {
+			resp["refresh_token"] = fmt.Sprintf("refresh-%d", len(s.grants))
+		}
+		json.NewEncoder(w).Encode(resp)
+	})
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+// browser follows the login URL, with the redirect back to the loopback listener.
+func browser(t *testing.T, query string) func(string) error {
+	return func(u string) error {
+		resp, err := http.Get(u + query)
+		if err != nil {
+			return err
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		t.Logf("Browser got %d: %s", resp.StatusCode, body)
+		return nil
+	}
+}
+
+func TestLogin(t *testing.T) {
+	defer resetConfig()
+	auth := newAuthServer(t, true)
+	defer auth.Close()
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Header.Get("Authorization"))
+	}))
+	defer api.Close()
+
+	dir, err := ioutil.TempDir("", "conman")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "config.yaml")
+	config := fmt.Sprintf(`connections:
+  sso:
+    serviceURL: %s
+    authToken: copied-by-hand
+    oauth2:
+      tokenURL: %s/token
+      authURL: %s/authorize
+      deviceAuthURL: %s/device
+      clientID: cli
+      scopes: [openid, profile]
+`, api.URL, auth.URL, auth.URL, auth.URL)
+	if err = ioutil.WriteFile(fn, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	viper.SetConfigFile(fn)
+	if err = viper.ReadInConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Until there's a login, the authToken is used.
+	conn, _ := GetConnection("sso")
+	_, resp, err := conn.Get("/", nil)
+	if err != nil || readBody(t, resp) != "Bearer copied-by-hand" {
+		t.Fatalf("Expected the authToken before logging in, error: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	tok, err := conn.Login(ctx, LoginOptions{OpenURL: browser(t, "")})
+	if err != nil {
+		t.Fatalf("Login failed: %v", err)
+	}
+	if tok.AccessToken != "access-1" || tok.RefreshToken != "refresh-1" || conn.OAuth2.RefreshToken != "refresh-1" || conn.AuthToken != "" {
+		t.Errorf("Got token %#v, connection %#v", tok, conn)
+	}
+
+	// The refresh token is saved, and the access token used without a refresh.
+	saved, _ := GetConnection("sso")
+	_, resp, err = saved.Get("/", nil)
+	if err != nil || readBody(t, resp) != "Bearer access-1" {
+		t.Errorf("Expected the access token from the login, error: %v", err)
+	}
+	v := viper.New()
+	v.SetConfigFile(fn)
+	if err = v.ReadInConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if got := v.GetString("connections.sso.oauth2.refreshToken"); got != "refresh-1" {
+		t.Errorf("Got refreshToken %q in the file", got)
+	}
+	if v.IsSet("connections.sso.authToken") {
+		t.Errorf("Expected the old authToken to be removed from the file")
+	}
+
+	// A refresh token the server rotates is saved when we ask.
+	saved.tokenSource().(*cachedTokenSource).invalidate(time.Now())
+	_, resp, err = saved.Get("/", nil)
+	if err != nil || readBody(t, resp) != "Bearer access-2" {
+		t.Errorf("Expected a refreshed access token, error: %v", err)
+	}
+	if err = v.ReadInConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if got := v.GetString("connections.sso.oauth2.refreshToken"); got != "refresh-1" {
+		t.Errorf("Expected the request to leave the file alone, got refreshToken %q", got)
+	}
+	if err = saved.SaveRefreshToken(); err != nil {
+		t.Fatal(err)
+	}
+	if err = v.ReadInConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if got := v.GetString("connections.sso.oauth2.refreshToken"); got != "refresh-2" {
+		t.Errorf("Got refreshToken %q in the file after a refresh", got)
+	}
+	if fmt.Sprint(auth.grants) != "[authorization_code refresh_token]" {
+		t.Errorf("Got grants %v", auth.grants)
+	}
+
+	// Denied.
+	_, err = conn.Login(ctx, LoginOptions{OpenURL: browser(t, "&deny=1")})
+	var oerr *OAuth2Error
+	if !errors.As(err, &oerr) || oerr.Code != "access_denied" {
+		t.Errorf("Expected access_denied, got %v", err)
+	}
+
+	// A redirect with the wrong state is turned away, and the login goes on.
+	follow := browser(t, "")
+	tok, err = conn.Login(ctx, LoginOptions{OpenURL: func(u string) error {
+		parsed, _ := url.Parse(u)
+		resp, err := http.Get(parsed.Query().Get("redirect_uri") + "?state=forged&error=access_denied")
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("Got %d for a forged redirect", resp.StatusCode)
+		}
+		return follow(u)
+	}})
+	if err != nil || tok.AccessToken == "" {
+		t.Errorf("Expected the login to succeed after a forged redirect, got %v", err)
+	}
+
+	// Nobody logs in.
+	short, cancelShort := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancelShort()
+	if _, err = conn.Login(short, LoginOptions{OpenURL: func(string) error { return nil }}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the login to time out, got %v", err)
+	}
+}
+
+func TestDeviceLogin(t *testing.T) {
+	defer func(saved time.Duration) { DefaultDevicePollInterval = saved }(DefaultDevicePollInterval)
+	DefaultDevicePollInterval = 10 * time.Millisecond
+
+	auth := newAuthServer(t, false)
+	defer auth.Close()
+	auth.pending = 2
+
+	conn := &Connection{
+		Name:       "device",
+		ServiceURL: "http://api.example.com",
+		OAuth2: OAuth2Config{
+			TokenURL:      auth.URL + "/token",
+			AuthURL:       auth.URL + "/authorize",
+			DeviceAuthURL: auth.URL + "/device",
+			ClientID:      "cli",
+			RefreshToken:  "from-an-earlier-login",
+		},
+	}
+	var dc DeviceCode
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	tok, err := conn.Login(ctx, LoginOptions{Device: true, Prompt: func(d DeviceCode) { dc = d }})
+	if err != nil {
+		t.Fatalf("Login failed: %v", err)
+	}
+	if dc.UserCode != "ABCD-EFGH" || dc.VerificationURI != "https://example.com/device" || dc.Expiry.IsZero() {
+		t.Errorf("Got device code %#v", dc)
+	}
+	if auth.polls != 3 {
+		t.Errorf("Got %d polls, expected 3", auth.polls)
+	}
+	// No refresh token, so the access token is kept, and the old refresh token dropped.
+	if tok.AccessToken != "access-3" || conn.AuthToken != "access-3" || conn.OAuth2.RefreshToken != "" {
+		t.Errorf("Got token %#v, connection %#v", tok, conn)
+	}
+
+	conn.OAuth2.DeviceAuthURL = ""
+	if _, err = conn.Login(ctx, LoginOptions{Device: true}); err == nil {
+		t.Errorf("Expected an error without a deviceAuthURL")
+	}
+}
+
+func readBody(t *testing.T, resp *http.Response) string {
+	t.Helper()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return string(b)
+}
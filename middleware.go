@@ -0,0 +1,66 @@
+package conman
+
+import (
+	"net/http"
+	"sync"
+)
+
+//
+// Middleware
+//
+// Middleware wraps each attempt at sending a request, inside the retry loop, so it sees
+// every attempt's request and response. It can change the request, look at or
+// replace the response, or not call next at all and return a response of its own.
+//
+// Middleware registered with Use runs first, outermost, in the order it was registered.
+// Then the connection's own Middleware, in order. The innermost round trip signs the
+// request, if the connection has Signing, and sends it with the connection's http.Client.
+//
+
+// RoundTripFunc sends a request for a connection. effect is the SideEffect of the call
+// the request is part of.
+type RoundTripFunc func(conn *Connection, req *http.Request, effect *SideEffect) (*http.Response, error)
+
+// Middleware wraps a RoundTripFunc.
+type Middleware func(next RoundTripFunc) RoundTripFunc
+
+var (
+	middlewareMu     sync.RWMutex
+	globalMiddleware []Middleware
+)
+
+// Use adds middleware for all connections.
+func Use(mw ...Middleware) {
+	middlewareMu.Lock()
+	defer middlewareMu.Unlock()
+	globalMiddleware = append(globalMiddleware, mw...)
+}
+
+// Use adds middleware for this connection, which runs inside any added with the package Use.
+func (conn *Connection) Use(mw ...Middleware) {
+	conn.Middleware = append(conn.Middleware, mw...)
+}
+
+// roundTripper builds the middleware chain around client.
+func (conn *Connection) roundTripper(client *http.Client) RoundTripFunc {
+	rt := func(_ *Connection, req *http.Request, _ *SideEffect) (*http.Response, error) {
+		if conn.Signing.enabled() {
+			// Connections from the config file haven't been through validate.
+			if err := conn.checkSigningAuth(); err != nil {
+				return nil, err
+			}
+			if err := conn.Signing.sign(req); err != nil {
+				return nil, err
+			}
+		}
+		return client.Do(req)
+	}
+
+	middlewareMu.RLock()
+	chain := append(append([]Middleware{}, globalMiddleware...), conn.Middleware...)
+	middlewareMu.RUnlock()
+	for i := len(chain) - 1; i >= 0; i-- {
+		rt = chain[i](rt)
+	}
+	return rt
+}
@@ -0,0 +1,89 @@
+package conman
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMiddleware(t *testing.T) {
+	defer func(saved []Middleware) { globalMiddleware = saved }(globalMiddleware)
+	globalMiddleware = nil
+
+	var got *http.Request
+	calls := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		calls++
+		if calls == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"name": "server"}`)
+	}))
+	defer ts.Close()
+
+	var order []string
+	trace := func(name string) Middleware {
+		return func(next RoundTripFunc) RoundTripFunc {
+			return func(conn *Connection, req *http.Request, effect *SideEffect) (*http.Response, error) {
+				order = append(order, name+">")
+				req.Header.Add("X-Trace", name)
+				resp, err := next(conn, req, effect)
+				order = append(order, "<"+name)
+				return resp, err
+			}
+		}
+	}
+
+	Use(trace("global1"), trace("global2"))
+	conn := Connection{Name: "mw", ServiceURL: ts.URL, Retry: RetryPolicy{MaxAttempts: 2, BaseDelay: 1}}
+	conn.Use(trace("conn1"))
+	conn.Use(trace("conn2"))
+
+	var result struct{ Name string }
+	effect, _, err := conn.Get("/", &result)
+	if err != nil || result.Name != "server" {
+		t.Fatalf("Got %#v, error: %v", result, err)
+	}
+	attempt := "global1> global2> conn1> conn2> <conn2 <conn1 <global2 <global1"
+	if effect.Attempts != 2 || fmt.Sprint(order) != "["+attempt+" "+attempt+"]" {
+		t.Errorf("Got %d attempts, order %v", effect.Attempts, order)
+	}
+	if h := got.Header.Values("X-Trace"); fmt.Sprint(h) != "[global1 global2 conn1 conn2]" {
+		t.Errorf("Got headers %v on the last attempt", h)
+	}
+
+	// Short circuit.
+	globalMiddleware = nil
+	conn.Middleware = nil
+	calls = 0
+	conn.Use(func(next RoundTripFunc) RoundTripFunc {
+		return func(conn *Connection, req *http.Request, effect *SideEffect) (*http.Response, error) {
+			if req.URL.Path == "/cached" {
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Status:     "200 OK",
+					Header:     http.Header{"Content-Type": {"application/json"}},
+					Body:       ioutil.NopCloser(strings.NewReader(`{"name": "cached"}`)),
+					Request:    req,
+				}, nil
+			}
+			if req.URL.Path == "/fail" {
+				return nil, errors.New("refused by middleware")
+			}
+			return next(conn, req, effect)
+		}
+	})
+	if _, _, err = conn.Get("/cached", &result); err != nil || result.Name != "cached" || calls != 0 {
+		t.Errorf("Got %#v, %d calls, error: %v", result, calls, err)
+	}
+	if _, _, err = conn.Get("/fail", &result); err == nil || !strings.Contains(err.Error(), "refused") {
+		t.Errorf("Expected the middleware error, got: %v", err)
+	}
+}
@@ -0,0 +1,447 @@
+package conman
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// OAuth2Config configures a connection to get its tokens from an OAuth2 token endpoint
+// (RFC 6749), with the client_credentials grant, or the refresh_token grant if there's a RefreshToken.
+// If there's an AuthURL or DeviceAuthURL the refresh token comes from a Login.
+type OAuth2Config struct {
+	TokenURL      string
+	AuthURL       string // Authorization endpoint, for Login with a browser.
+	DeviceAuthURL string // Device authorization endpoint, for Login without one.
+	ClientID      string
+	ClientSecret  string
+	Scopes        []string
+	RefreshToken  string
+	AuthStyle     string // How the client ID and secret are sent, see the OAuth2AuthStyle constants.
+}
+
+// How the client credentials are sent to the token endpoint.
+const (
+	OAuth2AuthStyleHeader = "header" // HTTP basic auth, the default.
+	OAuth2AuthStyleParams = "params" // client_id and client_secret in the form body.
+)
+
+// Token is an access token from a TokenSource.
+type Token struct {
+	AccessToken  string
+	TokenType    string
+	RefreshToken string
+	Expiry       time.Time // Zero if the token doesn't expire.
+}
+
+// TokenExpiryDelta is how long before it expires that a token stops being used,
+// so that it doesn't expire on the way to the server.
+var TokenExpiryDelta = 10 * time.Second
+
+// Valid is true if the token is there and not about to expire.
+func (t *Token) Valid() bool {
+	return t != nil && t.AccessToken != "" &&
+		(t.Expiry.IsZero() || time.Until(t.Expiry) > TokenExpiryDelta)
+}
+
+// TokenSource supplies the tokens for a connection's requests.
+type TokenSource interface {
+	Token(ctx context.Context) (*Token, error)
+}
+
+// CachedTokenSource returns a TokenSource that hands out src's token until it expires,
+// and then gets another. If a connection using it has a request rejected with a 401
+// the token is dropped, and the request sent once more with a new one.
+func CachedTokenSource(src TokenSource) TokenSource {
+	return &cachedTokenSource{src: src}
+}
+
+type cachedTokenSource struct {
+	mu      sync.Mutex
+	src     TokenSource
+	tok     *Token
+	fetched time.Time
+}
+
+func (c *cachedTokenSource) Token(ctx context.Context) (*Token, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.tok.Valid() {
+		return c.tok, nil
+	}
+	tok, err := c.src.Token(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.tok, c.fetched = tok, time.Now()
+	return tok, nil
+}
+
+// invalidate drops the token if it was fetched before since, so that
+// a token that's already been replaced isn't thrown away.
+func (c *cachedTokenSource) invalidate(since time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.fetched.Before(since) {
+		c.tok = nil
+	}
+}
+
+// Token sources for OAuth2 and AuthCommand configurations are cached by connection name like
+// clients, so all the copies of a connection share a token, and a change to the configuration
+// replaces it.
+var (
+	tokenSourcesMu sync.Mutex
+	tokenSources   = make(map[string]keyedTokenSource)
+)
+
+// keyedTokenSource is a cached token source, and the configuration it's for.
+type keyedTokenSource struct {
+	key string
+	ts  *cachedTokenSource
+}
+
+// tokenSource returns the connection's TokenSource if it has one. Otherwise tokens come from,
+// in order, its OAuth2 configuration or its AuthCommand. It's nil if there's none of these,
+// and the AuthToken is used.
+func (conn *Connection) tokenSource() TokenSource {
+	if conn.TokenSource != nil {
+		return conn.TokenSource
+	}
+	var src TokenSource
+	oc := conn.OAuth2
+	switch {
+	// Until there's been a Login, an interactive configuration has no tokens.
+	case oc.TokenURL != "" && (!oc.interactive() || oc.RefreshToken != ""):
+		src = &oauth2TokenSource{conn: *conn, refreshToken: oc.RefreshToken}
+	case len(conn.AuthCommand.Command) > 0:
+		src = &commandTokenSource{conn: *conn}
+	default:
+		return nil
+	}
+
+	key := conn.tokenSourceKey()
+	tokenSourcesMu.Lock()
+	defer tokenSourcesMu.Unlock()
+	if cached, ok := tokenSources[conn.Name]; ok && cached.key == key {
+		return cached.ts
+	}
+	ts := &cachedTokenSource{src: src}
+	tokenSources[conn.Name] = keyedTokenSource{key: key, ts: ts}
+	return ts
+}
+
+// tokenSourceKey leaves out the refresh token, which changes
+// as the server rotates it, and when there's a new Login.
+func (conn *Connection) tokenSourceKey() string {
+	oc := conn.OAuth2
+	oc.RefreshToken = ""
+	return fmt.Sprintf("%s|%#v|%#v", conn.clientKey(), oc, conn.AuthCommand)
+}
+
+// token returns the token to put on a request, from the TokenSource if there is one,
+// otherwise the AuthToken.
+func (conn *Connection) token(ctx context.Context) (string, error) {
+	ts := conn.tokenSource()
+	if ts == nil {
+		return conn.AuthToken, nil
+	}
+	tok, err := ts.Token(ctx)
+	if err != nil {
+		return "", fmt.Errorf("connection %q couldn't get a token: %w", conn.Name, err)
+	}
+	return tok.AccessToken, nil
+}
+
+// retryUnauthorized sends orig again, once, with a new token, after resp came back 401 for
+// a request sent at start. If it can't get a new token, or can't resend the body, resp is returned.
+func (conn *Connection) retryUnauthorized(client *http.Client, orig *http.Request, resp *http.Response, start time.Time, effect *SideEffect) (*http.Response, error) {
+	ts, ok := conn.tokenSource().(*cachedTokenSource)
+	if !ok {
+		return resp, nil
+	}
+	ctx := orig.Context()
+	log := conn.logger()
+	next, err := rewindRequest(orig)
+	if err != nil {
+		return resp, nil
+	}
+	ts.invalidate(start)
+	token, err := conn.token(ctx)
+	if err != nil {
+		log.WarnContext(ctx, "couldn't get a new token after a 401", "error", err)
+		return resp, nil
+	}
+	conn.clearAuth(next)
+	if err = conn.applyAuth(next, token); err != nil {
+		return resp, nil
+	}
+
+	if resp.Body != nil {
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	log.InfoContext(ctx, "retrying with a new token", LogMethodKey, next.Method, LogURLKey, newRedactor(conn).url(next.URL.String()))
+	attempts := effect.Attempts
+	resp, err = conn.doWithRetry(client, next, effect)
+	effect.Attempts += attempts
+	return resp, err
+}
+
+// oauth2TokenSource gets tokens from the token endpoint.
+// It isn't safe for concurrent use, it's always wrapped in a cachedTokenSource.
+type oauth2TokenSource struct {
+	conn         Connection
+	refreshToken string // The latest, if the server rotates them.
+}
+
+// maxTokenResponse limits how much of a token endpoint's response we read.
+const maxTokenResponse = 1 << 20
+
+func (s *oauth2TokenSource) Token(ctx context.Context) (*Token, error) {
+	form := url.Values{}
+	if s.refreshToken != "" {
+		form.Set("grant_type", "refresh_token")
+		form.Set("refresh_token", s.refreshToken)
+	} else {
+		form.Set("grant_type", "client_credentials")
+	}
+	if len(s.conn.OAuth2.Scopes) > 0 {
+		form.Set("scope", strings.Join(s.conn.OAuth2.Scopes, " "))
+	}
+	tok, err := s.conn.tokenRequest(ctx, form)
+	if err != nil {
+		return nil, err
+	}
+
+	if tok.RefreshToken == "" {
+		tok.RefreshToken = s.refreshToken
+	}
+	// A rotated refresh token is kept here, see SaveRefreshToken.
+	s.refreshToken = tok.RefreshToken
+	return tok, nil
+}
+
+// SaveRefreshToken writes the refresh token the connection's requests are using back to the
+// configuration (see UpdateConnection), if the server has rotated it since the connection was
+// loaded, so the next run doesn't start with one that's been used up.
+// Requests don't write the configuration themselves, so call this when nothing else is using it,
+// e.g. before the program exits.
+func (conn *Connection) SaveRefreshToken() error {
+	latest := conn.latestRefreshToken()
+	if latest == "" {
+		return nil
+	}
+	saved, err := LoadConnection(conn.Name)
+	if err != nil {
+		return err
+	}
+	if saved.OAuth2.TokenURL != conn.OAuth2.TokenURL || saved.OAuth2.RefreshToken == latest {
+		return nil
+	}
+	saved.OAuth2.RefreshToken = latest
+	if err = UpdateConnection(saved); err != nil {
+		return fmt.Errorf("connection %q couldn't save the new refresh token: %w", conn.Name, err)
+	}
+	conn.OAuth2.RefreshToken = latest
+	return nil
+}
+
+// latestRefreshToken is the refresh token held by the connection's cached token source,
+// empty if it doesn't have one.
+func (conn *Connection) latestRefreshToken() string {
+	if conn.TokenSource != nil {
+		return ""
+	}
+	ts, ok := conn.tokenSource().(*cachedTokenSource)
+	if !ok {
+		return ""
+	}
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if src, ok := ts.src.(*oauth2TokenSource); ok {
+		return src.refreshToken
+	}
+	return ""
+}
+
+// tokenRequest posts form to the token endpoint, and returns the token in the response.
+func (conn *Connection) tokenRequest(ctx context.Context, form url.Values) (*Token, error) {
+	var tr struct {
+		AccessToken  string      `json:"access_token"`
+		TokenType    string      `json:"token_type"`
+		RefreshToken string      `json:"refresh_token"`
+		ExpiresIn    json.Number `json:"expires_in"`
+	}
+	if err := conn.postForm(ctx, conn.OAuth2.TokenURL, form, &tr); err != nil {
+		return nil, err
+	}
+	if tr.AccessToken == "" {
+		return nil, fmt.Errorf("token response from %s has no access_token", newRedactor(conn).url(conn.OAuth2.TokenURL))
+	}
+	tok := &Token{AccessToken: tr.AccessToken, TokenType: tr.TokenType, RefreshToken: tr.RefreshToken}
+	if secs, err := tr.ExpiresIn.Int64(); err == nil && secs > 0 {
+		tok.Expiry = time.Now().Add(time.Duration(secs) * time.Second)
+	}
+	return tok, nil
+}
+
+// postForm posts form to one of the OAuth2 endpoints, with the client's credentials,
+// and decodes the JSON response into v. An error response is returned as an OAuth2Error.
+func (conn *Connection) postForm(ctx context.Context, endpoint string, form url.Values, v interface{}) error {
+	oc := conn.OAuth2
+	basic := oc.authStyle() == OAuth2AuthStyleHeader && oc.ClientSecret != ""
+	if !basic {
+		form.Set("client_id", oc.ClientID)
+		if oc.ClientSecret != "" {
+			form.Set("client_secret", oc.ClientSecret)
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return fmt.Errorf("couldn't generate OAuth2 request: %v", err)
+	}
+	req.Header.Set("Content-Type", FormContentType)
+	req.Header.Set("Accept", JSONContentType)
+	if basic {
+		// RFC 6749 section 2.3.1: the credentials are form encoded before they go in the header.
+		req.SetBasicAuth(url.QueryEscape(oc.ClientID), url.QueryEscape(oc.ClientSecret))
+	}
+
+	client, err := conn.HTTPClient()
+	if err != nil {
+		return err
+	}
+	log := conn.logger()
+	target := newRedactor(conn).url(endpoint)
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		log.WarnContext(ctx, "OAuth2 request failed", LogURLKey, target, LogElapsedKey, time.Since(start), "error", err)
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxTokenResponse))
+	if err != nil {
+		return err
+	}
+
+	var oe struct {
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	json.Unmarshal(body, &oe)
+	if resp.StatusCode != http.StatusOK || oe.Error != "" {
+		err = &OAuth2Error{StatusCode: resp.StatusCode, Code: oe.Error, Description: oe.ErrorDescription}
+		log.InfoContext(ctx, "OAuth2 response", LogURLKey, target, LogStatusKey, resp.StatusCode,
+			LogElapsedKey, time.Since(start), "error", err)
+		return err
+	}
+	if err = json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("couldn't decode the response from %s: %v", target, err)
+	}
+	log.InfoContext(ctx, "OAuth2 response", LogURLKey, target, LogStatusKey, resp.StatusCode, LogElapsedKey, time.Since(start))
+	return nil
+}
+
+// OAuth2Error is an error response from an OAuth2 endpoint.
+type OAuth2Error struct {
+	StatusCode  int    // Zero for an error in a login redirect.
+	Code        string // The error code, e.g. invalid_client.
+	Description string
+}
+
+func (e *OAuth2Error) Error() string {
+	s := "OAuth2 request failed"
+	if e.StatusCode != 0 {
+		s += fmt.Sprintf(" with %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+	if e.Code != "" {
+		s += ": " + e.Code
+	}
+	if e.Description != "" {
+		s += ": " + e.Description
+	}
+	return s
+}
+
+// interactive is true if tokens come from a Login, rather than the client's own credentials.
+func (oc OAuth2Config) interactive() bool {
+	return oc.AuthURL != "" || oc.DeviceAuthURL != ""
+}
+
+func (oc OAuth2Config) authStyle() string {
+	if oc.AuthStyle == "" {
+		return OAuth2AuthStyleHeader
+	}
+	return strings.ToLower(oc.AuthStyle)
+}
+
+// getOAuth2Config reads the oauth2 settings under the key ok.
+func getOAuth2Config(ok string) OAuth2Config {
+	key := func(k string) string { return fmt.Sprintf("%s.%s", ok, k) }
+	return OAuth2Config{
+		TokenURL:      viper.GetString(key(TokenURLKey)),
+		AuthURL:       viper.GetString(key(AuthURLKey)),
+		DeviceAuthURL: viper.GetString(key(DeviceAuthURLKey)),
+		ClientID:      viper.GetString(key(ClientIDKey)),
+		ClientSecret:  viper.GetString(key(ClientSecretKey)),
+		Scopes:        viper.GetStringSlice(key(ScopesKey)),
+		RefreshToken:  viper.GetString(key(RefreshTokenKey)),
+		AuthStyle:     viper.GetString(key(AuthStyleKey)),
+	}
+}
+
+func (oc OAuth2Config) mergeConfig(m map[string]interface{}) {
+	setKey(m, TokenURLKey, oc.TokenURL)
+	setKey(m, AuthURLKey, oc.AuthURL)
+	setKey(m, DeviceAuthURLKey, oc.DeviceAuthURL)
+	setKey(m, ClientIDKey, oc.ClientID)
+	setKey(m, ClientSecretKey, oc.ClientSecret)
+	scopes := make([]interface{}, len(oc.Scopes))
+	for i, s := range oc.Scopes {
+		scopes[i] = s
+	}
+	setKey(m, ScopesKey, scopes)
+	setKey(m, RefreshTokenKey, oc.RefreshToken)
+	setKey(m, AuthStyleKey, oc.AuthStyle)
+}
+
+func (oc OAuth2Config) validate() error {
+	if oc.TokenURL == "" {
+		if oc.ClientID != "" || oc.ClientSecret != "" || oc.RefreshToken != "" || oc.interactive() {
+			return fmt.Errorf("%s is needed", TokenURLKey)
+		}
+		return nil
+	}
+	for _, ep := range []struct{ key, value string }{
+		{TokenURLKey, oc.TokenURL}, {AuthURLKey, oc.AuthURL}, {DeviceAuthURLKey, oc.DeviceAuthURL},
+	} {
+		if ep.value == "" {
+			continue
+		}
+		u, err := url.Parse(ep.value)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("%s %q must be an absolute http or https URL", ep.key, ep.value)
+		}
+	}
+	if oc.ClientID == "" {
+		return fmt.Errorf("%s is needed", ClientIDKey)
+	}
+	switch oc.authStyle() {
+	case OAuth2AuthStyleHeader, OAuth2AuthStyleParams:
+	default:
+		return fmt.Errorf("unknown %s %q", AuthStyleKey, oc.AuthStyle)
+	}
+	return nil
+}
@@ -0,0 +1,363 @@
+package conman
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+// tokenServer is a fake OAuth2 token endpoint that hands out tok-1, tok-2, ...
+type tokenServer struct {
+	*httptest.Server
+	mu        sync.Mutex
+	calls     int
+	expiresIn int
+	forms     []map[string]string
+	basic     []string
+}
+
+func newTokenServer(expiresIn int, rotate bool) *tokenServer {
+	s := &tokenServer{expiresIn: expiresIn}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		r.ParseForm()
+		form := make(map[string]string)
+		for k := range r.PostForm {
+			form[k] = r.PostForm.Get(k)
+		}
+		s.forms = append(s.forms, form)
+		user, password, _ := r.BasicAuth()
+		s.basic = append(s.basic, user+":"+password)
+
+		w.Header().Set("Content-Type", "application/json")
+		if form["client_id"] == "bad" || user == "bad" {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"error": "invalid_client", "error_description": "unknown client"}`)
+			return
+		}
+		s.calls++
+		resp := map[string]interface{}{
+			"access_token": fmt.Sprintf("tok-%d", s.calls),
+			"token_type":   "Bearer",
+			"expires_in":   s.expiresIn,
+		}
+		if rotate {
+			resp["refresh_token"] = fmt.Sprintf("refresh-%d", s.calls)
+		}
+		json.NewEncoder(w).Encode(resp)
+	}))
+	return s
+}
+
+// apiServer accepts the token in *accept.
+func apiServer(mu *sync.Mutex, accept *string, unauthorized *int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.Header.Get("Authorization") != "Bearer "+*accept {
+			*unauthorized++
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"ok": true}`)
+	}))
+}
+
+func TestOAuth2ClientCredentials(t *testing.T) {
+	tokens := newTokenServer(3600, false)
+	defer tokens.Close()
+	var mu sync.Mutex
+	accept, unauthorized := "tok-1", 0
+	api := apiServer(&mu, &accept, &unauthorized)
+	defer api.Close()
+
+	conn := Connection{
+		Name:       "oauth2-cc",
+		ServiceURL: api.URL,
+		OAuth2: OAuth2Config{
+			TokenURL:     tokens.URL,
+			ClientID:     "client",
+			ClientSecret: "s3cret&more",
+			Scopes:       []string{"read", "write"},
+		},
+	}
+	var result struct{ OK bool }
+	for i := 0; i < 3; i++ {
+		if _, _, err := conn.Get("/", &result); err != nil || !result.OK {
+			t.Fatalf("Request %d: got %#v, error: %v", i, result, err)
+		}
+	}
+	if tokens.calls != 1 {
+		t.Errorf("Expected the token to be fetched once, got %d", tokens.calls)
+	}
+	form := tokens.forms[0]
+	if form["grant_type"] != "client_credentials" || form["scope"] != "read write" || form["client_secret"] != "" {
+		t.Errorf("Got token request form %v", form)
+	}
+	if tokens.basic[0] != "client:s3cret%26more" {
+		t.Errorf("Got basic auth %q", tokens.basic[0])
+	}
+
+	// A copy of the connection from elsewhere shares the token.
+	copied := conn
+	if _, _, err := copied.Get("/", &result); err != nil || tokens.calls != 1 {
+		t.Errorf("Got %d token requests, error: %v", tokens.calls, err)
+	}
+
+	// The token is revoked: the 401 gets a new token and the request is retried once.
+	mu.Lock()
+	accept = "tok-2"
+	mu.Unlock()
+	effect, resp, err := conn.Post("/", map[string]string{"a": "b"}, &result)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected the retry to work, got %v, error: %v", resp, err)
+	}
+	if tokens.calls != 2 || unauthorized != 1 || effect.Attempts != 2 {
+		t.Errorf("Got %d token requests, %d unauthorized, %d attempts", tokens.calls, unauthorized, effect.Attempts)
+	}
+
+	// It's only retried once.
+	mu.Lock()
+	accept = "none of them"
+	mu.Unlock()
+	_, resp, err = conn.Get("/", &result)
+	var herr *HTTPError
+	if !errors.As(err, &herr) || resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected a 401 error, got %v", err)
+	}
+	if tokens.calls != 3 || unauthorized != 3 {
+		t.Errorf("Got %d token requests, %d unauthorized", tokens.calls, unauthorized)
+	}
+}
+
+func TestOAuth2Refresh(t *testing.T) {
+	// Tokens that expire inside TokenExpiryDelta are fetched for every request.
+	tokens := newTokenServer(1, true)
+	defer tokens.Close()
+	var mu sync.Mutex
+	accept := ""
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		accept = r.URL.Query().Get(DefaultAuthParam)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"ok": true}`)
+	}))
+	defer api.Close()
+
+	conn := Connection{
+		Name:       "oauth2-refresh",
+		ServiceURL: api.URL,
+		AuthScheme: AuthSchemeQuery,
+		OAuth2: OAuth2Config{
+			TokenURL:     tokens.URL,
+			ClientID:     "client",
+			ClientSecret: "secret",
+			RefreshToken: "refresh-0",
+			AuthStyle:    OAuth2AuthStyleParams,
+		},
+	}
+	var result struct{ OK bool }
+	for i := 1; i <= 2; i++ {
+		if _, _, err := conn.Get("/", &result); err != nil {
+			t.Fatalf("Request %d: %v", i, err)
+		}
+		if want := fmt.Sprintf("tok-%d", i); accept != want {
+			t.Errorf("Request %d: got token %q, expected %q", i, accept, want)
+		}
+	}
+	if len(tokens.forms) != 2 {
+		t.Fatalf("Got %d token requests", len(tokens.forms))
+	}
+	for i, form := range tokens.forms {
+		want := map[string]string{
+			"grant_type":    "refresh_token",
+			"refresh_token": fmt.Sprintf("refresh-%d", i), // Rotated by the server.
+			"client_id":     "client",
+			"client_secret": "secret",
+		}
+		if fmt.Sprint(form) != fmt.Sprint(want) || tokens.basic[i] != ":" {
+			t.Errorf("Token request %d: got %v basic %q, expected %v", i, form, tokens.basic[i], want)
+		}
+	}
+}
+
+// Concurrent requests that rotate the refresh token don't write the configuration,
+// SaveRefreshToken does, afterwards.
+func TestRotatedRefreshTokenSaved(t *testing.T) {
+	defer resetConfig()
+	tokens := newTokenServer(1, true)
+	defer tokens.Close()
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer api.Close()
+
+	fn := filepath.Join(t.TempDir(), "config.yaml")
+	config := fmt.Sprintf(`connections:
+  rotating:
+    serviceURL: %s
+    authScheme: query
+    oauth2:
+      tokenURL: %s
+      clientID: client
+      refreshToken: refresh-0
+`, api.URL, tokens.URL)
+	if err := ioutil.WriteFile(fn, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	viper.SetConfigFile(fn)
+	if err := viper.ReadInConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := LoadConnection("rotating")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 5; j++ {
+				if _, _, err := conn.Get("/", nil); err != nil {
+					t.Error(err)
+				}
+				if _, err := LoadConnection("rotating"); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if b, _ := ioutil.ReadFile(fn); string(b) != config {
+		t.Errorf("Expected requests to leave the config file alone, got:\n%s", b)
+	}
+
+	if err = conn.SaveRefreshToken(); err != nil {
+		t.Fatal(err)
+	}
+	want := fmt.Sprintf("refresh-%d", tokens.calls)
+	saved, err := LoadConnection("rotating")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.OAuth2.RefreshToken != want || conn.OAuth2.RefreshToken != want {
+		t.Errorf("Expected %s saved, got %q", want, saved.OAuth2.RefreshToken)
+	}
+}
+
+func TestOAuth2Error(t *testing.T) {
+	tokens := newTokenServer(3600, false)
+	defer tokens.Close()
+	called := false
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+	defer api.Close()
+
+	conn := Connection{
+		Name:       "oauth2-error",
+		ServiceURL: api.URL,
+		OAuth2:     OAuth2Config{TokenURL: tokens.URL, ClientID: "bad", ClientSecret: "secret"},
+	}
+	_, _, err := conn.Get("/", nil)
+	var oerr *OAuth2Error
+	if !errors.As(err, &oerr) || oerr.Code != "invalid_client" || oerr.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expected an OAuth2Error, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "unknown client") || called {
+		t.Errorf("Got error %q, request sent: %t", err, called)
+	}
+}
+
+func TestCachedTokenSource(t *testing.T) {
+	var mu sync.Mutex
+	accept, unauthorized := "static-2", 0
+	api := apiServer(&mu, &accept, &unauthorized)
+	defer api.Close()
+
+	n := 0
+	src := tokenSourceFunc(func() (*Token, error) {
+		n++
+		return &Token{AccessToken: fmt.Sprintf("static-%d", n)}, nil
+	})
+	conn := Connection{Name: "cached", ServiceURL: api.URL, AuthToken: "ignored", TokenSource: CachedTokenSource(src)}
+	if _, _, err := conn.Get("/", nil); err != nil || n != 2 || unauthorized != 1 {
+		t.Errorf("Got %d tokens, %d unauthorized, error: %v", n, unauthorized, err)
+	}
+
+	// A source that isn't cached isn't retried.
+	n, unauthorized = 0, 0
+	conn.TokenSource = src
+	if _, _, err := conn.Get("/", nil); err == nil || n != 1 || unauthorized != 1 {
+		t.Errorf("Got %d tokens, %d unauthorized, error: %v", n, unauthorized, err)
+	}
+}
+
+type tokenSourceFunc func() (*Token, error)
+
+func (f tokenSourceFunc) Token(context.Context) (*Token, error) { return f() }
+
+func TestOAuth2Config(t *testing.T) {
+	defer resetConfig()
+	viper.Set(ConnectionsKey, map[string]interface{}{
+		"one": map[string]interface{}{
+			ServiceURLKey: "http://one.example.com",
+			OAuth2Key: map[string]interface{}{
+				TokenURLKey:     "https://auth.example.com/token",
+				ClientIDKey:     "client",
+				ClientSecretKey: "secret",
+				ScopesKey:       []interface{}{"read", "write"},
+				AuthStyleKey:    "params",
+			},
+		},
+	})
+	conn, ok := getConnectionFromConfig("one")
+	if !ok {
+		t.Fatal("Connection not found")
+	}
+	want := OAuth2Config{
+		TokenURL:     "https://auth.example.com/token",
+		ClientID:     "client",
+		ClientSecret: "secret",
+		Scopes:       []string{"read", "write"},
+		AuthStyle:    "params",
+	}
+	if fmt.Sprintf("%#v", conn.OAuth2) != fmt.Sprintf("%#v", want) {
+		t.Errorf("Got %#v", conn.OAuth2)
+	}
+	if err := conn.validate(); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	m := make(map[string]interface{})
+	conn.mergeConfig(m)
+	if fmt.Sprint(m[OAuth2Key]) != "map[authStyle:params clientID:client clientSecret:secret scopes:[read write] tokenURL:https://auth.example.com/token]" {
+		t.Errorf("Got config %v", m[OAuth2Key])
+	}
+
+	bad := []OAuth2Config{
+		{ClientID: "client"},
+		{TokenURL: "/token", ClientID: "client"},
+		{TokenURL: "https://auth.example.com/token"},
+		{TokenURL: "https://auth.example.com/token", ClientID: "client", AuthStyle: "cookie"},
+	}
+	for _, oc := range bad {
+		conn.OAuth2 = oc
+		if err := conn.validate(); err == nil {
+			t.Errorf("Expected an error for %#v", oc)
+		}
+	}
+}
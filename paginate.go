@@ -0,0 +1,330 @@
+package conman
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// PageOptions say how a Paginator finds the items in a page, and the next page.
+//
+// A Link header with rel="next" (RFC 5988) is always followed if there is one,
+// as long as it's on the connection's ServiceURL scheme and host.
+// Otherwise the next page is found from a cursor in the page if CursorPath is set, or
+// by counting pages or items if PageParam or OffsetParam is. Without any of these there's
+// only one page.
+//
+// Paths are dotted paths into the JSON of the page, e.g. "data.items" or "meta.next".
+// A segment that's a number indexes an array.
+type PageOptions struct {
+	ItemsPath string // Path of the array of items in a page, empty if the page is the array.
+	MaxItems  int    // Stop after this many items, 0 for no limit.
+
+	CursorPath  string // Path of the next cursor in a page. An empty or null cursor is the last page.
+	CursorParam string // Query parameter to send the cursor in, defaults to "cursor".
+
+	PageParam   string // Query parameter with the page number.
+	FirstPage   int    // Number of the first page, defaults to 1.
+	OffsetParam string // Query parameter with the offset of the first item in the page.
+	LimitParam  string // Query parameter with the page size, sent with Limit on every request.
+	Limit       int    // Page size. A page with fewer items than this is the last one.
+}
+
+// DefaultCursorParam is the query parameter used for cursors if the PageOptions don't set one.
+const DefaultCursorParam = "cursor"
+
+// Paginator iterates over the items in a paginated list, fetching pages as it needs them:
+//
+//	p := conn.Paginate(ctx, "/users", conman.PageOptions{ItemsPath: "items", CursorPath: "next"})
+//	var u User
+//	for p.Next(&u) {
+//		...
+//	}
+//	if err := p.Err(); err != nil { ... }
+type Paginator struct {
+	ctx   context.Context
+	conn  Connection
+	po    PageOptions
+	opts  *sendOptions
+	edit  func(*http.Request)
+	next  string // URL of the next page, empty when there isn't one.
+	items []json.RawMessage
+	i     int
+	count int
+	pages int
+
+	effect *SideEffect
+	resp   *http.Response
+	err    error
+}
+
+// Paginate returns a Paginator for the list starting at cmd.
+func (conn Connection) Paginate(ctx context.Context, cmd string, po PageOptions, opts ...SendOption) *Paginator {
+	return newPaginator(ctx, conn, conn.ServiceURL+cmd, po, conn.sendOptions(opts), nil)
+}
+
+// Paginate returns a Paginator for the list starting with this request, which is sent with GET
+// for each page with the same headers and options.
+func (r *Request) Paginate(ctx context.Context, po PageOptions) *Paginator {
+	target, err := r.URL()
+	p := newPaginator(ctx, r.conn, target, po, r.sendOptions(), r.edit)
+	if err != nil {
+		p.err = err
+	}
+	return p
+}
+
+func newPaginator(ctx context.Context, conn Connection, target string, po PageOptions, opts *sendOptions, edit func(*http.Request)) *Paginator {
+	if po.CursorParam == "" {
+		po.CursorParam = DefaultCursorParam
+	}
+	if po.FirstPage == 0 {
+		po.FirstPage = 1
+	}
+	p := &Paginator{ctx: ctx, conn: conn, po: po, opts: opts, edit: edit, effect: &SideEffect{}}
+	p.next, p.err = p.withLimit(target)
+	return p
+}
+
+// Next decodes the next item into v, fetching another page if it has to.
+// It returns false when there are no more items, or on an error.
+func (p *Paginator) Next(v interface{}) bool {
+	if p.err != nil || (p.po.MaxItems > 0 && p.count >= p.po.MaxItems) {
+		return false
+	}
+	for p.i >= len(p.items) {
+		if p.next == "" || !p.fetch() {
+			return false
+		}
+	}
+
+	item := p.items[p.i]
+	p.i++
+	if err := p.opts.decode.decodeJSON(item, v); err != nil {
+		p.err = fmt.Errorf("couldn't decode item %d: %w", p.count, err)
+		return false
+	}
+	p.count++
+	return true
+}
+
+// Err returns the error that stopped Next, if there was one.
+func (p *Paginator) Err() error {
+	return p.err
+}
+
+// SideEffect covers all the pages fetched so far.
+func (p *Paginator) SideEffect() *SideEffect {
+	return p.effect
+}
+
+// Response is the response for the last page fetched.
+func (p *Paginator) Response() *http.Response {
+	return p.resp
+}
+
+// Pages is the number of pages fetched so far.
+func (p *Paginator) Pages() int {
+	return p.pages
+}
+
+// fetch gets the next page, and works out the URL of the one after.
+func (p *Paginator) fetch() bool {
+	target := p.next
+	var page json.RawMessage
+	effect, resp, err := p.conn.send(p.ctx, http.MethodGet, target, nil, &page, p.edit, p.opts)
+	p.effect.add(effect)
+	p.resp = resp
+	if err != nil {
+		p.err = err
+		return false
+	}
+	if resp != nil && resp.Body != nil {
+		resp.Body.Close()
+	}
+	p.pages++
+
+	p.items, p.i = nil, 0
+	if len(bytes.TrimSpace(page)) > 0 {
+		items, ok := jsonPath(page, p.po.ItemsPath)
+		if !ok {
+			p.err = fmt.Errorf("page %d from %s has no items at %q", p.pages, newRedactor(&p.conn).url(target), p.po.ItemsPath)
+			return false
+		}
+		if err = json.Unmarshal(items, &p.items); err != nil && !isNull(items) {
+			p.err = fmt.Errorf("items at %q in page %d aren't a list: %w", p.po.ItemsPath, p.pages, err)
+			return false
+		}
+	}
+
+	p.next, p.err = p.nextURL(target, resp, page)
+	return p.err == nil
+}
+
+// nextURL works out the URL of the page after the one at target, empty if this was the last page.
+func (p *Paginator) nextURL(target string, resp *http.Response, page json.RawMessage) (string, error) {
+	base, err := url.Parse(target)
+	if err != nil {
+		return "", err
+	}
+
+	if next, ok := parseLinks(resp.Header)["next"]; ok {
+		u, err := base.Parse(next)
+		if err != nil {
+			return "", fmt.Errorf("bad next link %q: %w", next, err)
+		}
+		if u.String() == target {
+			return "", nil
+		}
+		// The next page gets the connection's credentials, so it has to be on the same service.
+		if svc, err := url.Parse(p.conn.ServiceURL); err != nil || !strings.EqualFold(u.Scheme, svc.Scheme) || !strings.EqualFold(u.Host, svc.Host) {
+			return "", fmt.Errorf("next link %s isn't on the connection's service %s",
+				newRedactor(&p.conn).url(u.String()), newRedactor(&p.conn).url(p.conn.ServiceURL))
+		}
+		return u.String(), nil
+	}
+
+	q := base.Query()
+	switch {
+	case p.po.CursorPath != "":
+		raw, ok := jsonPath(page, p.po.CursorPath)
+		if !ok || isNull(raw) {
+			return "", nil
+		}
+		var cursor interface{}
+		if err = json.Unmarshal(raw, &cursor); err != nil {
+			return "", err
+		}
+		c := string(bytes.TrimSpace(raw))
+		if s, isString := cursor.(string); isString {
+			c = s
+		}
+		if c == "" || c == q.Get(p.po.CursorParam) {
+			return "", nil
+		}
+		q.Set(p.po.CursorParam, c)
+
+	case p.po.PageParam != "" || p.po.OffsetParam != "":
+		if len(p.items) == 0 || (p.po.Limit > 0 && len(p.items) < p.po.Limit) {
+			return "", nil
+		}
+		if p.po.PageParam != "" {
+			n, err := intParam(q, p.po.PageParam, p.po.FirstPage)
+			if err != nil {
+				return "", err
+			}
+			q.Set(p.po.PageParam, strconv.Itoa(n+1))
+		} else {
+			n, err := intParam(q, p.po.OffsetParam, 0)
+			if err != nil {
+				return "", err
+			}
+			q.Set(p.po.OffsetParam, strconv.Itoa(n+len(p.items)))
+		}
+
+	default:
+		return "", nil
+	}
+	base.RawQuery = q.Encode()
+	return base.String(), nil
+}
+
+// withLimit adds the page size to the URL.
+func (p *Paginator) withLimit(target string) (string, error) {
+	if p.po.LimitParam == "" || p.po.Limit <= 0 {
+		return target, nil
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	q.Set(p.po.LimitParam, strconv.Itoa(p.po.Limit))
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+func intParam(q url.Values, name string, def int) (int, error) {
+	v := q.Get(name)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("query parameter %s=%q isn't a number", name, v)
+	}
+	return n, nil
+}
+
+// jsonPath finds the value at a dotted path in a JSON document.
+// An empty path is the whole document.
+func jsonPath(doc json.RawMessage, path string) (json.RawMessage, bool) {
+	if path == "" {
+		return doc, true
+	}
+	v := doc
+	for _, seg := range strings.Split(path, ".") {
+		if i, err := strconv.Atoi(seg); err == nil {
+			var a []json.RawMessage
+			if json.Unmarshal(v, &a) != nil || i < 0 || i >= len(a) {
+				return nil, false
+			}
+			v = a[i]
+			continue
+		}
+		var m map[string]json.RawMessage
+		if json.Unmarshal(v, &m) != nil {
+			return nil, false
+		}
+		var ok bool
+		if v, ok = m[seg]; !ok {
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+func isNull(raw json.RawMessage) bool {
+	return string(bytes.TrimSpace(raw)) == "null"
+}
+
+// parseLinks parses RFC 5988 Link headers into a map of rel to URL.
+func parseLinks(h http.Header) map[string]string {
+	links := make(map[string]string)
+	for _, v := range h.Values("Link") {
+		for len(v) > 0 {
+			start := strings.Index(v, "<")
+			end := strings.Index(v, ">")
+			if start < 0 || end < start {
+				break
+			}
+			target := strings.TrimSpace(v[start+1 : end])
+			v = v[end+1:]
+
+			params := v
+			if next := strings.Index(v, "<"); next >= 0 {
+				params, v = v[:next], v[next:]
+			} else {
+				v = ""
+			}
+			for _, param := range strings.Split(params, ";") {
+				kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+				if len(kv) != 2 || !strings.EqualFold(strings.TrimSpace(kv[0]), "rel") {
+					continue
+				}
+				for _, rel := range strings.Fields(strings.Trim(strings.TrimRight(strings.TrimSpace(kv[1]), ","), `"`)) {
+					rel = strings.ToLower(rel)
+					if _, ok := links[rel]; !ok {
+						links[rel] = target
+					}
+				}
+			}
+		}
+	}
+	return links
+}
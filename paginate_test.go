@@ -0,0 +1,186 @@
+package conman
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestPaginate(t *testing.T) {
+	const total = 25
+	var requests []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.URL.RequestURI())
+		q := r.URL.Query()
+		limit := 10
+		if l := q.Get("per_page"); l != "" {
+			limit, _ = strconv.Atoi(l)
+		}
+		from := 0
+		switch r.URL.Path {
+		case "/link", "/cursor":
+			from, _ = strconv.Atoi(q.Get("cursor"))
+		case "/page":
+			if p := q.Get("page"); p != "" {
+				n, _ := strconv.Atoi(p)
+				from = (n - 1) * limit
+			}
+		case "/offset":
+			from, _ = strconv.Atoi(q.Get("offset"))
+		}
+		to := from + limit
+		if to > total {
+			to = total
+		}
+		var items []int
+		for i := from; i < to; i++ {
+			items = append(items, i)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/link":
+			if to < total {
+				w.Header().Add("Link", fmt.Sprintf(`</link?cursor=%d>; rel="next", </link>; rel="first"`, to))
+			}
+			fmt.Fprintf(w, "%s", mustJSON(items))
+		case "/cursor":
+			next := "null"
+			if to < total {
+				next = strconv.Quote(strconv.Itoa(to))
+			}
+			fmt.Fprintf(w, `{"data": {"items": %s}, "meta": {"next": %s}}`, mustJSON(items), next)
+		default:
+			fmt.Fprintf(w, `{"items": %s}`, mustJSON(items))
+		}
+	}))
+	defer ts.Close()
+
+	conn := Connection{ServiceURL: ts.URL}
+	ctx := context.Background()
+
+	cases := []struct {
+		name     string
+		cmd      string
+		po       PageOptions
+		expects  int
+		pages    int
+		requests []string
+	}{
+		{name: "Link", cmd: "/link", expects: total, pages: 3},
+		{name: "Cursor", cmd: "/cursor", po: PageOptions{ItemsPath: "data.items", CursorPath: "meta.next"}, expects: total, pages: 3},
+		{name: "Page", cmd: "/page", po: PageOptions{ItemsPath: "items", PageParam: "page", LimitParam: "per_page", Limit: 10}, expects: total, pages: 3,
+			requests: []string{"/page?per_page=10", "/page?page=2&per_page=10", "/page?page=3&per_page=10"}},
+		{name: "Offset", cmd: "/offset", po: PageOptions{ItemsPath: "items", OffsetParam: "offset"}, expects: total, pages: 4},
+		{name: "Max items", cmd: "/link", po: PageOptions{MaxItems: 12}, expects: 12, pages: 2},
+		{name: "One page", cmd: "/offset", po: PageOptions{ItemsPath: "items"}, expects: 10, pages: 1},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			requests = nil
+			p := conn.Paginate(ctx, tc.cmd, tc.po)
+			var got []int
+			var item int
+			for p.Next(&item) {
+				got = append(got, item)
+			}
+			if err := p.Err(); err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+			if len(got) != tc.expects {
+				t.Errorf("Expected %d items, got %d: %v", tc.expects, len(got), got)
+			}
+			for i, v := range got {
+				if v != i {
+					t.Errorf("Expected item %d to be %d, got %d", i, i, v)
+					break
+				}
+			}
+			if p.Pages() != tc.pages || p.SideEffect().Attempts != tc.pages {
+				t.Errorf("Expected %d pages, got %d (%d attempts)", tc.pages, p.Pages(), p.SideEffect().Attempts)
+			}
+			if tc.requests != nil && fmt.Sprint(requests) != fmt.Sprint(tc.requests) {
+				t.Errorf("Expected requests %v, got %v", tc.requests, requests)
+			}
+		})
+	}
+
+	t.Run("Builder", func(t *testing.T) {
+		p := conn.Request(http.MethodGet).Path("cursor").Query("per_page", "5").
+			Paginate(ctx, PageOptions{ItemsPath: "data.items", CursorPath: "meta.next"})
+		n := 0
+		var item int
+		for p.Next(&item) {
+			n++
+		}
+		if p.Err() != nil || n != total || p.Pages() != 5 {
+			t.Errorf("Got %d items in %d pages, error: %v", n, p.Pages(), p.Err())
+		}
+	})
+
+	t.Run("Errors", func(t *testing.T) {
+		p := conn.Paginate(ctx, "/cursor", PageOptions{ItemsPath: "missing"})
+		var item int
+		if p.Next(&item) || p.Err() == nil {
+			t.Errorf("Expected an error for a missing items path.")
+		}
+		p = conn.Paginate(ctx, "/nothing-here", PageOptions{ItemsPath: "items"})
+		var s struct{}
+		if p.Next(&s) || p.Err() == nil {
+			t.Errorf("Expected an error decoding an item.")
+		}
+	})
+}
+
+func TestParseLinks(t *testing.T) {
+	h := http.Header{}
+	h.Add("Link", `<https://api.example.com/items?page=2>; rel="next", <https://api.example.com/items?page=5>; rel="last"`)
+	h.Add("Link", `</items?page=1>; title="a, b"; rel="prev first"`)
+	links := parseLinks(h)
+	expects := map[string]string{
+		"next":  "https://api.example.com/items?page=2",
+		"last":  "https://api.example.com/items?page=5",
+		"prev":  "/items?page=1",
+		"first": "/items?page=1",
+	}
+	if fmt.Sprint(links) != fmt.Sprint(expects) {
+		t.Errorf("Expected %v, got %v", expects, links)
+	}
+}
+
+func mustJSON(v interface{}) string {
+	b, _ := json.Marshal(v)
+	if string(b) == "null" {
+		return "[]"
+	}
+	return string(b)
+}
+
+// A next link to another host isn't followed, it would get the connection's token.
+func TestPaginateOtherHost(t *testing.T) {
+	stolen := ""
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stolen = r.Header.Get("Authorization")
+		fmt.Fprint(w, "[]")
+	}))
+	defer other.Close()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Link", fmt.Sprintf(`<%s/items?page=2>; rel="next"`, other.URL))
+		fmt.Fprint(w, "[1, 2]")
+	}))
+	defer ts.Close()
+
+	conn := Connection{ServiceURL: ts.URL, AuthToken: "secret"}
+	p := conn.Paginate(context.Background(), "/items", PageOptions{})
+	var item int
+	for p.Next(&item) {
+	}
+	if p.Err() == nil || stolen != "" {
+		t.Errorf("Expected an error for the next link, got %v, and the other host got %q", p.Err(), stolen)
+	}
+}
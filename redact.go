@@ -0,0 +1,274 @@
+package conman
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/spf13/viper"
+)
+
+//
+// Redaction of secrets from debug and verbose output.
+//
+// Header values, JSON body fields, form values and query parameters with sensitive names
+// are masked in request and response dumps, pretty printed bodies, and Describe and List.
+// The lists below can be added to through the configuration (see config.go), and the connection's
+// own authHeader and authParam are always included.
+// Set showSecrets to turn all of this off.
+//
+
+// SensitiveHeaders are the header names whose values are redacted (case insensitive).
+var SensitiveHeaders = []string{
+	"Authorization",
+	"Proxy-Authorization",
+	"Cookie",
+	"Set-Cookie",
+	"X-Auth-Token",
+	"X-Api-Key",
+}
+
+// SensitiveFields are the JSON field, form field and query parameter
+// names whose values are redacted (case insensitive).
+var SensitiveFields = []string{
+	"password",
+	"secret",
+	"token",
+	"access_token",
+	"refresh_token",
+	"id_token",
+	"client_secret",
+	"authToken",
+	"apiKey",
+	"api_key",
+}
+
+// Values this short are masked entirely, longer ones keep
+// a few characters at each end so you can tell tokens apart.
+const (
+	maskShowChars = 4
+	maskMinLength = 12
+	maskFull      = "****"
+	maskElided    = "…"
+)
+
+// mask hides a secret, e.g. abcd…wxyz.
+// An auth scheme prefix (Bearer, Basic, token) is kept.
+func mask(s string) string {
+	if i := strings.Index(s, " "); i > 0 {
+		switch strings.ToLower(s[:i]) {
+		case "bearer", "basic", "token", "digest":
+			return s[:i+1] + mask(s[i+1:])
+		}
+	}
+	if len(s) < maskMinLength {
+		if s == "" {
+			return s
+		}
+		return maskFull
+	}
+	return s[:maskShowChars] + maskElided + s[len(s)-maskShowChars:]
+}
+
+// redactor knows which names are sensitive for a connection.
+// A nil *redactor doesn't redact anything.
+type redactor struct {
+	headers map[string]bool
+	fields  map[string]bool
+
+	// The regexp for JSON fields is only compiled if a body is redacted.
+	jsonOnce    sync.Once
+	jsonPattern string
+	jsonRE      *regexp.Regexp
+}
+
+// Every request needs a redactor, so they're kept by the names they redact
+// rather than built each time.
+var (
+	redactorsMu sync.Mutex
+	redactors   = make(map[string]*redactor)
+)
+
+// newRedactor returns the redactor for the connection, nil if showSecrets is set.
+// conn may be nil for output that isn't about a particular connection.
+func newRedactor(conn *Connection) *redactor {
+	if viper.GetBool(ShowSecretsKey) {
+		return nil
+	}
+
+	headers := append(append([]string{}, SensitiveHeaders...),
+		viper.GetStringSlice(fmt.Sprintf("%s.%s", RedactKey, RedactHeadersKey))...)
+	fields := append(append([]string{}, SensitiveFields...),
+		viper.GetStringSlice(fmt.Sprintf("%s.%s", RedactKey, RedactFieldsKey))...)
+	if conn != nil {
+		if conn.AuthHeader != "" {
+			headers = append(headers, conn.AuthHeader)
+		}
+		if conn.AuthParam != "" {
+			fields = append(fields, conn.AuthParam)
+		}
+	}
+	headers = append(headers, DefaultAuthHeader)
+	fields = append(fields, DefaultAuthParam)
+
+	key := strings.Join(headers, "\x00") + "\x01" + strings.Join(fields, "\x00")
+	redactorsMu.Lock()
+	defer redactorsMu.Unlock()
+	if r, ok := redactors[key]; ok {
+		return r
+	}
+	r := &redactor{
+		headers: make(map[string]bool),
+		fields:  make(map[string]bool),
+	}
+	for _, h := range headers {
+		r.headers[http.CanonicalHeaderKey(h)] = true
+	}
+	var quoted []string
+	for _, f := range fields {
+		r.fields[strings.ToLower(f)] = true
+		quoted = append(quoted, regexp.QuoteMeta(f))
+	}
+	r.jsonPattern = `(?i)("(?:` + strings.Join(quoted, "|") + `)"\s*:\s*")((?:[^"\\]|\\.)*)"`
+	redactors[key] = r
+	return r
+}
+
+// secret masks a value that's always sensitive, like an AuthToken.
+func (r *redactor) secret(value string) string {
+	if r != nil {
+		return mask(value)
+	}
+	return value
+}
+
+func (r *redactor) header(name, value string) string {
+	if r != nil && r.headers[http.CanonicalHeaderKey(name)] {
+		return mask(value)
+	}
+	return value
+}
+
+func (r *redactor) field(name, value string) string {
+	if r != nil && r.fields[strings.ToLower(name)] {
+		return mask(value)
+	}
+	return value
+}
+
+// url masks a password in the user info and any sensitive query parameters.
+func (r *redactor) url(s string) string {
+	if r == nil {
+		return s
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return s
+	}
+	changed := false
+	if u.User != nil {
+		if p, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), mask(p))
+			changed = true
+		}
+	}
+	if u.RawQuery != "" {
+		if q, qerr := url.ParseQuery(u.RawQuery); qerr == nil {
+			if r.values(q) {
+				u.RawQuery = q.Encode()
+				changed = true
+			}
+		}
+	}
+	if !changed {
+		return s
+	}
+	return u.String()
+}
+
+// values masks sensitive values in place, returns true if it changed any.
+func (r *redactor) values(q url.Values) (changed bool) {
+	for k, vs := range q {
+		for i, v := range vs {
+			if nv := r.field(k, v); nv != v {
+				vs[i] = nv
+				changed = true
+			}
+		}
+	}
+	return changed
+}
+
+// json masks sensitive string fields in a JSON document, leaving the formatting alone.
+func (r *redactor) json(b []byte) []byte {
+	if r == nil {
+		return b
+	}
+	r.jsonOnce.Do(func() { r.jsonRE = regexp.MustCompile(r.jsonPattern) })
+	return r.jsonRE.ReplaceAllFunc(b, func(m []byte) []byte {
+		sub := r.jsonRE.FindSubmatch(m)
+		return append(append(append([]byte{}, sub[1]...), mask(string(sub[2]))...), '"')
+	})
+}
+
+// body masks a request or response body based on its content type.
+func (r *redactor) body(contentType string, b []byte) []byte {
+	if r == nil || len(b) == 0 {
+		return b
+	}
+	mt, _, _ := mime.ParseMediaType(contentType)
+	switch {
+	case mt == "application/x-www-form-urlencoded":
+		if q, err := url.ParseQuery(string(b)); err == nil && r.values(q) {
+			return []byte(q.Encode())
+		}
+		return b
+	default:
+		// Try JSON on anything, it only changes things that look like JSON fields.
+		return r.json(b)
+	}
+}
+
+// dump redacts the output of httputil.DumpRequestOut or httputil.DumpResponse.
+func (r *redactor) dump(d []byte) []byte {
+	if r == nil {
+		return d
+	}
+
+	head, body := d, []byte(nil)
+	if i := bytes.Index(d, []byte("\r\n\r\n")); i >= 0 {
+		head, body = d[:i], d[i+4:]
+	}
+
+	var out bytes.Buffer
+	contentType := ""
+	for i, line := range strings.Split(string(head), "\r\n") {
+		if i == 0 {
+			// Request line: METHOD URI PROTO, redact the URI.
+			// (Response status lines are left alone).
+			if parts := strings.SplitN(line, " ", 3); len(parts) == 3 && !strings.HasPrefix(parts[0], "HTTP/") {
+				line = parts[0] + " " + r.url(parts[1]) + " " + parts[2]
+			}
+		} else if c := strings.Index(line, ":"); c > 0 {
+			name, value := line[:c], strings.TrimSpace(line[c+1:])
+			if strings.EqualFold(name, "Content-Type") {
+				contentType = value
+			}
+			line = name + ": " + r.header(name, value)
+		}
+		if i > 0 {
+			out.WriteString("\r\n")
+		}
+		out.WriteString(line)
+	}
+	if body != nil {
+		out.WriteString("\r\n\r\n")
+		out.Write(r.body(contentType, body))
+	}
+	return out.Bytes()
+}
@@ -0,0 +1,176 @@
+package conman
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// secretRef is a config value with references, and what it resolved to.
+type secretRef struct {
+	raw   string
+	value string
+}
+
+// resolveRefs replaces the references in the connection's values with what they refer to.
+// The values as they were are kept, so that they're what's written back to the configuration.
+func (conn *Connection) resolveRefs() error {
+	conn.refs = make(map[string]secretRef)
+	resolve := func(key string, v *string) error {
+		if isEncrypted(*v) {
+			s, err := decryptValue(*v)
+			if err != nil {
+				return fmt.Errorf("connection %q couldn't decrypt %s: %w", conn.Name, key, err)
+			}
+			conn.refs[key] = secretRef{raw: *v, value: s}
+			*v = s
+			return nil
+		}
+		s, err := expandRefs(*v)
+		if err != nil {
+			return fmt.Errorf("connection %q has an unresolved reference in %s: %w", conn.Name, key, err)
+		}
+		if s != *v {
+			conn.refs[key] = secretRef{raw: *v, value: s}
+			*v = s
+		}
+		return nil
+	}
+
+	for _, f := range conn.refFields() {
+		if err := resolve(f.key, f.value); err != nil {
+			return err
+		}
+	}
+	for name, v := range conn.Headers {
+		if err := resolve(HeadersKey+"."+name, &v); err != nil {
+			return err
+		}
+		conn.Headers[name] = v
+	}
+	return nil
+}
+
+// refField is a value, other than a header, that can have references in it.
+type refField struct {
+	key   string
+	value *string
+}
+
+// refFields are the connection's values, other than headers, that can have references.
+func (conn *Connection) refFields() []refField {
+	return []refField{
+		{ServiceURLKey, &conn.ServiceURL},
+		{AuthTokenKey, &conn.AuthToken},
+		{OAuth2Key + "." + ClientIDKey, &conn.OAuth2.ClientID},
+		{OAuth2Key + "." + ClientSecretKey, &conn.OAuth2.ClientSecret},
+		{OAuth2Key + "." + RefreshTokenKey, &conn.OAuth2.RefreshToken},
+		{SigningKey + "." + SigningSecretKey, &conn.Signing.Secret},
+		{SigningKey + "." + SessionTokenKey, &conn.Signing.SessionToken},
+	}
+}
+
+// refValue is the connection's current value for a key refFields or the headers have.
+func (conn *Connection) refValue(key string) (string, bool) {
+	for _, f := range conn.refFields() {
+		if f.key == key {
+			return *f.value, true
+		}
+	}
+	if strings.HasPrefix(key, HeadersKey+".") {
+		v, ok := conn.Headers[strings.TrimPrefix(key, HeadersKey+".")]
+		return v, ok
+	}
+	return "", false
+}
+
+// restoreRefs puts the references back in a config map the connection has been merged into,
+// for the values that haven't changed since they were resolved.
+func (conn *Connection) restoreRefs(m map[string]interface{}) {
+	for key, ref := range conn.refs {
+		path := strings.SplitN(key, ".", 2)
+		sub := m
+		if len(path) == 2 {
+			_, v := findKey(m, path[0])
+			if sub, _ = v.(map[string]interface{}); sub == nil {
+				continue
+			}
+		}
+		k, v := findKey(sub, path[len(path)-1])
+		if s, ok := v.(string); ok && s == ref.value {
+			sub[k] = ref.raw
+		}
+	}
+}
+
+// expandRefs resolves the references in s.
+func expandRefs(s string) (string, error) {
+	if !strings.Contains(s, "$") {
+		return s, nil
+	}
+	var b strings.Builder
+	for {
+		i := strings.Index(s, "$")
+		if i < 0 || i == len(s)-1 {
+			b.WriteString(s)
+			return b.String(), nil
+		}
+		b.WriteString(s[:i])
+		switch s[i+1] {
+		case '$':
+			b.WriteByte('$')
+			s = s[i+2:]
+		case '{':
+			end := strings.Index(s[i:], "}")
+			if end < 0 {
+				return "", fmt.Errorf("%q has no closing }", s[i:])
+			}
+			v, err := resolveRef(s[i+2 : i+end])
+			if err != nil {
+				return "", fmt.Errorf("%s: %w", s[i:i+end+1], err)
+			}
+			b.WriteString(v)
+			s = s[i+end+1:]
+		default:
+			b.WriteByte('$')
+			s = s[i+1:]
+		}
+	}
+}
+
+// resolveRef resolves the inside of a ${...} reference.
+func resolveRef(ref string) (string, error) {
+	switch {
+	case strings.HasPrefix(ref, "env:"):
+		return lookupEnv(strings.TrimPrefix(ref, "env:"))
+	case strings.HasPrefix(ref, "file:"):
+		path := strings.TrimPrefix(ref, "file:")
+		if path == "" {
+			return "", fmt.Errorf("no file name")
+		}
+		b, err := ioutil.ReadFile(expandPath(path))
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(b), "\r\n"), nil
+	}
+	if i := strings.Index(ref, ":-"); i >= 0 {
+		if v := os.Getenv(ref[:i]); v != "" {
+			return v, nil
+		}
+		return ref[i+2:], nil
+	}
+	return lookupEnv(ref)
+}
+
+func lookupEnv(name string) (string, error) {
+	if name == "" || strings.ContainsAny(name, "=: ") {
+		return "", fmt.Errorf("bad environment variable name %q", name)
+	}
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return "", fmt.Errorf("environment variable %s isn't set", name)
+	}
+	return v, nil
+}
@@ -0,0 +1,147 @@
+package conman
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestExpandRefs(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("HOME", dir)
+	t.Setenv("CONMAN_TOKEN", "env-token")
+	t.Setenv("CONMAN_EMPTY", "")
+	if err := ioutil.WriteFile(filepath.Join(dir, "token"), []byte("file-token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		in     string
+		expect string
+		err    string
+	}{
+		{in: "plain", expect: "plain"},
+		{in: "${env:CONMAN_TOKEN}", expect: "env-token"},
+		{in: "Bearer ${CONMAN_TOKEN}!", expect: "Bearer env-token!"},
+		{in: "${file:~/token}", expect: "file-token"},
+		{in: "${file:" + filepath.Join(dir, "token") + "}", expect: "file-token"},
+		{in: "http://${CONMAN_HOST:-localhost}:${CONMAN_EMPTY:-8080}", expect: "http://localhost:8080"},
+		{in: "${CONMAN_TOKEN:-default}", expect: "env-token"},
+		{in: "pa$$word", expect: "pa$word"},
+		{in: "$${env:CONMAN_TOKEN}", expect: "${env:CONMAN_TOKEN}"},
+		{in: "cost $5 $", expect: "cost $5 $"},
+		{in: "${env:CONMAN_MISSING}", err: "${env:CONMAN_MISSING}: environment variable CONMAN_MISSING isn't set"},
+		{in: "${CONMAN_MISSING}", err: "isn't set"},
+		{in: "${file:~/missing}", err: "no such file"},
+		{in: "${env:CONMAN_TOKEN", err: "no closing }"},
+		{in: "${}", err: "bad environment variable name"},
+		{in: "${vault:secret/token}", err: "bad environment variable name"},
+	}
+	for _, c := range cases {
+		got, err := expandRefs(c.in)
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("%q: expected error %q, got %q, %v", c.in, c.err, got, err)
+			}
+			continue
+		}
+		if err != nil || got != c.expect {
+			t.Errorf("%q: got %q, error %v, expected %q", c.in, got, err, c.expect)
+		}
+	}
+}
+
+func TestLoadConnectionRefs(t *testing.T) {
+	defer resetConfig()
+	dir := t.TempDir()
+	secret := filepath.Join(dir, "secret")
+	if err := ioutil.WriteFile(secret, []byte("header-secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CONMAN_TOKEN", "env-token")
+
+	fn := filepath.Join(dir, "config.yaml")
+	config := fmt.Sprintf(`connections:
+  refs:
+    serviceURL: http://${CONMAN_HOST:-localhost}:8080
+    authToken: ${env:CONMAN_TOKEN}
+    headers:
+      X-Secret: ${file:%s}
+      X-Plain: pa$$word
+    oauth2:
+      tokenURL: https://auth.example.com/token
+      clientID: client
+      clientSecret: ${env:CONMAN_TOKEN}
+  broken:
+    serviceURL: http://localhost
+    authToken: ${env:CONMAN_MISSING}
+`, secret)
+	if err := ioutil.WriteFile(fn, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	viper.SetConfigFile(fn)
+	if err := viper.ReadInConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := LoadConnection("refs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn.ServiceURL != "http://localhost:8080" || conn.AuthToken != "env-token" || conn.OAuth2.ClientSecret != "env-token" ||
+		conn.Headers["x-secret"] != "header-secret" || conn.Headers["x-plain"] != "pa$word" {
+		t.Errorf("Got %#v", conn)
+	}
+
+	_, err = LoadConnection("broken")
+	if err == nil || !strings.Contains(err.Error(), `connection "broken" has an unresolved reference in authToken: ${env:CONMAN_MISSING}`) {
+		t.Errorf("Expected an unresolved reference error, got %v", err)
+	}
+	if _, ok := GetConnection("broken"); ok {
+		t.Errorf("Expected GetConnection to fail")
+	}
+	if cl := GetAllConnections(); len(cl) != 1 || cl[0].Name != "refs" {
+		t.Errorf("Expected only the connection that loads, got %v", cl)
+	}
+	if cl, err := LoadAllConnections(); len(cl) != 1 || err == nil || !strings.Contains(err.Error(), `connection "broken"`) {
+		t.Errorf("Expected the connection that loads and an error for the other, got %v, %v", cl, err)
+	}
+	if err = RemoveConnection("broken"); err != nil {
+		t.Errorf("Expected to be able to remove a connection that doesn't load: %v", err)
+	}
+
+	// The references are written back, but not a value that's changed.
+	conn.AuthToken = "new-token"
+	conn.Timeout = 0
+	if err = UpdateConnection(conn); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"serviceURL: http://${CONMAN_HOST:-localhost}:8080",
+		"authToken: new-token",
+		"x-secret: ${file:" + secret + "}",
+		"x-plain: pa$$word",
+		"clientSecret: ${env:CONMAN_TOKEN}",
+	} {
+		if !strings.Contains(string(b), want) {
+			t.Errorf("Expected %q in the config file:\n%s", want, b)
+		}
+	}
+	if strings.Contains(string(b), "env-token") || strings.Contains(string(b), "header-secret") {
+		t.Errorf("Secrets written to the config file:\n%s", b)
+	}
+
+	os.Unsetenv("CONMAN_TOKEN")
+	if _, err = LoadConnection("refs"); err == nil {
+		t.Errorf("Expected an error once CONMAN_TOKEN is gone")
+	}
+}
@@ -0,0 +1,164 @@
+package conman
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Request builds up a request on a connection, and sends it with Do.
+// Unlike Send, the URL is put together properly: path segments are escaped and
+// joined to the ServiceURL with exactly one slash, and query values are encoded.
+//
+//	var users []User
+//	_, _, err := conn.Request(http.MethodGet).
+//		Path("hub", "api", "users", name).
+//		Query("state", "active").
+//		Result(&users).
+//		Do(ctx)
+//
+// The methods change the request in place and return it, so they can be chained.
+type Request struct {
+	conn     Connection
+	method   string
+	segments []string
+	query    url.Values
+	header   http.Header
+	remove   []string
+	content  interface{}
+	result   interface{}
+	opts     []SendOption
+	expect   []int
+}
+
+// Request starts a request on the connection using method (e.g. http.MethodPut).
+func (conn Connection) Request(method string) *Request {
+	return &Request{
+		conn:   conn,
+		method: method,
+		query:  make(url.Values),
+		header: make(http.Header),
+	}
+}
+
+// Path adds segments to the path after the ServiceURL.
+// Each one is escaped, so a segment containing a / stays a single segment.
+func (r *Request) Path(segments ...string) *Request {
+	r.segments = append(r.segments, segments...)
+	return r
+}
+
+// Query adds values for the query parameter key.
+func (r *Request) Query(key string, values ...string) *Request {
+	for _, v := range values {
+		r.query.Add(key, v)
+	}
+	return r
+}
+
+// QueryValues adds all of q to the query parameters.
+func (r *Request) QueryValues(q url.Values) *Request {
+	for k, vs := range q {
+		r.Query(k, vs...)
+	}
+	return r
+}
+
+// Header sets a header for this request, replacing any the connection would send.
+func (r *Request) Header(key, value string) *Request {
+	r.header.Set(key, value)
+	return r
+}
+
+// RemoveHeader stops a header, including one from the connection's Headers or auth, being sent.
+func (r *Request) RemoveHeader(key string) *Request {
+	r.remove = append(r.remove, key)
+	return r
+}
+
+// Body sets the content of the request, encoded as it is by Send.
+func (r *Request) Body(content interface{}) *Request {
+	r.content = content
+	return r
+}
+
+// Result sets the object the response body is decoded into.
+func (r *Request) Result(result interface{}) *Request {
+	r.result = result
+	return r
+}
+
+// Expect sets the response status codes that aren't an error.
+// Any other status, even a 2xx, returns an *HTTPError.
+// Without Expect any status under 300 is fine.
+func (r *Request) Expect(codes ...int) *Request {
+	r.expect = append(r.expect, codes...)
+	return r
+}
+
+// Options adds SendOptions, e.g. WithDecodeOptions, for the request.
+func (r *Request) Options(opts ...SendOption) *Request {
+	r.opts = append(r.opts, opts...)
+	return r
+}
+
+// URL returns the URL the request will be sent to.
+func (r *Request) URL() (string, error) {
+	u, err := url.Parse(r.conn.ServiceURL)
+	if err != nil {
+		return "", fmt.Errorf("bad service URL for connection %q: %w", r.conn.Name, err)
+	}
+
+	if len(r.segments) > 0 {
+		escaped := make([]string, len(r.segments))
+		for i, s := range r.segments {
+			escaped[i] = url.PathEscape(s)
+		}
+		u.RawPath = strings.TrimRight(u.EscapedPath(), "/") + "/" + strings.Join(escaped, "/")
+		if u.Path, err = url.PathUnescape(u.RawPath); err != nil {
+			return "", err
+		}
+	}
+
+	if len(r.query) > 0 {
+		q := u.Query()
+		for k, vs := range r.query {
+			for _, v := range vs {
+				q.Add(k, v)
+			}
+		}
+		u.RawQuery = q.Encode()
+	}
+	return u.String(), nil
+}
+
+// Do sends the request, and decodes the response into the Result if there is one.
+// It behaves like SendContext otherwise.
+func (r *Request) Do(ctx context.Context) (effect *SideEffect, resp *http.Response, err error) {
+	target, err := r.URL()
+	if err != nil {
+		return effect, resp, err
+	}
+	return r.conn.send(ctx, r.method, target, r.content, r.result, r.edit, r.sendOptions())
+}
+
+func (r *Request) sendOptions() *sendOptions {
+	opts := r.conn.sendOptions(r.opts)
+	opts.expect = r.expect
+	if ct := r.header.Get("Content-Type"); ct != "" {
+		opts.contentType = ct
+	}
+	return opts
+}
+
+// edit applies the request's headers.
+func (r *Request) edit(req *http.Request) {
+	for k, vs := range r.header {
+		req.Header[k] = vs
+	}
+	for _, k := range r.remove {
+		req.Header.Del(k)
+	}
+}
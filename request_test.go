@@ -0,0 +1,137 @@
+package conman
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequestURL(t *testing.T) {
+	cases := []struct {
+		name       string
+		serviceURL string
+		build      func(r *Request) *Request
+		expects    string
+	}{
+		{
+			name:       "Joins with one slash",
+			serviceURL: "http://example.com/hub/",
+			build:      func(r *Request) *Request { return r.Path("api", "users") },
+			expects:    "http://example.com/hub/api/users",
+		},
+		{
+			name:       "No trailing slash on the service URL",
+			serviceURL: "http://example.com/hub",
+			build:      func(r *Request) *Request { return r.Path("api").Path("users") },
+			expects:    "http://example.com/hub/api/users",
+		},
+		{
+			name:       "Segments are escaped",
+			serviceURL: "http://example.com",
+			build:      func(r *Request) *Request { return r.Path("users", "a/b c?") },
+			expects:    "http://example.com/users/a%2Fb%20c%3F",
+		},
+		{
+			name:       "Query values are encoded and merged",
+			serviceURL: "http://example.com/api?v=2",
+			build:      func(r *Request) *Request { return r.Query("q", "a&b", "c").Query("limit", "10") },
+			expects:    "http://example.com/api?limit=10&q=a%26b&q=c&v=2",
+		},
+		{
+			name:       "Nothing added",
+			serviceURL: "http://example.com/api/",
+			build:      func(r *Request) *Request { return r },
+			expects:    "http://example.com/api/",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			conn := Connection{ServiceURL: tc.serviceURL}
+			got, err := tc.build(conn.Request(http.MethodGet)).URL()
+			if err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+			if got != tc.expects {
+				t.Errorf("Expected %q, got %q", tc.expects, got)
+			}
+		})
+	}
+}
+
+func TestRequestDo(t *testing.T) {
+	var got *http.Request
+	var gotBody string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		b := make([]byte, 64)
+		n, _ := r.Body.Read(b)
+		gotBody = string(b[:n])
+		switch r.URL.Path {
+		case "/missing":
+			w.WriteHeader(http.StatusNotFound)
+		case "/created":
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprintln(w, `{"name": "created"}`)
+		default:
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintln(w, `{"name": "ok"}`)
+		}
+	}))
+	defer ts.Close()
+
+	conn := Connection{
+		ServiceURL: ts.URL,
+		AuthToken:  "abc",
+		Headers:    map[string]string{"X-Keep": "conn", "X-Drop": "conn"},
+	}
+	ctx := context.Background()
+
+	var result struct{ Name string }
+	_, _, err := conn.Request(http.MethodPut).
+		Path("created").
+		Header("X-Keep", "request").
+		RemoveHeader("X-Drop").
+		Body(map[string]string{"a": "b"}).
+		Result(&result).
+		Expect(http.StatusCreated).
+		Do(ctx)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if got.Method != http.MethodPut || result.Name != "created" || gotBody != `{"a":"b"}` {
+		t.Errorf("Got method %s, result %#v, body %q", got.Method, result, gotBody)
+	}
+	if h := got.Header.Get("X-Keep"); h != "request" {
+		t.Errorf("Expected request header to win, got %q", h)
+	}
+	if _, ok := got.Header["X-Drop"]; ok {
+		t.Errorf("Expected X-Drop to be removed.")
+	}
+	if got.Header.Get("Content-Type") != "application/json" || got.Header.Get("Authorization") != "Bearer abc" {
+		t.Errorf("Unexpected headers: %v", got.Header)
+	}
+
+	// A 200 isn't expected.
+	_, _, err = conn.Request(http.MethodGet).Path("ok").Expect(http.StatusCreated).Do(ctx)
+	var herr *HTTPError
+	if !errors.As(err, &herr) || herr.StatusCode != http.StatusOK {
+		t.Errorf("Expected an HTTPError for an unexpected 200, got: %v", err)
+	}
+
+	// A 404 is.
+	if _, resp, err := conn.Request(http.MethodDelete).Path("missing").Expect(http.StatusNoContent, http.StatusNotFound).Do(ctx); err != nil || resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected a 404 without an error, got: %v", err)
+	}
+
+	if _, resp, err := conn.Head("/ok"); err != nil || got.Method != http.MethodHead || resp.StatusCode != http.StatusOK {
+		t.Errorf("HEAD failed: %v", err)
+	}
+	if _, _, err := conn.Options("/ok", &result); err != nil || got.Method != http.MethodOptions {
+		t.Errorf("OPTIONS failed: %v", err)
+	}
+}
@@ -0,0 +1,249 @@
+package conman
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// RetryPolicy says when, and how often, a connection retries a request.
+// The zero value doesn't retry.
+//
+// The delay between attempts is exponential backoff with full jitter: a random
+// duration up to BaseDelay * 2^(attempt-1), capped at MaxDelay. If the response has a
+// Retry-After header that's used instead, unless it's longer than MaxDelay, and then
+// the request isn't retried.
+type RetryPolicy struct {
+	MaxAttempts   int           // Total attempts, including the first. Zero or one means no retries.
+	BaseDelay     time.Duration // Defaults to DefaultRetryBaseDelay.
+	MaxDelay      time.Duration // Defaults to DefaultRetryMaxDelay.
+	StatusCodes   []int         // Response codes to retry, defaults to DefaultRetryStatusCodes.
+	NetworkErrors bool          // Retry on errors making the connection or reading the response.
+	AllMethods    bool          // Retry non-idempotent methods (POST, PATCH) too.
+}
+
+// Retry defaults.
+var (
+	DefaultRetryBaseDelay   = 100 * time.Millisecond
+	DefaultRetryMaxDelay    = 10 * time.Second
+	DefaultRetryStatusCodes = []int{
+		http.StatusTooManyRequests,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout,
+	}
+)
+
+// doWithRetry sends the request through the middleware and client, retrying according to the
+// connection's policy. Each attempt is recorded in effect.
+func (conn *Connection) doWithRetry(client *http.Client, req *http.Request, effect *SideEffect) (resp *http.Response, err error) {
+	rp := conn.Retry
+	rt := conn.roundTripper(client)
+	// Retries start from the request as it was, not as middleware left it.
+	orig := req.Clone(req.Context())
+	for attempt := 1; ; attempt++ {
+		start := time.Now()
+		resp, err = rt(conn, req, effect)
+		effect.Attempts = attempt
+		effect.AttemptTimes = append(effect.AttemptTimes, time.Since(start))
+
+		delay, retry := rp.shouldRetry(req, resp, err, attempt)
+		if !retry {
+			return resp, err
+		}
+
+		next, rewindErr := rewindRequest(orig)
+		if rewindErr != nil {
+			// Can't send the body again, so we're done.
+			return resp, err
+		}
+		if resp != nil && resp.Body != nil {
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		if err = sleepContext(req.Context(), delay); err != nil {
+			return nil, err
+		}
+		req = next
+	}
+}
+
+// shouldRetry returns how long to wait before retrying, and whether to retry at all.
+func (rp RetryPolicy) shouldRetry(req *http.Request, resp *http.Response, err error, attempt int) (time.Duration, bool) {
+	if attempt >= rp.MaxAttempts {
+		return 0, false
+	}
+	if !rp.AllMethods && !isIdempotent(req) {
+		return 0, false
+	}
+	if req.Context().Err() != nil {
+		return 0, false
+	}
+
+	if err != nil {
+		if !rp.NetworkErrors || !isRetryableError(err) {
+			return 0, false
+		}
+		return rp.backoff(attempt), true
+	}
+
+	codes := rp.StatusCodes
+	if len(codes) == 0 {
+		codes = DefaultRetryStatusCodes
+	}
+	for _, c := range codes {
+		if resp.StatusCode == c {
+			if d, ok := parseRetryAfter(resp.Header.Get("Retry-After")); ok {
+				// Rather than wait longer than MaxDelay, give up.
+				return d, d <= rp.maxDelay()
+			}
+			return rp.backoff(attempt), true
+		}
+	}
+	return 0, false
+}
+
+func (rp RetryPolicy) maxDelay() time.Duration {
+	if rp.MaxDelay <= 0 {
+		return DefaultRetryMaxDelay
+	}
+	return rp.MaxDelay
+}
+
+func (rp RetryPolicy) backoff(attempt int) time.Duration {
+	base, max := rp.BaseDelay, rp.maxDelay()
+	if base <= 0 {
+		base = DefaultRetryBaseDelay
+	}
+	d := base << uint(attempt-1)
+	if d > max || d <= 0 { // <= 0 on overflow.
+		d = max
+	}
+	return time.Duration(rand.Int63n(int64(d) + 1))
+}
+
+// parseRetryAfter handles both forms of Retry-After: seconds and an HTTP date.
+func parseRetryAfter(v string) (time.Duration, bool) {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		if secs < 0 {
+			secs = 0
+		}
+		return time.Duration(secs) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		d := time.Until(t)
+		if d < 0 {
+			d = 0
+		}
+		return d, true
+	}
+	return 0, false
+}
+
+func isIdempotent(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace,
+		http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// isRetryableError is true for errors that are likely to go away on their own.
+// Cancellation and certificate problems aren't.
+func isRetryableError(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var (
+		unknownAuthority x509.UnknownAuthorityError
+		hostname         x509.HostnameError
+		invalid          x509.CertificateInvalidError
+	)
+	if errors.As(err, &unknownAuthority) || errors.As(err, &hostname) || errors.As(err, &invalid) {
+		return false
+	}
+	var nerr net.Error
+	return errors.As(err, &nerr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// rewindRequest returns a copy of req with a fresh body, so it can be sent again.
+func rewindRequest(req *http.Request) (*http.Request, error) {
+	next := req.Clone(req.Context())
+	if req.Body != nil && req.Body != http.NoBody {
+		if req.GetBody == nil {
+			return nil, fmt.Errorf("can't resend request body")
+		}
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		next.Body = body
+	}
+	return next, nil
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// getRetryPolicy reads the retry settings under the key rk.
+func getRetryPolicy(rk string) RetryPolicy {
+	key := func(k string) string { return fmt.Sprintf("%s.%s", rk, k) }
+	var codes []int
+	for _, s := range viper.GetStringSlice(key(RetryStatusCodesKey)) {
+		if c, err := strconv.Atoi(strings.TrimSpace(s)); err == nil {
+			codes = append(codes, c)
+		}
+	}
+	return RetryPolicy{
+		MaxAttempts:   viper.GetInt(key(MaxAttemptsKey)),
+		BaseDelay:     viper.GetDuration(key(BaseDelayKey)),
+		MaxDelay:      viper.GetDuration(key(MaxDelayKey)),
+		StatusCodes:   codes,
+		NetworkErrors: viper.GetBool(key(NetworkErrorsKey)),
+		AllMethods:    viper.GetBool(key(AllMethodsKey)),
+	}
+}
+
+func (rp RetryPolicy) mergeConfig(m map[string]interface{}) {
+	setKey(m, MaxAttemptsKey, rp.MaxAttempts)
+	setKey(m, BaseDelayKey, durationValue(rp.BaseDelay))
+	setKey(m, MaxDelayKey, durationValue(rp.MaxDelay))
+	codes := make([]interface{}, len(rp.StatusCodes))
+	for i, c := range rp.StatusCodes {
+		codes[i] = c
+	}
+	setKey(m, RetryStatusCodesKey, codes)
+	setKey(m, NetworkErrorsKey, rp.NetworkErrors)
+	setKey(m, AllMethodsKey, rp.AllMethods)
+}
+
+func (rp RetryPolicy) validate() error {
+	if rp.MaxAttempts < 0 || rp.BaseDelay < 0 || rp.MaxDelay < 0 {
+		return fmt.Errorf("retry settings can't be negative")
+	}
+	return nil
+}
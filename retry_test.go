@@ -0,0 +1,121 @@
+package conman
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetry(t *testing.T) {
+
+	var calls int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&calls, 1)
+		switch r.URL.Path {
+		case "/flaky":
+			if n < 3 {
+				w.Header().Set("Retry-After", "0")
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+		case "/down":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case "/missing":
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	policy := RetryPolicy{MaxAttempts: 4, BaseDelay: time.Millisecond, MaxDelay: 5 * time.Millisecond}
+
+	cases := []struct {
+		name     string
+		method   string
+		path     string
+		policy   RetryPolicy
+		attempts int
+		fails    bool
+	}{
+		{"No policy", http.MethodGet, "/flaky", RetryPolicy{}, 1, true},
+		{"Succeeds after retries", http.MethodGet, "/flaky", policy, 3, false},
+		{"Gives up", http.MethodGet, "/down", policy, 4, true},
+		{"Doesn't retry other codes", http.MethodGet, "/missing", policy, 1, true},
+		{"Doesn't retry POST", http.MethodPost, "/flaky", policy, 1, true},
+		{"Retries POST if asked", http.MethodPost, "/flaky",
+			RetryPolicy{MaxAttempts: 4, BaseDelay: time.Millisecond, AllMethods: true}, 3, false},
+		{"Retries PUT with a body", http.MethodPut, "/flaky", policy, 3, false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			atomic.StoreInt32(&calls, 0)
+			conn := Connection{ServiceURL: ts.URL, Retry: c.policy}
+			effect, _, err := conn.Send(c.method, c.path, map[string]string{"a": "b"}, nil)
+			if (err != nil) != c.fails {
+				t.Errorf("Got error: %v, expected error: %t", err, c.fails)
+			}
+			if effect.Attempts != c.attempts || len(effect.AttemptTimes) != c.attempts ||
+				int(atomic.LoadInt32(&calls)) != c.attempts {
+				t.Errorf("Got %d attempts (%d calls), expected %d", effect.Attempts, calls, c.attempts)
+			}
+		})
+	}
+}
+
+func TestRetryNetworkErrors(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	url := ts.URL
+	ts.Close()
+
+	conn := Connection{ServiceURL: url, Retry: RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond}}
+	effect, _, err := conn.Get("/", nil)
+	if err == nil || effect.Attempts != 1 {
+		t.Errorf("Expected one failed attempt, got %d, error: %v", effect.Attempts, err)
+	}
+
+	conn.Retry.NetworkErrors = true
+	effect, _, err = conn.Get("/", nil)
+	if err == nil || effect.Attempts != 3 {
+		t.Errorf("Expected three failed attempts, got %d, error: %v", effect.Attempts, err)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	cases := []struct {
+		value string
+		ok    bool
+		min   time.Duration
+		max   time.Duration
+	}{
+		{"", false, 0, 0},
+		{"junk", false, 0, 0},
+		{"3", true, 3 * time.Second, 3 * time.Second},
+		{time.Now().Add(time.Minute).UTC().Format(http.TimeFormat), true, 58 * time.Second, time.Minute},
+		{time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat), true, 0, 0},
+	}
+	for _, c := range cases {
+		d, ok := parseRetryAfter(c.value)
+		if ok != c.ok || d < c.min || d > c.max {
+			t.Errorf("parseRetryAfter(%q) got %v, %t", c.value, d, ok)
+		}
+	}
+}
+
+func TestRetryAfterTooLong(t *testing.T) {
+	rp := RetryPolicy{MaxAttempts: 3, MaxDelay: time.Second}
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	for _, c := range []struct {
+		after string
+		retry bool
+	}{
+		{"1", true},
+		{"86400", false},
+		{time.Now().Add(time.Hour).UTC().Format(http.TimeFormat), false},
+	} {
+		resp := &http.Response{StatusCode: http.StatusTooManyRequests, Header: http.Header{"Retry-After": {c.after}}}
+		if d, retry := rp.shouldRetry(req, resp, nil, 1); retry != c.retry || (retry && d > time.Second) {
+			t.Errorf("Retry-After %s: got %v, %t", c.after, d, retry)
+		}
+	}
+}
@@ -5,5 +5,21 @@ import "time"
 // Meta information about a request
 // TODO: Consider a better name.
 type SideEffect struct {
-	ElapsedTime time.Duration
+	ElapsedTime   time.Duration   // Total, including any waiting between retries.
+	Attempts      int             // Number of times the request was sent.
+	AttemptTimes  []time.Duration // Time each attempt took.
+	BytesSent     int64           // Size of the request body sent on the last attempt.
+	BytesReceived int64           // Size of a downloaded body.
+}
+
+// add accumulates the effect of another request into e.
+func (e *SideEffect) add(o *SideEffect) {
+	if o == nil {
+		return
+	}
+	e.ElapsedTime += o.ElapsedTime
+	e.Attempts += o.Attempts
+	e.AttemptTimes = append(e.AttemptTimes, o.AttemptTimes...)
+	e.BytesSent += o.BytesSent
+	e.BytesReceived += o.BytesReceived
 }
@@ -0,0 +1,326 @@
+package conman
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+//
+// Request signing
+//
+// A connection with signing configured signs each attempt at a request just before it's
+// sent, after middleware, so the signature covers the headers as they go out.
+// Both schemes sign the same canonical request (the one AWS Signature Version 4 uses):
+//
+//     <METHOD>\n
+//     <canonical path>\n
+//     <canonical query>\n
+//     <canonical headers>\n
+//     <signed headers>\n
+//     <payload hash>
+//
+// canonical path     - the URL path with each segment percent-encoded (RFC 3986: everything but
+//                      A-Z a-z 0-9 - _ . ~ is encoded, with upper case hex), "/" if it's empty.
+// canonical query    - the query parameters, names and values percent-encoded the same way,
+//                      sorted (by byte) by name then value, as name=value joined with &.
+// canonical headers  - a line for each signed header, lower case name:value\n, sorted by name.
+//                      The value has its surrounding space trimmed and runs of spaces made one,
+//                      and repeated headers are joined with commas.
+// signed headers     - the signed header names, lower case and sorted, joined with ;.
+// payload hash       - the hex SHA-256 of the body (of nothing, for no body), or UNSIGNED-PAYLOAD.
+//
+// The signed headers are host, the scheme's timestamp header, the scheme's own headers
+// below, and the headers in the signing headers list that the request has.
+//
+// hmac-sha256
+// Sets X-Date to the time (20060102T150405Z, UTC) and X-Content-Sha256 to the payload hash,
+// both signed, and then
+//     string to sign = HMAC-SHA256\n<X-Date>\n<hex SHA-256 of the canonical request>
+//     Authorization: HMAC-SHA256 KeyId=<keyID>, SignedHeaders=<signed headers>, Signature=<hex HMAC-SHA256 of the string to sign, keyed with secret>
+//
+// aws-sigv4
+// AWS Signature Version 4, with keyID the access key ID and secret the secret access key.
+// Sets X-Amz-Date, and X-Amz-Security-Token if there's a session token, and
+// X-Amz-Content-Sha256 if it's in the headers list (S3 wants it). The path is encoded once,
+// as S3 does, so paths other services would encode twice aren't supported.
+//
+
+// Signing schemes.
+const (
+	SigningSchemeHMAC  = "hmac-sha256"
+	SigningSchemeSigV4 = "aws-sigv4"
+)
+
+// SigningConfig configures request signing, see the Request signing comment above.
+type SigningConfig struct {
+	Scheme          string   // One of the SigningScheme constants, empty for no signing.
+	KeyID           string   // The key ID, or for aws-sigv4 the access key ID.
+	Secret          string   // The signing secret, or for aws-sigv4 the secret access key.
+	Headers         []string // More headers to sign, if the request has them.
+	UnsignedPayload bool     // Don't hash the body, use UNSIGNED-PAYLOAD instead, e.g. for large uploads.
+	Region          string   // aws-sigv4 region, e.g. us-east-1.
+	Service         string   // aws-sigv4 service name, e.g. execute-api.
+	SessionToken    string   // aws-sigv4 session token, for temporary credentials.
+}
+
+const (
+	signingTimeFormat = "20060102T150405Z"
+	unsignedPayload   = "UNSIGNED-PAYLOAD"
+	hmacAlgorithm     = "HMAC-SHA256"
+	sigV4Algorithm    = "AWS4-HMAC-SHA256"
+)
+
+// signingNow is the clock for signatures, so the tests can check them against known values.
+var signingNow = time.Now
+
+func (s SigningConfig) enabled() bool {
+	return s.Scheme != ""
+}
+
+// sign adds the signature, and the headers it needs, to req.
+func (s SigningConfig) sign(req *http.Request) error {
+	payload, err := s.payloadHash(req)
+	if err != nil {
+		return fmt.Errorf("couldn't sign the request: %w", err)
+	}
+	now := signingNow().UTC()
+	stamp := now.Format(signingTimeFormat)
+	signed := []string{"host"}
+
+	switch strings.ToLower(s.Scheme) {
+	case SigningSchemeHMAC:
+		req.Header.Set("X-Date", stamp)
+		req.Header.Set("X-Content-Sha256", payload)
+		signed = append(signed, "x-date", "x-content-sha256")
+		list, canonical := canonicalRequest(req, s.signedHeaders(req, signed), payload)
+		sts := strings.Join([]string{hmacAlgorithm, stamp, hashHex([]byte(canonical))}, "\n")
+		req.Header.Set("Authorization", fmt.Sprintf("%s KeyId=%s, SignedHeaders=%s, Signature=%s",
+			hmacAlgorithm, s.KeyID, list, hex.EncodeToString(hmacSHA256([]byte(s.Secret), sts))))
+
+	case SigningSchemeSigV4:
+		req.Header.Set("X-Amz-Date", stamp)
+		signed = append(signed, "x-amz-date")
+		if s.SessionToken != "" {
+			req.Header.Set("X-Amz-Security-Token", s.SessionToken)
+			signed = append(signed, "x-amz-security-token")
+		}
+		for _, h := range s.Headers {
+			if strings.EqualFold(h, "X-Amz-Content-Sha256") {
+				req.Header.Set("X-Amz-Content-Sha256", payload)
+			}
+		}
+		list, canonical := canonicalRequest(req, s.signedHeaders(req, signed), payload)
+		date := now.Format("20060102")
+		scope := strings.Join([]string{date, s.Region, s.Service, "aws4_request"}, "/")
+		sts := strings.Join([]string{sigV4Algorithm, stamp, scope, hashHex([]byte(canonical))}, "\n")
+		key := []byte("AWS4" + s.Secret)
+		for _, k := range []string{date, s.Region, s.Service, "aws4_request"} {
+			key = hmacSHA256(key, k)
+		}
+		req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+			sigV4Algorithm, s.KeyID, scope, list, hex.EncodeToString(hmacSHA256(key, sts))))
+	}
+	return nil
+}
+
+// signedHeaders adds the configured headers the request has to the scheme's own.
+func (s SigningConfig) signedHeaders(req *http.Request, signed []string) []string {
+	for _, h := range s.Headers {
+		if len(req.Header.Values(h)) > 0 {
+			signed = append(signed, strings.ToLower(h))
+		}
+	}
+	return signed
+}
+
+// payloadHash is the hex SHA-256 of the request body, read from GetBody.
+// A streamed body, without GetBody, can't be read twice, so it has to be sent with UnsignedPayload.
+func (s SigningConfig) payloadHash(req *http.Request) (string, error) {
+	if s.UnsignedPayload {
+		return unsignedPayload, nil
+	}
+	if req.Body == nil || req.Body == http.NoBody {
+		return hashHex(nil), nil
+	}
+	if req.GetBody == nil {
+		return "", fmt.Errorf("can't hash a streamed body, set %s.%s to send it", SigningKey, UnsignedPayloadKey)
+	}
+
+	body, err := req.GetBody()
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	_, err = io.Copy(h, body)
+	body.Close()
+	if err != nil {
+		return "", err
+	}
+	// Send a fresh copy too, so an upload's progress starts again from 0.
+	if body, err = req.GetBody(); err != nil {
+		return "", err
+	}
+	req.Body.Close()
+	req.Body = body
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// canonicalRequest returns the signed header list and the canonical request,
+// as described in the Request signing comment.
+func canonicalRequest(req *http.Request, headers []string, payload string) (signed, canonical string) {
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	values := make(map[string]string)
+	for _, h := range headers {
+		if h == "host" {
+			values[h] = host
+			continue
+		}
+		var vs []string
+		for _, v := range req.Header.Values(h) {
+			vs = append(vs, strings.Join(strings.Fields(v), " "))
+		}
+		values[h] = strings.Join(vs, ",")
+	}
+	names := make([]string, 0, len(values))
+	for h := range values {
+		names = append(names, h)
+	}
+	sort.Strings(names)
+	var ch strings.Builder
+	for _, h := range names {
+		ch.WriteString(h + ":" + values[h] + "\n")
+	}
+
+	signed = strings.Join(names, ";")
+	canonical = strings.Join([]string{
+		req.Method,
+		canonicalPath(req.URL),
+		canonicalQuery(req.URL),
+		ch.String(),
+		signed,
+		payload,
+	}, "\n")
+	return signed, canonical
+}
+
+func canonicalPath(u *url.URL) string {
+	if u.Path == "" {
+		return "/"
+	}
+	segments := strings.Split(u.Path, "/")
+	for i, s := range segments {
+		segments[i] = uriEncode(s)
+	}
+	return strings.Join(segments, "/")
+}
+
+func canonicalQuery(u *url.URL) string {
+	var params [][2]string
+	for k, vs := range u.Query() {
+		for _, v := range vs {
+			params = append(params, [2]string{uriEncode(k), uriEncode(v)})
+		}
+	}
+	sort.Slice(params, func(i, j int) bool {
+		if params[i][0] != params[j][0] {
+			return params[i][0] < params[j][0]
+		}
+		return params[i][1] < params[j][1]
+	})
+	pairs := make([]string, len(params))
+	for i, p := range params {
+		pairs[i] = p[0] + "=" + p[1]
+	}
+	return strings.Join(pairs, "&")
+}
+
+// uriEncode percent-encodes everything but the RFC 3986 unreserved characters.
+func uriEncode(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hashHex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// getSigningConfig reads the signing settings under the key sk.
+func getSigningConfig(sk string) SigningConfig {
+	key := func(k string) string { return fmt.Sprintf("%s.%s", sk, k) }
+	return SigningConfig{
+		Scheme:          viper.GetString(key(SigningSchemeKey)),
+		KeyID:           viper.GetString(key(KeyIDKey)),
+		Secret:          viper.GetString(key(SigningSecretKey)),
+		Headers:         viper.GetStringSlice(key(SignedHeadersKey)),
+		UnsignedPayload: viper.GetBool(key(UnsignedPayloadKey)),
+		Region:          viper.GetString(key(RegionKey)),
+		Service:         viper.GetString(key(ServiceKey)),
+		SessionToken:    viper.GetString(key(SessionTokenKey)),
+	}
+}
+
+func (s SigningConfig) mergeConfig(m map[string]interface{}) {
+	setKey(m, SigningSchemeKey, s.Scheme)
+	setKey(m, KeyIDKey, s.KeyID)
+	setKey(m, SigningSecretKey, s.Secret)
+	headers := make([]interface{}, len(s.Headers))
+	for i, h := range s.Headers {
+		headers[i] = h
+	}
+	setKey(m, SignedHeadersKey, headers)
+	setKey(m, UnsignedPayloadKey, s.UnsignedPayload)
+	setKey(m, RegionKey, s.Region)
+	setKey(m, ServiceKey, s.Service)
+	setKey(m, SessionTokenKey, s.SessionToken)
+}
+
+func (s SigningConfig) validate() error {
+	switch strings.ToLower(s.Scheme) {
+	case "":
+		return nil
+	case SigningSchemeHMAC:
+	case SigningSchemeSigV4:
+		if s.Region == "" || s.Service == "" {
+			return fmt.Errorf("%s needs a %s and %s", SigningSchemeSigV4, RegionKey, ServiceKey)
+		}
+	default:
+		return fmt.Errorf("unknown %s %q", SigningSchemeKey, s.Scheme)
+	}
+	if s.KeyID == "" || s.Secret == "" {
+		return fmt.Errorf("%s and %s are needed", KeyIDKey, SigningSecretKey)
+	}
+	for _, h := range s.Headers {
+		if h == "" || strings.ContainsAny(h, ": ") {
+			return fmt.Errorf("bad header name %q in %s", h, SignedHeadersKey)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,252 @@
+package conman
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func fixedSigningTime(t *testing.T) {
+	saved := signingNow
+	t.Cleanup(func() { signingNow = saved })
+	signingNow = func() time.Time { return time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC) }
+}
+
+// Cases from the AWS Signature Version 4 test suite.
+func TestSigV4Vectors(t *testing.T) {
+	fixedSigningTime(t)
+	s := SigningConfig{
+		Scheme:  SigningSchemeSigV4,
+		KeyID:   "AKIDEXAMPLE",
+		Secret:  "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+		Region:  "us-east-1",
+		Service: "service",
+	}
+	cases := []struct {
+		name      string
+		method    string
+		target    string
+		signature string
+	}{
+		{"get-vanilla", "GET", "/", "5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"},
+		{"get-vanilla-query-order-key-case", "GET", "/?Param2=value2&Param1=value1", "b97d918cfa904a5beff61c982a1b6f458b799221646efd99d3219ec94cdf2500"},
+		{"post-vanilla", "POST", "/", "5da7c1a2acd57cee7505fc6676e4e544621c30862966e37dddb68e92efbe5d6b"},
+	}
+	for _, c := range cases {
+		req, _ := http.NewRequest(c.method, "https://example.amazonaws.com"+c.target, nil)
+		if err := s.sign(req); err != nil {
+			t.Fatal(err)
+		}
+		expect := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=" + c.signature
+		if got := req.Header.Get("Authorization"); got != expect || req.Header.Get("X-Amz-Date") != "20150830T123600Z" {
+			t.Errorf("%s: got %q, expected %q", c.name, got, expect)
+		}
+	}
+}
+
+func TestHMACSigning(t *testing.T) {
+	fixedSigningTime(t)
+	s := SigningConfig{
+		Scheme:  SigningSchemeHMAC,
+		KeyID:   "partner",
+		Secret:  "s3cr3t",
+		Headers: []string{"Content-Type", "X-Request-Id", "X-Missing"},
+	}
+	req, _ := http.NewRequest("POST", "http://api.example.com/v1/my%20orders?z=last&a=2&sp=x+y&a=1", strings.NewReader(`{"id":1}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Request-Id", "  abc   def ")
+	if err := s.sign(req); err != nil {
+		t.Fatal(err)
+	}
+
+	digest := "037c9214eef74cc3887f3a4f085b4e17d76280dafd273b0ee160c09c4ba1cfd4"
+	canonical := "POST\n" +
+		"/v1/my%20orders\n" +
+		"a=1&a=2&sp=x%20y&z=last\n" +
+		"content-type:application/json\n" +
+		"host:api.example.com\n" +
+		"x-content-sha256:" + digest + "\n" +
+		"x-date:20150830T123600Z\n" +
+		"x-request-id:abc def\n" +
+		"\n" +
+		"content-type;host;x-content-sha256;x-date;x-request-id\n" +
+		digest
+	signed, got := canonicalRequest(req, []string{"host", "x-date", "x-content-sha256", "content-type", "x-request-id"}, digest)
+	if got != canonical || signed != "content-type;host;x-content-sha256;x-date;x-request-id" {
+		t.Errorf("Got canonical request:\n%s\nexpected:\n%s", got, canonical)
+	}
+	expect := "HMAC-SHA256 KeyId=partner, SignedHeaders=content-type;host;x-content-sha256;x-date;x-request-id, " +
+		"Signature=60a7c63d01937ca04893e9bfa9fef8bb3094e139e60f3b16c2d2ceb8a624f8a5"
+	if req.Header.Get("Authorization") != expect || req.Header.Get("X-Content-Sha256") != digest {
+		t.Errorf("Got Authorization %q", req.Header.Get("Authorization"))
+	}
+	// The body can still be sent.
+	if b, _ := ioutil.ReadAll(req.Body); string(b) != `{"id":1}` {
+		t.Errorf("Got body %q after signing", b)
+	}
+
+	if got := canonicalQuery(req.URL); got != "a=1&a=2&sp=x%20y&z=last" {
+		t.Errorf("Got query %q", got)
+	}
+	req.URL.RawQuery = "a-b=1&a=2&%E2%9C%93=%2F"
+	if got := canonicalQuery(req.URL); got != "%E2%9C%93=%2F&a=2&a-b=1" {
+		t.Errorf("Got query %q", got)
+	}
+}
+
+// A body that can't be read again isn't read into memory to hash it.
+func TestSignStreamedBody(t *testing.T) {
+	fixedSigningTime(t)
+	s := SigningConfig{Scheme: SigningSchemeHMAC, KeyID: "partner", Secret: "s3cr3t"}
+	stream := func() *http.Request {
+		req, _ := http.NewRequest("POST", "http://api.example.com/upload", ioutil.NopCloser(strings.NewReader("streamed")))
+		return req
+	}
+	if err := s.sign(stream()); err == nil || !strings.Contains(err.Error(), UnsignedPayloadKey) {
+		t.Errorf("Got error %v", err)
+	}
+
+	s.UnsignedPayload = true
+	req := stream()
+	if err := s.sign(req); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadAll(req.Body); string(b) != "streamed" || req.Header.Get("X-Content-Sha256") != unsignedPayload {
+		t.Errorf("Got body %q, payload hash %q", b, req.Header.Get("X-Content-Sha256"))
+	}
+}
+
+func TestSignedRequests(t *testing.T) {
+	// The server signs again when it gets the request, so both need the same time.
+	fixedSigningTime(t)
+	s := SigningConfig{Scheme: SigningSchemeHMAC, KeyID: "partner", Secret: "s3cr3t", Headers: []string{"X-Request-Id"}}
+
+	// The server checks the signature by signing what it got again.
+	var mu sync.Mutex
+	var signatures []string
+	failures := 1
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		body, _ := ioutil.ReadAll(r.Body)
+		check := r.Clone(r.Context())
+		check.Body = ioutil.NopCloser(bytes.NewReader(body))
+		check.GetBody = func() (io.ReadCloser, error) { return ioutil.NopCloser(bytes.NewReader(body)), nil }
+		if err := s.sign(check); err != nil {
+			t.Error(err)
+		}
+		got := r.Header.Get("Authorization")
+		if got != check.Header.Get("Authorization") || !strings.Contains(got, "x-request-id") {
+			t.Errorf("Got Authorization %q, expected %q", got, check.Header.Get("Authorization"))
+		}
+		signatures = append(signatures, got)
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	// Each attempt is signed again, after the middleware that sets X-Request-Id.
+	attempt := 0
+	conn := Connection{
+		Name:       "signed",
+		ServiceURL: server.URL,
+		AuthScheme: AuthSchemeNone,
+		Signing:    s,
+		Retry:      RetryPolicy{MaxAttempts: 2, BaseDelay: time.Millisecond, AllMethods: true, StatusCodes: []int{http.StatusServiceUnavailable}},
+	}
+	conn.Use(func(next RoundTripFunc) RoundTripFunc {
+		return func(conn *Connection, req *http.Request, effect *SideEffect) (*http.Response, error) {
+			attempt++
+			req.Header.Set("X-Request-Id", fmt.Sprintf("request-%d", attempt))
+			return next(conn, req, effect)
+		}
+	})
+	if _, _, err := conn.Post("/orders", map[string]int{"id": 1}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(signatures) != 2 || signatures[0] == signatures[1] {
+		t.Errorf("Got signatures %v", signatures)
+	}
+}
+
+func TestSigningConfig(t *testing.T) {
+	defer resetConfig()
+	t.Setenv("CONMAN_SIGNING_SECRET", "from-env")
+	viper.Set(ConnectionsKey, map[string]interface{}{
+		"aws": map[string]interface{}{
+			ServiceURLKey: "https://execute-api.us-west-2.amazonaws.com",
+			AuthSchemeKey: AuthSchemeNone,
+			SigningKey: map[string]interface{}{
+				SigningSchemeKey: "aws-sigv4",
+				KeyIDKey:         "AKID",
+				SigningSecretKey: "${CONMAN_SIGNING_SECRET}",
+				SignedHeadersKey: []interface{}{"Content-Type"},
+				RegionKey:        "us-west-2",
+				ServiceKey:       "execute-api",
+			},
+		},
+	})
+	conn, err := LoadConnection("aws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := SigningConfig{Scheme: "aws-sigv4", KeyID: "AKID", Secret: "from-env", Headers: []string{"Content-Type"}, Region: "us-west-2", Service: "execute-api"}
+	if fmt.Sprintf("%#v", conn.Signing) != fmt.Sprintf("%#v", want) {
+		t.Errorf("Got %#v", conn.Signing)
+	}
+	m := make(map[string]interface{})
+	conn.mergeConfig(m)
+	if fmt.Sprint(m[SigningKey]) != "map[headers:[Content-Type] keyID:AKID region:us-west-2 scheme:aws-sigv4 secret:${CONMAN_SIGNING_SECRET} service:execute-api]" {
+		t.Errorf("Got config %v", m[SigningKey])
+	}
+
+	for _, s := range []SigningConfig{
+		{Scheme: "md5", KeyID: "k", Secret: "s"},
+		{Scheme: SigningSchemeHMAC, KeyID: "k"},
+		{Scheme: SigningSchemeSigV4, KeyID: "k", Secret: "s", Region: "us-east-1"},
+		{Scheme: SigningSchemeHMAC, KeyID: "k", Secret: "s", Headers: []string{"X-Bad:"}},
+	} {
+		conn.Signing = s
+		if err := conn.validate(); err == nil {
+			t.Errorf("Expected an error for %#v", s)
+		}
+	}
+
+	// The signature is the Authorization header, so the token can't be.
+	// A connection that hasn't been validated can't send requests.
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { requests++ }))
+	defer server.Close()
+	unchecked := Connection{Name: "unchecked", ServiceURL: server.URL, AuthToken: "token", Signing: want}
+	if _, _, err := unchecked.Get("/", nil); err == nil || requests != 0 {
+		t.Errorf("Expected an error and no request, got %d requests, error: %v", requests, err)
+	}
+	conn.Signing = want
+	for _, c := range []struct {
+		scheme, header string
+		ok             bool
+	}{
+		{"", "", false},
+		{AuthSchemeBearer, "", false},
+		{AuthSchemeBasic, "", false},
+		{AuthSchemeHeader, "authorization", false},
+		{AuthSchemeHeader, "X-Api-Key", true},
+		{AuthSchemeQuery, "", true},
+	} {
+		conn.AuthScheme, conn.AuthHeader = c.scheme, c.header
+		if err := conn.validate(); (err == nil) != c.ok {
+			t.Errorf("%s %s: got error %v", c.scheme, c.header, err)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package conman
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Event is a server-sent event from a text/event-stream.
+type Event struct {
+	ID    string        // Last event ID, carried over from earlier events if this one doesn't set it.
+	Event string        // Event type, "message" if the server didn't say.
+	Data  string        // Data lines, joined with newlines.
+	Retry time.Duration // Reconnection time the server asked for with this event, if it did.
+}
+
+// EventOptions control Subscribe and Events.
+type EventOptions struct {
+	LastEventID string        // Sent as Last-Event-ID on the first request, to pick up where an earlier subscription left off.
+	Retry       time.Duration // Wait before reconnecting, until the server says otherwise. Defaults to DefaultEventRetry.
+}
+
+// DefaultEventRetry is how long to wait before reconnecting to an event stream.
+// MinEventRetry is the shortest wait a server can ask for, so a retry of 0 doesn't
+// have us reconnecting as fast as we can.
+var (
+	DefaultEventRetry = 3 * time.Second
+	MinEventRetry     = 100 * time.Millisecond
+)
+
+// EventStreamContentType is the media type of server-sent events.
+const EventStreamContentType = "text/event-stream"
+
+// Subscribe GETs cmd as a stream of server-sent events, calling fn with each one.
+// The connection's headers and auth are sent as usual. When the stream ends or the connection
+// drops, it reconnects, sending the last event ID it saw in Last-Event-ID.
+// It returns when ctx is cancelled (with ctx.Err()), or on an error that
+// reconnecting won't fix: an HTTP error, a response that isn't an event stream,
+// or a 204 No Content, which is the server asking us to stop (nil).
+// The connection's Timeout isn't used, the stream lasts as long as ctx.
+func (conn Connection) Subscribe(ctx context.Context, cmd string, opts EventOptions, fn func(Event)) error {
+	conn.Timeout = 0
+	log := conn.logger()
+	lastID := opts.LastEventID
+	retry := opts.Retry
+	if retry <= 0 {
+		retry = DefaultEventRetry
+	}
+
+	for {
+		done, err := conn.subscribeOnce(ctx, cmd, &lastID, &retry, fn)
+		if done {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		log.InfoContext(ctx, "event stream reconnecting", LogURLKey, newRedactor(&conn).url(conn.ServiceURL+cmd),
+			"lastEventID", lastID, "retry", retry, "error", err)
+		if err = sleepContext(ctx, retry); err != nil {
+			return err
+		}
+	}
+}
+
+// Events works like Subscribe, but delivers the events on a channel.
+// The error Subscribe would return is sent on errc, then both channels are closed.
+func (conn Connection) Events(ctx context.Context, cmd string, opts EventOptions) (events <-chan Event, errc <-chan error) {
+	ec := make(chan Event)
+	errs := make(chan error, 1)
+	go func() {
+		defer close(errs)
+		defer close(ec)
+		errs <- conn.Subscribe(ctx, cmd, opts, func(e Event) {
+			select {
+			case ec <- e:
+			case <-ctx.Done():
+			}
+		})
+	}()
+	return ec, errs
+}
+
+// subscribeOnce makes one request for the stream, and reads events until it ends.
+// done is true if there's no point reconnecting.
+func (conn Connection) subscribeOnce(ctx context.Context, cmd string, lastID *string, retry *time.Duration, fn func(Event)) (done bool, err error) {
+	id := *lastID
+	edit := func(req *http.Request) {
+		req.Header.Set("Accept", EventStreamContentType)
+		req.Header.Set("Cache-Control", "no-cache")
+		if id != "" {
+			req.Header.Set("Last-Event-ID", id)
+		}
+	}
+	so := conn.sendOptions(nil)
+	so.streamResponse = true
+	_, resp, err := conn.send(ctx, http.MethodGet, conn.ServiceURL+cmd, nil, nil, edit, so)
+	if err != nil {
+		// Network errors are worth another go, HTTP errors aren't.
+		if resp != nil || ctx.Err() != nil {
+			return true, err
+		}
+		return !isRetryableError(err), err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNoContent {
+		return true, nil
+	}
+	if mt, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mt != EventStreamContentType {
+		return true, &ContentTypeError{ContentType: resp.Header.Get("Content-Type"), URL: newRedactor(&conn).url(responseURL(resp))}
+	}
+
+	err = readEvents(resp.Body, lastID, retry, fn)
+	if ctx.Err() != nil {
+		return true, ctx.Err()
+	}
+	if err == nil {
+		err = io.EOF
+	}
+	return false, err
+}
+
+// readEvents parses an event stream, calling fn for each event.
+// It returns nil at the end of the stream.
+func readEvents(r io.Reader, lastID *string, retry *time.Duration, fn func(Event)) error {
+	br := bufio.NewReader(r)
+	var data strings.Builder
+	var eventType string
+	var eventRetry time.Duration
+	hasData := false
+
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil && (err != io.EOF || line == "") {
+			// An event that isn't finished by a blank line is dropped.
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+
+		if line == "" {
+			if hasData {
+				e := Event{ID: *lastID, Event: eventType, Data: data.String(), Retry: eventRetry}
+				if e.Event == "" {
+					e.Event = "message"
+				}
+				fn(e)
+			}
+			data.Reset()
+			eventType, eventRetry, hasData = "", 0, false
+			continue
+		}
+		if strings.HasPrefix(line, ":") {
+			continue // Comment.
+		}
+
+		field, value := line, ""
+		if i := strings.Index(line, ":"); i >= 0 {
+			field, value = line[:i], strings.TrimPrefix(line[i+1:], " ")
+		}
+		switch field {
+		case "event":
+			eventType = value
+		case "data":
+			if hasData {
+				data.WriteByte('\n')
+			}
+			data.WriteString(value)
+			hasData = true
+		case "id":
+			if !strings.ContainsRune(value, 0) {
+				*lastID = value
+			}
+		case "retry":
+			if ms, perr := strconv.ParseUint(value, 10, 63); perr == nil {
+				eventRetry = time.Duration(ms) * time.Millisecond
+				*retry = eventRetry
+				if *retry < MinEventRetry {
+					*retry = MinEventRetry
+				}
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+	}
+}
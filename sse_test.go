@@ -0,0 +1,135 @@
+package conman
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadEvents(t *testing.T) {
+	stream := ": comment\r\n" +
+		"retry: 1500\n" +
+		"id: 1\n" +
+		"event: status\n" +
+		"data: first\n" +
+		"data:second\n" +
+		"\n" +
+		"data: no id\r\n" +
+		"\r\n" +
+		"id\n" +
+		"\n" +
+		"id: 3\n" +
+		"data: unfinished"
+
+	var got []Event
+	lastID := ""
+	retry := time.Second
+	if err := readEvents(strings.NewReader(stream), &lastID, &retry, func(e Event) { got = append(got, e) }); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	expects := []Event{
+		{ID: "1", Event: "status", Data: "first\nsecond", Retry: 1500 * time.Millisecond},
+		{ID: "1", Event: "message", Data: "no id"},
+	}
+	if !reflect.DeepEqual(got, expects) {
+		t.Errorf("Expected %#v, got %#v", expects, got)
+	}
+	if lastID != "3" || retry != 1500*time.Millisecond {
+		t.Errorf("Got last ID %q, retry %v", lastID, retry)
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	var lastIDs []string
+	var times []time.Time
+	var auth string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lastIDs = append(lastIDs, r.Header.Get("Last-Event-ID"))
+		times = append(times, time.Now())
+		auth = r.Header.Get("Authorization")
+		if r.URL.Path == "/json" {
+			w.Header().Set("Content-Type", "application/json")
+			return
+		}
+		switch len(lastIDs) {
+		case 1:
+			w.Header().Set("Content-Type", EventStreamContentType)
+			fmt.Fprint(w, "id: 1\ndata: one\n\nid: 2\ndata: two\n\n")
+		case 2:
+			w.Header().Set("Content-Type", EventStreamContentType)
+			fmt.Fprint(w, "id: 3\nretry: 0\ndata: three\n\n")
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer ts.Close()
+
+	conn := Connection{ServiceURL: ts.URL, AuthToken: "abc", Timeout: time.Millisecond}
+	ctx := context.Background()
+
+	var data []string
+	err := conn.Subscribe(ctx, "/events", EventOptions{Retry: time.Millisecond}, func(e Event) {
+		data = append(data, e.ID+":"+e.Data)
+	})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if fmt.Sprint(data) != "[1:one 2:two 3:three]" {
+		t.Errorf("Got events %v", data)
+	}
+	if fmt.Sprint(lastIDs) != "[ 2 3]" {
+		t.Errorf("Got Last-Event-IDs %q", lastIDs)
+	}
+	// The server's retry of 0 is raised to the minimum.
+	if len(times) == 3 && times[2].Sub(times[1]) < MinEventRetry {
+		t.Errorf("Reconnected after %v", times[2].Sub(times[1]))
+	}
+	if auth != "Bearer abc" {
+		t.Errorf("Expected auth, got %q", auth)
+	}
+
+	lastIDs = nil
+	if err = conn.Subscribe(ctx, "/json", EventOptions{}, func(Event) {}); err == nil {
+		t.Errorf("Expected an error for a response that isn't an event stream.")
+	}
+}
+
+func TestEventsCancel(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", EventStreamContentType)
+		for i := 0; ; i++ {
+			if _, err := fmt.Fprintf(w, "id: %d\ndata: tick\n\n", i); err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(5 * time.Millisecond):
+			}
+		}
+	}))
+	defer ts.Close()
+
+	conn := Connection{ServiceURL: ts.URL}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, errc := conn.Events(ctx, "/ticks", EventOptions{})
+	n := 0
+	for e := range events {
+		if e.Data != "tick" {
+			t.Errorf("Unexpected event %#v", e)
+		}
+		if n++; n == 3 {
+			cancel()
+		}
+	}
+	if err := <-errc; err != context.Canceled {
+		t.Errorf("Expected context.Canceled, got: %v", err)
+	}
+}
@@ -0,0 +1,196 @@
+package conman
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// TLSConfig configures TLS for a connection's transport.
+// The zero value uses the system roots and no client certificate.
+type TLSConfig struct {
+	CAFile             string   // PEM file of CA certificates to trust, in addition to the system roots.
+	CertFile           string   // PEM client certificate, for mutual TLS.
+	KeyFile            string   // PEM key for the client certificate.
+	InsecureSkipVerify bool     // Don't verify the server's certificate chain or host name.
+	Pins               []string // SHA-256 hashes of the server's public key, see pinPrefix.
+}
+
+// Pins are the base64 encoded SHA-256 hash of a certificate's
+// SubjectPublicKeyInfo, optionally prefixed with "sha256/" (the format curl uses).
+// You can get one with:
+//
+//	openssl x509 -in cert.pem -pubkey -noout | openssl pkey -pubin -outform der |
+//	    openssl dgst -sha256 -binary | base64
+//
+// If any certificate in the verified chain matches any pin the connection is allowed.
+// With insecureSkipVerify there's no verified chain, so the server's own certificate must match.
+const pinPrefix = "sha256/"
+
+func (tc TLSConfig) isZero() bool {
+	return tc.CAFile == "" && tc.CertFile == "" && tc.KeyFile == "" &&
+		!tc.InsecureSkipVerify && len(tc.Pins) == 0
+}
+
+// filesVersion changes when one of the files is changed, so that a client that read
+// the old ones is replaced.
+func (tc TLSConfig) filesVersion() string {
+	var v []string
+	for _, f := range []string{tc.CAFile, tc.CertFile, tc.KeyFile} {
+		if f == "" {
+			continue
+		}
+		if fi, err := os.Stat(expandPath(f)); err == nil {
+			v = append(v, fmt.Sprintf("%d/%d", fi.ModTime().UnixNano(), fi.Size()))
+		}
+	}
+	return strings.Join(v, ",")
+}
+
+// tlsClientConfig builds the *tls.Config for a connection.
+// Returns nil if the connection doesn't have any TLS configuration.
+func (tc TLSConfig) tlsClientConfig() (cfg *tls.Config, err error) {
+	if tc.isZero() {
+		return nil, nil
+	}
+
+	cfg = &tls.Config{
+		InsecureSkipVerify: tc.InsecureSkipVerify,
+	}
+
+	if tc.CAFile != "" {
+		var pem []byte
+		if pem, err = ioutil.ReadFile(expandPath(tc.CAFile)); err != nil {
+			return nil, fmt.Errorf("couldn't read %s: %v", CAFileKey, err)
+		}
+		pool, poolErr := x509.SystemCertPool()
+		if poolErr != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s %q", CAFileKey, tc.CAFile)
+		}
+		cfg.RootCAs = pool
+	}
+
+	if tc.CertFile != "" || tc.KeyFile != "" {
+		if tc.CertFile == "" || tc.KeyFile == "" {
+			return nil, fmt.Errorf("both %s and %s are needed for a client certificate", CertFileKey, KeyFileKey)
+		}
+		cert, certErr := tls.LoadX509KeyPair(expandPath(tc.CertFile), expandPath(tc.KeyFile))
+		if certErr != nil {
+			return nil, fmt.Errorf("couldn't load client certificate: %v", certErr)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	if len(tc.Pins) > 0 {
+		pins := make(map[string]bool, len(tc.Pins))
+		for _, p := range tc.Pins {
+			pins[strings.TrimPrefix(strings.TrimSpace(p), pinPrefix)] = true
+		}
+		// This is called after the normal verification, if there is one. Then only the
+		// verified chains count, otherwise a server could add the pinned certificate to a
+		// chain of its own. Without verification only the server's own certificate counts.
+		insecure := tc.InsecureSkipVerify
+		cfg.VerifyPeerCertificate = func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+			if insecure {
+				if len(rawCerts) > 0 {
+					if cert, err := x509.ParseCertificate(rawCerts[0]); err == nil && pins[PublicKeyPin(cert)] {
+						return nil
+					}
+				}
+			} else {
+				for _, chain := range verifiedChains {
+					for _, cert := range chain {
+						if pins[PublicKeyPin(cert)] {
+							return nil
+						}
+					}
+				}
+			}
+			return fmt.Errorf("server certificate doesn't match any pinned public key")
+		}
+	}
+	return cfg, nil
+}
+
+// PublicKeyPin returns the pin for a certificate: the base64 encoded SHA-256
+// hash of its SubjectPublicKeyInfo.
+func PublicKeyPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// String is a short description for display.
+func (tc TLSConfig) String() string {
+	var s []string
+	if tc.CAFile != "" {
+		s = append(s, "ca="+tc.CAFile)
+	}
+	if tc.CertFile != "" {
+		s = append(s, "cert="+tc.CertFile)
+	}
+	if tc.InsecureSkipVerify {
+		s = append(s, "insecure")
+	}
+	if len(tc.Pins) > 0 {
+		s = append(s, fmt.Sprintf("pins=%d", len(tc.Pins)))
+	}
+	return strings.Join(s, " ")
+}
+
+// getTLSConfig reads the tls settings under the key tk.
+func getTLSConfig(tk string) TLSConfig {
+	key := func(k string) string { return fmt.Sprintf("%s.%s", tk, k) }
+	return TLSConfig{
+		CAFile:             viper.GetString(key(CAFileKey)),
+		CertFile:           viper.GetString(key(CertFileKey)),
+		KeyFile:            viper.GetString(key(KeyFileKey)),
+		InsecureSkipVerify: viper.GetBool(key(InsecureSkipVerifyKey)),
+		Pins:               viper.GetStringSlice(key(PinsKey)),
+	}
+}
+
+func (tc TLSConfig) mergeConfig(m map[string]interface{}) {
+	setKey(m, CAFileKey, tc.CAFile)
+	setKey(m, CertFileKey, tc.CertFile)
+	setKey(m, KeyFileKey, tc.KeyFile)
+	setKey(m, InsecureSkipVerifyKey, tc.InsecureSkipVerify)
+	pins := make([]interface{}, len(tc.Pins))
+	for i, p := range tc.Pins {
+		pins[i] = p
+	}
+	setKey(m, PinsKey, pins)
+}
+
+func (tc TLSConfig) validate() error {
+	if (tc.CertFile == "") != (tc.KeyFile == "") {
+		return fmt.Errorf("both %s and %s are needed for a client certificate", CertFileKey, KeyFileKey)
+	}
+	for _, p := range tc.Pins {
+		b, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(strings.TrimSpace(p), pinPrefix))
+		if err != nil || len(b) != sha256.Size {
+			return fmt.Errorf("pin %q isn't a base64 SHA-256 hash", p)
+		}
+	}
+	return nil
+}
+
+// expandPath replaces a leading ~ with the user's home directory.
+func expandPath(path string) string {
+	if path == "~" || strings.HasPrefix(path, "~/") {
+		if home, err := os.UserHomeDir(); err == nil {
+			return filepath.Join(home, path[1:])
+		}
+	}
+	return path
+}
@@ -0,0 +1,145 @@
+package conman
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTLSConfig(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "conman")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Server that requires a client certificate.
+	clientCert, clientKey := writeClientCert(t, dir)
+	clientPEM, _ := ioutil.ReadFile(clientCert)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AppendCertsFromPEM(clientPEM)
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	ts.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	ts.StartTLS()
+	defer ts.Close()
+
+	caFile := filepath.Join(dir, "ca.pem")
+	writePEM(t, caFile, "CERTIFICATE", ts.Certificate().Raw)
+	pin := PublicKeyPin(ts.Certificate())
+
+	cases := []struct {
+		name  string
+		tls   TLSConfig
+		fails bool
+	}{
+		{"No client certificate", TLSConfig{CAFile: caFile}, true},
+		{"Unknown CA", TLSConfig{CertFile: clientCert, KeyFile: clientKey}, true},
+		{"CA and client certificate", TLSConfig{CAFile: caFile, CertFile: clientCert, KeyFile: clientKey}, false},
+		{"Insecure", TLSConfig{InsecureSkipVerify: true, CertFile: clientCert, KeyFile: clientKey}, false},
+		{"Pinned", TLSConfig{CAFile: caFile, CertFile: clientCert, KeyFile: clientKey, Pins: []string{pinPrefix + pin}}, false},
+		{"Insecure but pinned", TLSConfig{InsecureSkipVerify: true, CertFile: clientCert, KeyFile: clientKey, Pins: []string{pin}}, false},
+		{"Wrong pin", TLSConfig{InsecureSkipVerify: true, CertFile: clientCert, KeyFile: clientKey,
+			Pins: []string{"47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="}}, true},
+		{"Missing key file", TLSConfig{CAFile: caFile, CertFile: clientCert}, true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			conn := Connection{Name: "tls", ServiceURL: ts.URL, TLS: c.tls}
+			_, _, err := conn.Get("/", nil)
+			if (err != nil) != c.fails {
+				t.Errorf("Got error: %v, expected error: %t", err, c.fails)
+			}
+		})
+	}
+}
+
+// A pinned certificate the server adds to a chain that doesn't include it doesn't count.
+func TestPinsUseVerifiedChain(t *testing.T) {
+	dir := t.TempDir()
+	pinnedFile, _ := writeClientCert(t, dir)
+	otherDir := t.TempDir()
+	otherFile, _ := writeClientCert(t, otherDir)
+	parse := func(fn string) *x509.Certificate {
+		b, _ := ioutil.ReadFile(fn)
+		block, _ := pem.Decode(b)
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert
+	}
+	pinned, other := parse(pinnedFile), parse(otherFile)
+	raw := [][]byte{other.Raw, pinned.Raw}
+
+	cfg, err := TLSConfig{Pins: []string{PublicKeyPin(pinned)}}.tlsClientConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cfg.VerifyPeerCertificate(raw, [][]*x509.Certificate{{other}}); err == nil {
+		t.Errorf("Expected the pin to fail when it's not in the verified chain")
+	}
+	if err = cfg.VerifyPeerCertificate(raw, [][]*x509.Certificate{{other, pinned}}); err != nil {
+		t.Errorf("Expected the pin in the verified chain to match: %v", err)
+	}
+
+	cfg, _ = TLSConfig{InsecureSkipVerify: true, Pins: []string{PublicKeyPin(pinned)}}.tlsClientConfig()
+	if err = cfg.VerifyPeerCertificate(raw, nil); err == nil {
+		t.Errorf("Expected the pin to fail when it's not the server's certificate")
+	}
+}
+
+// writeClientCert creates a self signed client certificate and key
+// and returns the names of the files they're in.
+func writeClientCert(t *testing.T, dir string) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "conman-test-client"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile = filepath.Join(dir, "client.pem")
+	keyFile = filepath.Join(dir, "client-key.pem")
+	writePEM(t, certFile, "CERTIFICATE", der)
+	writePEM(t, keyFile, "EC PRIVATE KEY", keyDER)
+	return certFile, keyFile
+}
+
+func writePEM(t *testing.T, fn, blockType string, der []byte) {
+	t.Helper()
+	b := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	if err := ioutil.WriteFile(fn, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
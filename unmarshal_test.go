@@ -0,0 +1,225 @@
+package conman
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// legacyUnmarshal is unmarshal as it was before responses were decoded from pooled
+// buffers or the stream, kept to benchmark against.
+// It restores the body to the resp, in any case.
+// An empty body leaves obj alone, a body we don't have a codec for is a *ContentTypeError.
+// Debug output goes to log, redacted with redact.
+func legacyUnmarshal(ctx context.Context, resp *http.Response, obj interface{}, decode DecodeOptions, accept string, log *slog.Logger, redact *redactor) (err error) {
+	var body []byte
+
+	// lifted from source to http.DumpResponse
+	// Save body
+	save := resp.Body
+	savecl := resp.ContentLength
+	if resp.Body == nil {
+		resp.Body = legacyEmptyBody
+	} else {
+		save, resp.Body, err = legacyDrainBody(resp.Body)
+		if err != nil {
+			return err
+		}
+	}
+
+	body, err = ioutil.ReadAll(resp.Body)
+	defer resp.Body.Close()
+	if err == nil {
+
+		if log.Enabled(ctx, slog.LevelDebug) {
+			var prettyJSON bytes.Buffer
+			if indentErr := json.Indent(&prettyJSON, redact.json(body), "", " "); indentErr == nil {
+				log.DebugContext(ctx, "pretty print response body", "body", prettyJSON.String())
+			} else {
+				log.DebugContext(ctx, "error indenting JSON", "error", indentErr,
+					"body", string(redact.body(resp.Header.Get("Content-Type"), body)))
+			}
+		}
+
+		ct := resp.Header.Get("Content-Type")
+		if len(body) > 0 {
+			var raw bool
+			if raw, err = decodeRaw(ct, body, obj); !raw {
+				err = decodeBody(ct, accept, body, obj, decode)
+				var cterr *ContentTypeError
+				if errors.As(err, &cterr) {
+					cterr.URL = redact.url(responseURL(resp))
+				} else if err != nil {
+					err = fmt.Errorf("couldn't decode response from %s: %w", redact.url(responseURL(resp)), err)
+				}
+			}
+		}
+		if err == nil && log.Enabled(ctx, slog.LevelDebug) {
+			// With redaction on we can't show the Go value, but we can show it re-encoded.
+			objStr := fmt.Sprintf("%#v", obj)
+			if redact != nil {
+				if b, mErr := json.Marshal(obj); mErr == nil {
+					objStr = string(redact.json(b))
+				}
+			}
+			log.DebugContext(ctx, "unmarshaled object", "object", objStr)
+		}
+	}
+
+	// Restore body.
+	resp.Body = save
+	resp.ContentLength = savecl
+	return err
+}
+
+var legacyEmptyBody = ioutil.NopCloser(strings.NewReader(""))
+
+// Copied from http.httputil/dump.go
+// http.DumpResponse keeps a copy of the body
+// around for use once its' been read off of the http.Resp.
+// Let's do that too.
+func legacyDrainBody(b io.ReadCloser) (r1, r2 io.ReadCloser, err error) {
+	if b == http.NoBody {
+		// no copying neede. Preserve the magic sentinel meaning of NoBody.
+		return http.NoBody, http.NoBody, nil
+	}
+	var buf bytes.Buffer
+	if _, err = buf.ReadFrom(b); err != nil {
+		return nil, b, err
+	}
+	if err = b.Close(); err != nil {
+		return nil, b, err
+	}
+	return ioutil.NopCloser(&buf), ioutil.NopCloser(bytes.NewReader(buf.Bytes())), nil
+}
+
+// listBody is a large JSON list, like the ones the benchmarks are about.
+func listBody(n int) []byte {
+	var b bytes.Buffer
+	b.WriteString("[")
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		fmt.Fprintf(&b, `{"id": %d, "name": "user-%d", "admin": false, "groups": ["a", "b", "c"], "server": "/user/%d/"}`, i, i, i)
+	}
+	b.WriteString("]")
+	return b.Bytes()
+}
+
+type benchUser struct {
+	ID     int      `json:"id"`
+	Name   string   `json:"name"`
+	Admin  bool     `json:"admin"`
+	Groups []string `json:"groups"`
+	Server string   `json:"server"`
+}
+
+func benchResponse(body []byte) *http.Response {
+	return &http.Response{
+		StatusCode:    http.StatusOK,
+		Header:        http.Header{"Content-Type": {"application/json"}},
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+	}
+}
+
+var quietLogger = slog.New(slog.NewTextHandler(ioutil.Discard, &slog.HandlerOptions{Level: slog.LevelWarn}))
+
+func benchmarkUnmarshal(b *testing.B, f func(*http.Response, interface{}) error) {
+	for _, n := range []int{10, 1000, 10000} {
+		body := listBody(n)
+		b.Run(strconv.Itoa(n), func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(body)))
+			for i := 0; i < b.N; i++ {
+				var users []benchUser
+				resp := benchResponse(body)
+				if err := f(resp, &users); err != nil || len(users) != n {
+					b.Fatalf("Got %d users, error: %v", len(users), err)
+				}
+				resp.Body.Close()
+			}
+		})
+	}
+}
+
+func BenchmarkUnmarshalLegacy(b *testing.B) {
+	benchmarkUnmarshal(b, func(resp *http.Response, obj interface{}) error {
+		return legacyUnmarshal(context.Background(), resp, obj, DecodeOptions{}, "", quietLogger, nil)
+	})
+}
+
+func BenchmarkUnmarshalRetained(b *testing.B) {
+	benchmarkUnmarshal(b, func(resp *http.Response, obj interface{}) error {
+		return unmarshal(context.Background(), resp, obj, DecodeOptions{}, "", quietLogger, nil)
+	})
+}
+
+func BenchmarkUnmarshalDiscarded(b *testing.B) {
+	benchmarkUnmarshal(b, func(resp *http.Response, obj interface{}) error {
+		return unmarshal(context.Background(), resp, obj, DecodeOptions{DiscardBody: true}, "", quietLogger, nil)
+	})
+}
+
+func TestUnmarshalBody(t *testing.T) {
+	body := listBody(100)
+
+	// Retained, the body can be read again.
+	var users []benchUser
+	resp := benchResponse(body)
+	if err := unmarshal(context.Background(), resp, &users, DecodeOptions{}, "", quietLogger, nil); err != nil || len(users) != 100 {
+		t.Fatalf("Got %d users, error: %v", len(users), err)
+	}
+	if b, _ := ioutil.ReadAll(resp.Body); !bytes.Equal(b, body) {
+		t.Errorf("Expected the body to be retained, got %d bytes", len(b))
+	}
+	resp.Body.Close()
+	if _, err := resp.Body.Read(make([]byte, 1)); err == nil {
+		t.Errorf("Expected an error reading a closed body.")
+	}
+
+	// Discarded, it's gone.
+	users = nil
+	resp = benchResponse(body)
+	if err := unmarshal(context.Background(), resp, &users, DecodeOptions{DiscardBody: true}, "", quietLogger, nil); err != nil || len(users) != 100 {
+		t.Fatalf("Got %d users, error: %v", len(users), err)
+	}
+	if b, _ := ioutil.ReadAll(resp.Body); len(b) != 0 {
+		t.Errorf("Expected the body to be discarded, got %d bytes", len(b))
+	}
+
+	// Empty.
+	resp = benchResponse(nil)
+	if err := unmarshal(context.Background(), resp, &users, DecodeOptions{DiscardBody: true}, "", quietLogger, nil); err != nil {
+		t.Errorf("Expected no error for an empty body, got: %v", err)
+	}
+
+	// Too large, either way.
+	for _, discard := range []bool{false, true} {
+		limit := int64(len(body) - 1)
+		err := unmarshal(context.Background(), benchResponse(body), &users, DecodeOptions{MaxBodySize: limit, DiscardBody: discard}, "", quietLogger, nil)
+		var tooLarge *BodyTooLargeError
+		if !errors.As(err, &tooLarge) || tooLarge.Limit != limit {
+			t.Errorf("Discard %v: expected a BodyTooLargeError, got: %v", discard, err)
+		}
+		if err = unmarshal(context.Background(), benchResponse(body), &users, DecodeOptions{MaxBodySize: int64(len(body)), DiscardBody: discard}, "", quietLogger, nil); err != nil {
+			t.Errorf("Discard %v: expected a body at the limit to be fine, got: %v", discard, err)
+		}
+	}
+
+	// Streamed to a writer.
+	var buf bytes.Buffer
+	if err := unmarshal(context.Background(), benchResponse(body), io.Writer(&buf), DecodeOptions{DiscardBody: true}, "", quietLogger, nil); err != nil || !bytes.Equal(buf.Bytes(), body) {
+		t.Errorf("Got %d bytes, error: %v", buf.Len(), err)
+	}
+}
@@ -0,0 +1,297 @@
+package conman
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Multipart is multipart/form-data content. Pass it as the content to Send,
+// Upload or a Request's Body and it's streamed to the server: files
+// aren't read into memory.
+//
+// If all the parts are Values or Paths, the content can be sent again, so the request can be retried,
+// and its length is known up front.
+type Multipart []Part
+
+// Part is a form field or file in Multipart content.
+// Set one of Value, Path or Reader.
+type Part struct {
+	FieldName   string
+	FileName    string // Sent for file parts, defaults to the base of Path.
+	ContentType string // Defaults from the FileName extension for file parts, none for fields.
+	Value       string
+	Path        string    // File to send, opened as it's sent.
+	Reader      io.Reader // Content to send, read as it's sent.
+}
+
+// FormField is a Part with a plain value.
+func FormField(name, value string) Part {
+	return Part{FieldName: name, Value: value}
+}
+
+// FilePart is a Part with the contents of the file at path.
+func FilePart(name, path string) Part {
+	return Part{FieldName: name, Path: path}
+}
+
+// ReaderPart is a Part with the contents of r, sent as a file called fileName.
+func ReaderPart(name, fileName string, r io.Reader) Part {
+	return Part{FieldName: name, FileName: fileName, Reader: r}
+}
+
+// ProgressFunc is called as a body is sent or received with the bytes done
+// so far, and the total if it's known (-1 if it isn't).
+type ProgressFunc func(done, total int64)
+
+// WithProgress calls fn as the request body is sent.
+func WithProgress(fn ProgressFunc) SendOption {
+	return func(o *sendOptions) {
+		o.progress = fn
+	}
+}
+
+// Upload sends parts as multipart/form-data, and decodes the response into result.
+// It's SendContext with Multipart content.
+func (conn Connection) Upload(ctx context.Context, method, cmd string, parts []Part, result interface{}, opts ...SendOption) (effect *SideEffect, resp *http.Response, err error) {
+	return conn.SendContext(ctx, method, cmd, Multipart(parts), result, opts...)
+}
+
+var quoteEscaper = strings.NewReplacer("\\", "\\\\", `"`, "\\\"")
+
+func (p Part) isFile() bool {
+	return p.Path != "" || p.Reader != nil
+}
+
+func (p Part) header() textproto.MIMEHeader {
+	h := make(textproto.MIMEHeader)
+	disposition := fmt.Sprintf(`form-data; name="%s"`, quoteEscaper.Replace(p.FieldName))
+	ct := p.ContentType
+	if p.isFile() {
+		fileName := p.FileName
+		if fileName == "" {
+			fileName = filepath.Base(p.Path)
+		}
+		disposition += fmt.Sprintf(`; filename="%s"`, quoteEscaper.Replace(fileName))
+		if ct == "" {
+			ct = mime.TypeByExtension(filepath.Ext(fileName))
+		}
+		if ct == "" {
+			ct = RawContentType
+		}
+	}
+	h.Set("Content-Disposition", disposition)
+	if ct != "" {
+		h.Set("Content-Type", ct)
+	}
+	return h
+}
+
+// size is the length of the part's content, -1 if it isn't known.
+func (p Part) size() int64 {
+	switch {
+	case p.Path != "":
+		fi, err := os.Stat(expandPath(p.Path))
+		if err != nil {
+			return -1
+		}
+		return fi.Size()
+	case p.Reader != nil:
+		if l, ok := p.Reader.(interface{ Len() int }); ok {
+			return int64(l.Len())
+		}
+		return -1
+	}
+	return int64(len(p.Value))
+}
+
+// rewindable is true if the content can be sent again.
+func (m Multipart) rewindable() bool {
+	for _, p := range m {
+		if p.Reader != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// length works out the size of the encoded content, -1 if it can't be known.
+func (m Multipart) length(boundary string) int64 {
+	var c countWriter
+	w := multipart.NewWriter(&c)
+	w.SetBoundary(boundary)
+	for _, p := range m {
+		size := p.size()
+		if size < 0 {
+			return -1
+		}
+		w.CreatePart(p.header())
+		c += countWriter(size)
+	}
+	w.Close()
+	return int64(c)
+}
+
+// write encodes the parts onto w.
+func (m Multipart) write(w *multipart.Writer) error {
+	for _, p := range m {
+		pw, err := w.CreatePart(p.header())
+		if err != nil {
+			return err
+		}
+		switch {
+		case p.Path != "":
+			err = copyFile(pw, p.Path)
+		case p.Reader != nil:
+			_, err = io.Copy(pw, p.Reader)
+		default:
+			_, err = io.WriteString(pw, p.Value)
+		}
+		if err != nil {
+			return fmt.Errorf("couldn't send %q: %w", p.FieldName, err)
+		}
+	}
+	return w.Close()
+}
+
+func copyFile(w io.Writer, path string) error {
+	f, err := os.Open(expandPath(path))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// body returns the content type, a function that returns a body that encodes the parts
+// as it's read, and the length of the body (-1 if it isn't known).
+func (m Multipart) body() (contentType string, open func() (io.ReadCloser, error), length int64) {
+	boundary := multipart.NewWriter(nil).Boundary()
+	length = m.length(boundary)
+	open = func() (io.ReadCloser, error) {
+		return &pipeBody{start: func(pw *io.PipeWriter) {
+			w := multipart.NewWriter(pw)
+			w.SetBoundary(boundary)
+			pw.CloseWithError(m.write(w))
+		}}, nil
+	}
+	return "multipart/form-data; boundary=" + boundary, open, length
+}
+
+// pipeBody is a request body written by a goroutine.
+// The goroutine isn't started until the body is read, so nothing
+// leaks if the request is never sent.
+type pipeBody struct {
+	once  sync.Once
+	pr    *io.PipeReader
+	start func(*io.PipeWriter)
+}
+
+func (b *pipeBody) init() {
+	b.once.Do(func() {
+		var pw *io.PipeWriter
+		b.pr, pw = io.Pipe()
+		go b.start(pw)
+	})
+}
+
+func (b *pipeBody) Read(p []byte) (int, error) {
+	b.init()
+	if b.pr == nil {
+		return 0, io.ErrClosedPipe
+	}
+	return b.pr.Read(p)
+}
+
+func (b *pipeBody) Close() error {
+	b.once.Do(func() {}) // Never start if not yet started.
+	if b.pr != nil {
+		return b.pr.Close()
+	}
+	return nil
+}
+
+// byteCounter counts bytes of a body as they go, and reports progress.
+// A nil *byteCounter doesn't count.
+type byteCounter struct {
+	n        int64
+	total    int64
+	progress ProgressFunc
+}
+
+func (c *byteCounter) add(n int) {
+	if c == nil || n == 0 {
+		return
+	}
+	done := atomic.AddInt64(&c.n, int64(n))
+	if c.progress != nil {
+		c.progress(done, c.total)
+	}
+}
+
+func (c *byteCounter) reset() {
+	atomic.StoreInt64(&c.n, 0)
+}
+
+// wrap returns a body that counts what's read from b.
+func (c *byteCounter) wrap(b io.ReadCloser) io.ReadCloser {
+	return &countingBody{ReadCloser: b, counter: c}
+}
+
+// countRequest counts the request body as it's sent, including when it's sent again on a retry.
+func (c *byteCounter) countRequest(req *http.Request) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return
+	}
+	c.total = req.ContentLength
+	if c.total <= 0 {
+		c.total = -1
+	}
+	req.Body = c.wrap(req.Body)
+	if getBody := req.GetBody; getBody != nil {
+		req.GetBody = func() (io.ReadCloser, error) {
+			b, err := getBody()
+			if err != nil {
+				return nil, err
+			}
+			c.reset()
+			return c.wrap(b), nil
+		}
+	}
+}
+
+func (c *byteCounter) count() int64 {
+	if c == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&c.n)
+}
+
+type countingBody struct {
+	io.ReadCloser
+	counter *byteCounter
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.counter.add(n)
+	return n, err
+}
+
+// countWriter counts what's written to it.
+type countWriter int64
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	*c += countWriter(len(p))
+	return len(p), nil
+}
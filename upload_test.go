@@ -0,0 +1,120 @@
+package conman
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestUpload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "data.txt")
+	content := strings.Repeat("0123456789", 10000)
+	if err = ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	type upload struct {
+		contentLength int64
+		fields        map[string]string
+		files         map[string]string
+		types         map[string]string
+		names         map[string]string
+	}
+	var got upload
+	fail := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail > 0 {
+			fail--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		got = upload{contentLength: r.ContentLength,
+			fields: map[string]string{}, files: map[string]string{}, types: map[string]string{}, names: map[string]string{}}
+		mr, err := r.MultipartReader()
+		if err != nil {
+			t.Errorf("Not multipart: %v", err)
+			return
+		}
+		for {
+			p, err := mr.NextPart()
+			if err != nil {
+				break
+			}
+			b, _ := ioutil.ReadAll(p)
+			if p.FileName() == "" {
+				got.fields[p.FormName()] = string(b)
+			} else {
+				got.files[p.FormName()] = string(b)
+				got.names[p.FormName()] = p.FileName()
+			}
+			got.types[p.FormName()] = p.Header.Get("Content-Type")
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"ok": true}`))
+	}))
+	defer ts.Close()
+
+	conn := Connection{ServiceURL: ts.URL, Retry: RetryPolicy{MaxAttempts: 2, BaseDelay: 1, AllMethods: true}}
+	ctx := context.Background()
+
+	var progress []int64
+	var total int64
+	var result struct{ OK bool }
+	fail = 1
+	effect, _, err := conn.Upload(ctx, http.MethodPost, "/upload", []Part{
+		FormField("description", "a file"),
+		FilePart("file", path),
+		{FieldName: "json", FileName: "meta", ContentType: "application/json", Value: `{"a": 1}`},
+	}, &result, WithProgress(func(done, t int64) {
+		progress = append(progress, done)
+		total = t
+	}))
+	if err != nil || !result.OK {
+		t.Fatalf("Got %#v, error: %v", result, err)
+	}
+	if effect.Attempts != 2 {
+		t.Errorf("Expected a retry, got %d attempts", effect.Attempts)
+	}
+	if got.fields["description"] != "a file" || got.files["file"] != content || got.names["file"] != "data.txt" {
+		t.Errorf("Got fields %v and file names %v", got.fields, got.names)
+	}
+	if got.types["file"] != "text/plain; charset=utf-8" || got.types["description"] != "" {
+		t.Errorf("Got content types %v", got.types)
+	}
+	if got.contentLength <= int64(len(content)) || effect.BytesSent != got.contentLength || total != got.contentLength {
+		t.Errorf("Expected %d bytes sent, got %d (progress total %d)", got.contentLength, effect.BytesSent, total)
+	}
+	if len(progress) == 0 || progress[len(progress)-1] != got.contentLength {
+		t.Errorf("Expected progress up to %d, got %v", got.contentLength, progress)
+	}
+
+	// A reader of unknown length is sent chunked, and can't be retried.
+	fail = 1
+	r := ioutil.NopCloser(strings.NewReader("streamed"))
+	_, _, err = conn.Request(http.MethodPut).Path("upload").
+		Body(Multipart{ReaderPart("stream", "stream.bin", r)}).
+		Do(ctx)
+	if err == nil {
+		t.Errorf("Expected the 503 without a retry.")
+	}
+	fail = 0
+	_, _, err = conn.Upload(ctx, http.MethodPost, "/upload", []Part{ReaderPart("stream", "stream.bin", ioutil.NopCloser(strings.NewReader("streamed")))}, nil)
+	if err != nil || got.contentLength != -1 || got.files["stream"] != "streamed" || got.types["stream"] != RawContentType {
+		t.Errorf("Got %#v, error: %v", got, err)
+	}
+
+	// A missing file is an error.
+	if _, _, err = conn.Upload(ctx, http.MethodPost, "/upload", []Part{FilePart("file", filepath.Join(dir, "missing"))}, nil); err == nil {
+		t.Errorf("Expected an error for a missing file.")
+	}
+}
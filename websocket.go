@@ -0,0 +1,154 @@
+package conman
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// WebSocketOptions control DialWebSocket.
+type WebSocketOptions struct {
+	// PingInterval is how often to ping the server. If a pong (or any other message)
+	// doesn't come back within twice this, reads fail. Zero uses DefaultPingInterval,
+	// a negative interval turns keepalive off.
+	PingInterval time.Duration
+	Subprotocols []string
+}
+
+// DefaultPingInterval is the keepalive ping interval for WebSockets.
+var DefaultPingInterval = 30 * time.Second
+
+// WebSocket is a WebSocket connection made with DialWebSocket.
+// ReadJSON and WriteJSON can be used from different goroutines, and WriteJSON from more than one.
+type WebSocket struct {
+	Conn *websocket.Conn // The underlying connection, for anything the helpers don't do.
+
+	decode    DecodeOptions
+	writeMu   sync.Mutex
+	pongWait  time.Duration
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+// DialWebSocket opens a WebSocket at cmd, relative to the ServiceURL, with http mapped to ws
+// and https to wss. The handshake carries the connection's Headers and auth,
+// and uses its TLS and proxy settings.
+// The response is the handshake response, which is useful when the handshake fails.
+func (conn Connection) DialWebSocket(ctx context.Context, cmd string, opts WebSocketOptions) (ws *WebSocket, resp *http.Response, err error) {
+	// Build the request as usual, so we get the headers and auth.
+	req, err := conn.newRequest(ctx, http.MethodGet, conn.ServiceURL+cmd, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	u := *req.URL
+	switch u.Scheme {
+	case "http":
+		u.Scheme = "ws"
+	case "https":
+		u.Scheme = "wss"
+	case "ws", "wss":
+	default:
+		return nil, nil, fmt.Errorf("can't open a WebSocket to %s", newRedactor(&conn).url(u.String()))
+	}
+
+	proxy, err := conn.proxy()
+	if err != nil {
+		return nil, nil, err
+	}
+	tlsConfig, err := conn.TLS.tlsClientConfig()
+	if err != nil {
+		return nil, nil, fmt.Errorf("connection %q: %v", conn.Name, err)
+	}
+	dialer := websocket.Dialer{
+		Proxy:            proxy,
+		TLSClientConfig:  tlsConfig,
+		HandshakeTimeout: conn.Timeout,
+		Subprotocols:     opts.Subprotocols,
+	}
+
+	log := conn.logger()
+	redact := newRedactor(&conn)
+	target := redact.url(u.String())
+	start := time.Now()
+	c, resp, err := dialer.DialContext(ctx, u.String(), req.Header)
+	if err != nil {
+		if resp != nil {
+			if herr := conn.checkReturnCode(resp, redact, conn.Decode.MaxBodySize); herr != nil {
+				err = fmt.Errorf("WebSocket handshake failed: %w", herr)
+			}
+		}
+		log.WarnContext(ctx, "WebSocket dial failed", LogURLKey, target, LogElapsedKey, time.Since(start), "error", err)
+		return nil, resp, err
+	}
+	log.InfoContext(ctx, "WebSocket open", LogURLKey, target, LogElapsedKey, time.Since(start))
+
+	ws = &WebSocket{Conn: c, decode: conn.Decode, stop: make(chan struct{})}
+	interval := opts.PingInterval
+	if interval == 0 {
+		interval = DefaultPingInterval
+	}
+	if interval > 0 {
+		ws.keepAlive(interval)
+	}
+	return ws, resp, nil
+}
+
+// keepAlive pings every interval, and expects to hear something back within twice that.
+func (ws *WebSocket) keepAlive(interval time.Duration) {
+	ws.pongWait = 2 * interval
+	ws.Conn.SetReadDeadline(time.Now().Add(ws.pongWait))
+	ws.Conn.SetPongHandler(func(string) error {
+		return ws.Conn.SetReadDeadline(time.Now().Add(ws.pongWait))
+	})
+
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ws.stop:
+				return
+			case <-t.C:
+				if err := ws.Conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(interval)); err != nil {
+					return
+				}
+			}
+		}
+	}()
+}
+
+// ReadJSON reads the next message and decodes it into v, with the connection's DecodeOptions.
+func (ws *WebSocket) ReadJSON(v interface{}) error {
+	_, r, err := ws.Conn.NextReader()
+	if err != nil {
+		return err
+	}
+	if ws.pongWait > 0 {
+		// A message is as good as a pong.
+		ws.Conn.SetReadDeadline(time.Now().Add(ws.pongWait))
+	}
+	return ws.decode.streamJSON(r, v)
+}
+
+// WriteJSON sends v as a JSON text message.
+func (ws *WebSocket) WriteJSON(v interface{}) error {
+	ws.writeMu.Lock()
+	defer ws.writeMu.Unlock()
+	return ws.Conn.WriteJSON(v)
+}
+
+// Close says goodbye to the server with a normal closure, and closes the connection.
+func (ws *WebSocket) Close() error {
+	var err error
+	ws.closeOnce.Do(func() {
+		close(ws.stop)
+		msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+		ws.Conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+		err = ws.Conn.Close()
+	})
+	return err
+}
@@ -0,0 +1,113 @@
+package conman
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestWebSocket(t *testing.T) {
+	var pings int32
+	upgrader := websocket.Upgrader{Subprotocols: []string{"v1"}}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer abc" || r.Header.Get("X-Test") != "header" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path != "/api/ws" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		c.SetPingHandler(func(data string) error {
+			atomic.AddInt32(&pings, 1)
+			return c.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+		})
+		// Reply from another goroutine, so we keep reading (and answering pings) while we wait.
+		var mu sync.Mutex
+		for {
+			var m map[string]interface{}
+			if err := c.ReadJSON(&m); err != nil {
+				return
+			}
+			go func() {
+				if d, ok := m["delay"].(float64); ok {
+					time.Sleep(time.Duration(d) * time.Millisecond)
+				}
+				m["echo"] = true
+				mu.Lock()
+				defer mu.Unlock()
+				c.WriteJSON(m)
+			}()
+		}
+	})
+
+	for _, secure := range []bool{false, true} {
+		var ts *httptest.Server
+		conn := Connection{
+			AuthToken: "abc",
+			Headers:   map[string]string{"X-Test": "header"},
+		}
+		if secure {
+			ts = httptest.NewTLSServer(handler)
+			conn.TLS.InsecureSkipVerify = true
+		} else {
+			ts = httptest.NewServer(handler)
+		}
+		conn.ServiceURL = ts.URL + "/api"
+		ctx := context.Background()
+
+		ws, _, err := conn.DialWebSocket(ctx, "/ws", WebSocketOptions{PingInterval: 20 * time.Millisecond, Subprotocols: []string{"v1"}})
+		if err != nil {
+			t.Fatalf("Secure %v, dial error: %v", secure, err)
+		}
+		if ws.Conn.Subprotocol() != "v1" {
+			t.Errorf("Expected subprotocol v1, got %q", ws.Conn.Subprotocol())
+		}
+
+		// The reply takes longer than the pong wait, keepalive has to keep the read going.
+		if err = ws.WriteJSON(map[string]interface{}{"n": 1, "delay": 100}); err != nil {
+			t.Fatalf("Write error: %v", err)
+		}
+		var got struct {
+			N    int
+			Echo bool
+		}
+		if err = ws.ReadJSON(&got); err != nil || got.N != 1 || !got.Echo {
+			t.Errorf("Got %#v, error: %v", got, err)
+		}
+		if atomic.LoadInt32(&pings) == 0 {
+			t.Errorf("Expected some pings.")
+		}
+		if err = ws.Close(); err != nil {
+			t.Errorf("Close error: %v", err)
+		}
+		ws.Close()
+
+		// Handshake failure.
+		c := conn
+		c.AuthToken = "wrong"
+		_, resp, err := c.DialWebSocket(ctx, "/ws", WebSocketOptions{})
+		var herr *HTTPError
+		if !errors.As(err, &herr) || herr.StatusCode != http.StatusUnauthorized || resp == nil {
+			t.Errorf("Expected an HTTPError, got: %v", err)
+		}
+		ts.Close()
+	}
+
+	conn := Connection{ServiceURL: "ftp://example.com"}
+	if _, _, err := conn.DialWebSocket(context.Background(), "/ws", WebSocketOptions{}); err == nil {
+		t.Errorf("Expected an error for an ftp URL.")
+	}
+}